@@ -0,0 +1,282 @@
+package natter
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"heckel.io/natter/internal"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How far the timestamp of a signed check-in may be off, to allow for clock skew
+	checkinMaxSkew = 5 * time.Minute
+)
+
+// Clients authenticate to the broker on the application layer, because gQUIC does not support
+// client certificates: the check-in request carries the client's certificate chain, and a
+// signature over the client ID, a timestamp and the fingerprint of the broker's public key.
+// Binding the signature to the broker's key means that a man in the middle cannot relay it to
+// the real broker, and the timestamp keeps it from being replayed later.
+//
+// The broker, in turn, is authenticated by the client after the QUIC handshake, see
+// verifyBrokerCertificate. quic-go already checks that the broker owns the key of the
+// certificate it presents, even though the client connects with InsecureSkipVerify.
+
+// clientCertificate returns the certificate that identifies the client to the broker, i.e. the
+// first certificate in TLSServerConfig (or the one returned by its GetCertificate function, see
+// client.getCertificate), if its common name is the client ID. Otherwise, it returns nil.
+func clientCertificate(config *Config) *tls.Certificate {
+	if config.TLSServerConfig == nil {
+		return nil
+	}
+
+	var certificate *tls.Certificate
+	if config.TLSServerConfig.GetCertificate != nil {
+		certificate, _ = config.TLSServerConfig.GetCertificate(&tls.ClientHelloInfo{})
+	}
+	if certificate == nil && len(config.TLSServerConfig.Certificates) > 0 {
+		certificate = &config.TLSServerConfig.Certificates[0]
+	}
+	if certificate == nil || len(certificate.Certificate) == 0 {
+		return nil
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil || leaf.Subject.CommonName != config.ClientId {
+		return nil
+	}
+
+	return certificate
+}
+
+// verifyBrokerCertificate checks the certificate chain the broker presented against the CA pool
+// and the pinned fingerprint (see Config.BrokerFingerprint), if any, and returns the fingerprint
+// of the broker's public key. The broker's certificate must be valid for the host part of addr.
+func verifyBrokerCertificate(pool *x509.CertPool, brokerFingerprint string, addr string, chain []*x509.Certificate) (string, error) {
+	if len(chain) == 0 {
+		if pool != nil || brokerFingerprint != "" {
+			return "", errors.New("broker did not present a certificate")
+		}
+		return "", nil
+	}
+
+	fingerprint, err := keyFingerprint(chain[0].PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	if brokerFingerprint != "" && !strings.EqualFold(fingerprint, brokerFingerprint) {
+		return "", errors.New("broker key fingerprint " + fingerprint + " does not match BrokerFingerprint")
+	}
+
+	if pool != nil {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = chain[0].Verify(x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         pool,
+			Intermediates: intermediatePool(chain[1:]),
+		})
+		if err != nil {
+			return "", errors.New("invalid broker certificate: " + err.Error())
+		}
+	}
+
+	return fingerprint, nil
+}
+
+// verifyPeerCertificate checks that the certificate chain a peer presented is signed by one of the
+// CAs in the pool, and issued to the given client ID, if the pool is set (see client.caPool). The peer
+// that accepts a connection cannot verify the dialing peer this way, since gQUIC does not support
+// client certificates; it relies on the broker, which authenticated the source of the forward.
+func verifyPeerCertificate(pool *x509.CertPool, peer string, chain []*x509.Certificate) error {
+	if pool == nil {
+		return nil
+	} else if len(chain) == 0 {
+		return errors.New("peer did not present a certificate")
+	}
+
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediatePool(chain[1:]),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return errors.New("invalid peer certificate: " + err.Error())
+	}
+
+	if chain[0].Subject.CommonName != peer {
+		return errors.New("peer certificate is issued to " + chain[0].Subject.CommonName + ", not " + peer)
+	}
+
+	return nil
+}
+
+// signCheckin adds the client's certificate chain and a signature to the check-in request,
+// see verifyCheckin. brokerFingerprint is the fingerprint of the broker's public key.
+func signCheckin(request *internal.CheckinRequest, certificate *tls.Certificate, brokerFingerprint string) error {
+	signer, ok := certificate.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("cannot sign check-in, unsupported private key")
+	}
+
+	request.Timestamp = time.Now().Unix()
+	digest := sha256.Sum256(checkinData(request.Source, request.Timestamp, brokerFingerprint))
+
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return errors.New("cannot sign check-in: " + err.Error())
+	}
+
+	request.Certificates = certificate.Certificate
+	request.Signature = signature
+
+	return nil
+}
+
+// verifyCheckin checks that the check-in request carries a certificate chain signed by one of the
+// CAs in the pool, that the certificate's common name is the client ID, and that the signature was
+// made for this broker (identified by the fingerprint of its public key) by the certificate's key.
+func verifyCheckin(pool *x509.CertPool, brokerFingerprint string, request *internal.CheckinRequest) error {
+	if len(request.Certificates) == 0 {
+		return errors.New("client did not present a certificate")
+	}
+
+	chain := make([]*x509.Certificate, 0, len(request.Certificates))
+	for _, der := range request.Certificates {
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return errors.New("invalid client certificate: " + err.Error())
+		}
+		chain = append(chain, certificate)
+	}
+
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediatePool(chain[1:]),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return errors.New("invalid client certificate: " + err.Error())
+	}
+
+	if chain[0].Subject.CommonName != request.Source {
+		return errors.New("client certificate is issued to " + chain[0].Subject.CommonName + ", not " + request.Source)
+	}
+
+	return verifyCheckinSignature(chain[0], brokerFingerprint, request)
+}
+
+// verifyCheckinKey checks that the check-in request is signed with the key with the given fingerprint,
+// i.e. the key a client was registered with. Unlike verifyCheckin, it does not need a CA, since the
+// broker knows the key; the certificate may be self-signed.
+func verifyCheckinKey(fingerprint string, brokerFingerprint string, request *internal.CheckinRequest) error {
+	if len(request.Certificates) == 0 {
+		return errors.New("client did not present a certificate for its registered key")
+	}
+
+	certificate, err := x509.ParseCertificate(request.Certificates[0])
+	if err != nil {
+		return errors.New("invalid client certificate: " + err.Error())
+	}
+
+	actual, err := keyFingerprint(certificate.PublicKey)
+	if err != nil {
+		return err
+	} else if !strings.EqualFold(actual, fingerprint) {
+		return errors.New("client key fingerprint " + actual + " does not match the registered key")
+	}
+
+	return verifyCheckinSignature(certificate, brokerFingerprint, request)
+}
+
+// verifyCheckinSignature checks that the check-in request was signed recently with the key of the
+// given certificate, for this broker (identified by the fingerprint of its public key)
+func verifyCheckinSignature(certificate *x509.Certificate, brokerFingerprint string, request *internal.CheckinRequest) error {
+	skew := time.Since(time.Unix(request.Timestamp, 0))
+	if skew > checkinMaxSkew || skew < -checkinMaxSkew {
+		return errors.New("check-in timestamp is off by " + skew.Round(time.Second).String())
+	}
+
+	var algorithm x509.SignatureAlgorithm
+	switch certificate.PublicKey.(type) {
+	case *rsa.PublicKey:
+		algorithm = x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		algorithm = x509.ECDSAWithSHA256
+	default:
+		return errors.New("invalid client certificate: unsupported public key")
+	}
+
+	data := checkinData(request.Source, request.Timestamp, brokerFingerprint)
+	if err := certificate.CheckSignature(algorithm, data, request.Signature); err != nil {
+		return errors.New("invalid check-in signature: " + err.Error())
+	}
+
+	return nil
+}
+
+// checkinData returns the data a client signs when checking in
+func checkinData(source string, timestamp int64, brokerFingerprint string) []byte {
+	return []byte("natter checkin " + source + " " + strconv.FormatInt(timestamp, 10) + " " + brokerFingerprint)
+}
+
+// enrollMac returns the HMAC-SHA256 of the given data with the enrollment token, which proves
+// to the broker that the client knows the token, and to the client that the broker does
+func enrollMac(token string, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("natter enroll"))
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// keyFingerprint returns the hex encoded SHA-256 hash of the DER encoded public key
+func keyFingerprint(publicKey interface{}) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", errors.New("invalid public key: " + err.Error())
+	}
+
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// tlsConfigFingerprint returns the fingerprint of the public key of the first certificate in the
+// TLS config, or an empty string if there is none
+func tlsConfigFingerprint(config *tls.Config) string {
+	if config == nil || len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+
+	certificate, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		return ""
+	}
+
+	fingerprint, _ := keyFingerprint(certificate.PublicKey)
+	return fingerprint
+}
+
+func intermediatePool(certificates []*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, certificate := range certificates {
+		pool.AddCert(certificate)
+	}
+	return pool
+}
@@ -0,0 +1,95 @@
+package natter
+
+import (
+	"crypto/x509"
+	"heckel.io/natter/internal"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerifyCheckin(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	otherCa := newTestCA(t, "Other CA")
+	alice := newTestCertificate(t, ca, "alice")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	otherPool := x509.NewCertPool()
+	otherPool.AddCert(otherCa.Leaf)
+
+	sign := func() *internal.CheckinRequest {
+		request := &internal.CheckinRequest{Source: "alice"}
+		if err := signCheckin(request, alice, "broker1"); err != nil {
+			t.Fatal(err)
+		}
+		return request
+	}
+
+	if err := verifyCheckin(pool, "broker1", sign()); err != nil {
+		t.Errorf("expected check-in to be verified, got %s", err)
+	}
+	if err := verifyCheckin(otherPool, "broker1", sign()); err == nil {
+		t.Errorf("expected certificate of another CA to be rejected")
+	}
+	if err := verifyCheckin(pool, "broker2", sign()); err == nil {
+		t.Errorf("expected check-in signed for another broker to be rejected")
+	}
+
+	request := sign()
+	request.Source = "bob"
+	if err := verifyCheckin(pool, "broker1", request); err == nil {
+		t.Errorf("expected certificate of alice to be rejected for bob")
+	}
+
+	request = sign()
+	request.Timestamp = time.Now().Add(-2 * checkinMaxSkew).Unix()
+	if err := verifyCheckin(pool, "broker1", request); err == nil {
+		t.Errorf("expected old check-in to be rejected")
+	}
+
+	request = sign()
+	request.Timestamp++
+	if err := verifyCheckin(pool, "broker1", request); err == nil {
+		t.Errorf("expected check-in with changed timestamp to be rejected")
+	}
+
+	request = sign()
+	request.Certificates = nil
+	if err := verifyCheckin(pool, "broker1", request); err == nil {
+		t.Errorf("expected check-in without certificate to be rejected")
+	}
+}
+
+func TestVerifyCheckinKey(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	alice := newTestCertificate(t, ca, "alice")
+	bob := newTestCertificate(t, ca, "bob")
+
+	leaf, err := x509.ParseCertificate(alice.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := keyFingerprint(leaf.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := &internal.CheckinRequest{Source: "alice"}
+	if err := signCheckin(request, alice, "broker1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCheckinKey(fingerprint, "broker1", request); err != nil {
+		t.Errorf("expected check-in with registered key to be verified, got %s", err)
+	}
+	if err := verifyCheckinKey(fingerprint, "broker2", request); err == nil {
+		t.Errorf("expected check-in signed for another broker to be rejected")
+	}
+
+	request = &internal.CheckinRequest{Source: "alice"}
+	if err := signCheckin(request, bob, "broker1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCheckinKey(fingerprint, "broker1", request); err == nil {
+		t.Errorf("expected check-in with another key to be rejected")
+	}
+}
@@ -1,75 +1,173 @@
 package natter
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"github.com/golang/protobuf/proto"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/qerr"
 	"heckel.io/natter/internal"
-	"log"
+	"math"
 	"net"
+	"sort"
 	"sync"
+	"time"
 )
 
-type broker struct {
-	config   *Config
-	clients  map[string]*brokerClient
-	forwards map[string]*brokerForward
+const (
+	brokerClientTimeout   = 3 * checkLoopSleep
+	brokerForwardTimeout  = 30 * time.Second
+	brokerCleanupInterval = 10 * time.Second
+	brokerRecentForwards  = 100
+	brokerInviteTtl       = 10 * time.Minute
+	brokerInviteMaxTtl    = 24 * time.Hour
+	brokerInviteTokenLen  = 8
+)
 
-	mutex sync.RWMutex
+type broker struct {
+	config      *Config
+	clients     map[string]*brokerClient
+	forwards    map[string]*brokerForward
+	recent      []*brokerForward
+	invites     map[string]*brokerInvite
+	enrollments map[string]*brokerEnrollment // Client ID -> enrollment token, see createEnrollment
+	metrics     *brokerMetrics
+	events      *eventBus
+	registry    Registry
+	self        string                    // Cluster address of this broker, see Config.ClusterAddr
+	remote      map[string]*RegistryEntry // Clients of other brokers, as of the last syncRegistry
+	links       map[string]*brokerClient  // Cluster address -> connection to another broker
+	store       *clientStore
+	fingerprint string // Fingerprint of the broker's public key, see verifyCheckin
+
+	mutex      sync.RWMutex
+	linksMutex sync.Mutex
 }
 
 type brokerClient struct {
-	session quic.Session
-	proto   *protocol
-	addr    *net.UDPAddr
+	id          string
+	session     quic.Session
+	proto       *protocol
+	addr        *net.UDPAddr
+	natType     string
+	localAddr   string
+	services    []string
+	allowPeers  []string
+	watching    []string
+	connected   time.Time
+	lastCheckin time.Time
+	broker      string // Cluster address, if this is another broker of the cluster, see handleBrokerHello
+	nonce       []byte // Challenge for a broker that sent a hello, see handleBrokerHello
 }
 
 type brokerForward struct {
-	source *brokerClient
-	target *brokerClient
+	id       string
+	source   *brokerClient
+	target   *brokerClient
+	request  *internal.ForwardRequest
+	created  time.Time
+	finished time.Time
+	outcome  string
+}
+
+// brokerInvite is a single-use invite to a client's TCP address, see Client.Share. The broker
+// only knows the token; the secret that authenticates the peers never passes through it.
+type brokerInvite struct {
+	token             string
+	client            string
+	targetForwardAddr string
+	expires           time.Time
 }
 
+const (
+	forwardOutcomeAccepted  = "accepted"
+	forwardOutcomeRefused   = "refused"
+	forwardOutcomeOffline   = "offline"
+	forwardOutcomeExpired   = "expired"
+	forwardOutcomeAborted   = "aborted"
+	forwardOutcomeNoService = "no-service"
+	forwardOutcomeDenied    = "denied"
+	forwardOutcomeNoInvite  = "no-invite"
+)
+
+const (
+	natTypeUnknown         = "unknown"
+	natTypeNone            = "none"
+	natTypePortPreserving  = "port-preserving"
+	natTypePortTranslating = "port-translating"
+)
+
 func NewBroker(config *Config) (Broker, error) {
 	newConfig, err := populateBrokerConfig(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &broker{
-		config: newConfig,
-		clients: make(map[string]*brokerClient),
-		forwards: make(map[string]*brokerForward),
-	}, nil
+	store, err := newClientStore(newConfig.ClientsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	broker := &broker{
+		config:      newConfig,
+		clients:     make(map[string]*brokerClient),
+		forwards:    make(map[string]*brokerForward),
+		recent:      make([]*brokerForward, 0),
+		invites:     make(map[string]*brokerInvite),
+		enrollments: make(map[string]*brokerEnrollment),
+		events:      newEventBus(),
+		registry:    newConfig.Registry,
+		self:        newConfig.ClusterAddr,
+		remote:      make(map[string]*RegistryEntry),
+		links:       make(map[string]*brokerClient),
+		store:       store,
+		fingerprint: tlsConfigFingerprint(newConfig.TLSServerConfig),
+	}
+	broker.metrics = newBrokerMetrics(broker)
+
+	return broker, nil
 }
 
 func (b *broker) ListenAndServe() error {
-	tlsServerConfig := *b.config.TLSServerConfig // copy, because quic-go alters it!
-	listener, err := quic.ListenAddr(b.config.BrokerAddr, &tlsServerConfig, b.config.QuicConfig)
+	tlsServerConfig := b.config.TLSServerConfig.Clone() // copy, because quic-go alters it!
+	listener, err := quic.ListenAddr(b.config.BrokerAddr, tlsServerConfig, b.config.QuicConfig)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Waiting for connections")
+	go b.cleanupLoop()
+
+	if b.config.AdminAddr != "" {
+		go b.listenAndServeAdmin()
+	}
+
+	if b.config.MetricsAddr != "" {
+		go b.metrics.registry.listenAndServe(b.config.MetricsAddr, b.config.Logger)
+	}
+
+	b.config.Logger.Info("Waiting for connections", "addr", b.config.BrokerAddr, "fingerprint", b.fingerprint)
 
 	for {
 		session, err := listener.Accept()
 		if err != nil {
-			log.Println("Accepting client failed: " + err.Error())
+			b.config.Logger.Error("Accepting client failed", "error", err)
 			continue
 		}
 
 		go b.handleSession(session)
 	}
+}
 
-	return nil
+func (b *broker) Subscribe(handler EventHandler) func() {
+	return b.events.subscribe(handler)
 }
 
 func (b *broker) handleSession(session quic.Session) {
 	for {
 		stream, err := session.AcceptStream()
 		if err != nil {
-			log.Println("Session err: " + err.Error())
+			b.config.Logger.Debug("Session closed", "addr", session.RemoteAddr(), "error", err)
 			session.Close()
 			return
 		}
@@ -77,7 +175,7 @@ func (b *broker) handleSession(session quic.Session) {
 		client := &brokerClient{
 			addr:    session.RemoteAddr().(*net.UDPAddr),
 			session: session,
-			proto:   &protocol{stream: stream},
+			proto:   &protocol{stream: stream, logger: b.config.Logger, messageSize: b.metrics.messageSize},
 		}
 
 		go b.handleClient(client)
@@ -90,17 +188,29 @@ func (b *broker) handleClient(client *brokerClient) {
 
 		if err != nil {
 			if quicerr, ok := err.(*qerr.QuicError); ok && quicerr.ErrorCode == qerr.NetworkIdleTimeout {
-				log.Println("Network idle timeout. Closing stream: " + err.Error())
-				client.session.Close()
-				break
+				b.config.Logger.Debug("Network idle timeout, closing session", "client", client.id, "addr", client.addr, "error", err)
+			} else {
+				b.config.Logger.Info("Cannot read message, closing session", "client", client.id, "addr", client.addr, "error", err)
 			}
 
-
-			log.Println("Cannot read message: " + err.Error() + ". Closing session.")
 			client.session.Close()
+			b.removeLink(client)
+			b.removeClient(client)
 			break
 		}
 
+		// Other brokers of the cluster only relay forwards
+		if client.broker != "" && messageType != messageTypeForwardRequest && messageType != messageTypeForwardResponse {
+			b.config.Logger.Info("Ignoring unexpected message from broker", "broker", client.broker, "type", messageTypes[messageType])
+			continue
+		}
+
+		// Clients must check in before anything else, since that is where they are authenticated
+		if client.broker == "" && client.id == "" && messageType != messageTypeCheckinRequest && messageType != messageTypeEnrollRequest && messageType != messageTypeBrokerHello {
+			b.config.Logger.Info("Ignoring message from client that did not check in", "addr", client.addr, "type", messageTypes[messageType])
+			continue
+		}
+
 		switch messageType {
 		case messageTypeCheckinRequest:
 			b.handleCheckinRequest(client, message.(*internal.CheckinRequest))
@@ -108,50 +218,206 @@ func (b *broker) handleClient(client *brokerClient) {
 			b.handleForwardRequest(client, message.(*internal.ForwardRequest))
 		case messageTypeForwardResponse:
 			b.handleForwardResponse(client, message.(*internal.ForwardResponse))
+		case messageTypePeersRequest:
+			b.handlePeersRequest(client, message.(*internal.PeersRequest))
+		case messageTypePresenceRequest:
+			b.handlePresenceRequest(client, message.(*internal.PresenceRequest))
+		case messageTypeInviteRequest:
+			b.handleInviteRequest(client, message.(*internal.InviteRequest))
+		case messageTypeBrokerHello:
+			b.handleBrokerHello(client, message.(*internal.BrokerHello))
+		case messageTypeEnrollRequest:
+			b.handleEnrollRequest(client, message.(*internal.EnrollRequest))
 		}
 	}
 }
 
 func (b *broker) handleCheckinRequest(client *brokerClient, request *internal.CheckinRequest) {
 	remoteAddr := fmt.Sprintf("%s:%d", client.addr.IP, client.addr.Port)
+	b.metrics.checkins.inc()
+
+	// Clients prove their identity once per stream; later check-ins must use the same client ID
+	if client.id != request.Source {
+		if err := b.authenticateCheckin(request); err != nil {
+			b.config.Logger.Info("Client not authenticated, closing session", "client", request.Source, "addr", remoteAddr, "error", err)
+			client.session.Close()
+			return
+		}
+	}
 
-	log.Println("Client", request.Source, "with address", remoteAddr, "connected")
+	if b.config.RestrictClients {
+		if known, ok := b.store.get(request.Source); !ok || !known.Registered {
+			b.config.Logger.Info("Client is not registered, closing session", "client", request.Source, "addr", remoteAddr)
+			client.session.Close()
+			return
+		}
+	}
+
+	if b.store.revoked(request.Source) {
+		b.config.Logger.Info("Client is revoked, closing session", "client", request.Source, "addr", remoteAddr)
+		client.session.Close()
+		return
+	}
 
 	b.mutex.Lock()
+
+	existing, ok := b.clients[request.Source]
+
+	client.id = request.Source
+	client.natType = guessNatType(request.LocalAddr, remoteAddr)
+	client.localAddr = request.LocalAddr
+	client.services = request.Services
+	client.allowPeers = request.AllowPeers
+	client.lastCheckin = time.Now()
+	if client.connected.IsZero() {
+		client.connected = client.lastCheckin
+	}
+
 	b.clients[request.Source] = client
+
+	connected := !ok || existing != client
+	if connected {
+		b.config.Logger.Info("Client connected", "client", request.Source, "addr", remoteAddr, "nat", client.natType)
+		b.events.publish(Event{Type: EventClientConnected, Client: request.Source, Addr: remoteAddr})
+	}
+
+	for id, conn := range b.clients {
+		b.config.Logger.Debug("Control table", "client", id, "addr", conn.addr)
+	}
 	b.mutex.Unlock()
 
-	log.Println("Control table:")
-	for client, conn := range b.clients {
-		log.Println("-", client, conn.addr)
+	// The client re-connected with a new session, so the old one is stale
+	if ok && existing != client {
+		b.config.Logger.Info("Closing stale session", "client", request.Source, "addr", existing.addr)
+		b.removeForwards(existing)
+		existing.session.Close()
 	}
 
 	err := client.proto.send(messageTypeCheckinResponse, &internal.CheckinResponse{Addr: remoteAddr})
 	if err != nil {
-		log.Println("Cannot respond to client: " + err.Error())
+		b.config.Logger.Error("Cannot respond to client", "client", request.Source, "error", err)
+	}
+
+	if connected {
+		b.notifyPresence(client, true)
 	}
+
+	b.store.seen(request.Source, remoteAddr)
+	b.register(client)
+}
+
+// authenticateCheckin checks the certificate chain and signature of the check-in, if the broker
+// has a CA pool (see verifyCheckin), and that the check-in is signed with the registered key of
+// the client, if it was registered with one (see natter broker clients add)
+func (b *broker) authenticateCheckin(request *internal.CheckinRequest) error {
+	if b.config.CAPool != nil {
+		if err := verifyCheckin(b.config.CAPool, b.fingerprint, request); err != nil {
+			return err
+		}
+	}
+
+	if known, ok := b.store.get(request.Source); ok && known.Fingerprint != "" {
+		return verifyCheckinKey(known.Fingerprint, b.fingerprint, request)
+	}
+
+	return nil
 }
 
 func (b *broker) handleForwardRequest(client *brokerClient, request *internal.ForwardRequest) {
+	// Forwards relayed by another broker of the cluster carry the source client's identity and
+	// address. Clients can only request forwards for themselves, i.e. the source is the ID they
+	// checked in with.
+	sourceAddr := fmt.Sprintf("%s:%d", client.addr.IP, client.addr.Port)
+	if client.broker != "" {
+		sourceAddr = request.SourceAddr
+	} else {
+		request.Source = client.id
+	}
+	source := request.Source
+
+	b.events.publish(Event{Type: EventForwardRequested, Client: request.Source, Forward: request.Id, Addr: sourceAddr})
+
+	// Invites are redeemed by the broker of the inviting client, i.e. they cannot be used again, even
+	// if the forward fails. Invites of clients of other brokers are relayed to them (see lookupInvite).
+	// The invite determines target and address; the inviting client allowed the source by sharing it.
+	if request.Invite != "" {
+		b.mutex.Lock()
+		invite, ok := b.invites[request.Invite]
+		delete(b.invites, request.Invite)
+		b.mutex.Unlock()
+
+		var owner *RegistryEntry
+		if !ok && client.broker == "" {
+			owner = b.lookupInvite(request.Invite)
+		}
+
+		if owner != nil {
+			b.config.Logger.Info("Invite was created via another broker, relaying forward", "forward", request.Id, "source", request.Source, "target", owner.ClientId, "broker", owner.Broker)
+			request.Target = owner.ClientId
+		} else if !ok || time.Now().After(invite.expires) || (client.broker != "" && invite.client != request.Target) {
+			b.config.Logger.Info("Rejecting forward, invite is invalid or expired", "forward", request.Id, "source", request.Source)
+			b.rejectForward(client, request, forwardOutcomeNoInvite)
+			return
+		} else {
+			b.config.Logger.Info("Invite redeemed", "forward", request.Id, "source", request.Source, "target", invite.client)
+			request.Target = invite.client
+			request.TargetForwardAddr = invite.targetForwardAddr
+		}
+
+		request.TargetCommand = nil
+		request.TargetService = ""
+	}
+
 	b.mutex.RLock()
-	target , ok := b.clients[request.Target]
+	target, ok := b.clients[request.Target]
+	if ok && time.Since(target.lastCheckin) > brokerClientTimeout {
+		ok = false
+	}
+	allowed := ok && (request.Invite != "" || target.allows(source))
+	offered := ok && (request.TargetService == "" || isBuiltinService(request.TargetService) || target.offers(request.TargetService))
 	b.mutex.RUnlock()
 
-	if !ok {
-		err := client.proto.send(messageTypeForwardResponse, &internal.ForwardResponse{
-			Id:      request.Id,
-			Success: false,
-		})
-		if err != nil {
-			log.Printf("Failed to respond to forward request: " + err.Error())
+	// Clients of other brokers are reached via their broker, but forwards are never relayed twice
+	var remote *RegistryEntry
+	if !ok && client.broker == "" {
+		if remote = b.lookupRemote(request.Target); remote != nil {
+			ok = true
+			allowed = request.Invite != "" || remote.allows(source)
+			offered = request.TargetService == "" || isBuiltinService(request.TargetService) || remote.offers(request.TargetService)
+		}
+	}
+
+	if ok && remote != nil && allowed && offered {
+		var err error
+		if target, err = b.link(remote.Broker); err != nil {
+			b.config.Logger.Error("Cannot connect to broker of target client", "forward", request.Id, "target", request.Target, "broker", remote.Broker, "error", err)
+			ok = false
 		}
+	}
+
+	if !ok {
+		b.config.Logger.Info("Rejecting forward, target client is not connected", "forward", request.Id, "source", request.Source, "target", request.Target)
+		b.rejectForward(client, request, forwardOutcomeOffline)
+	} else if !allowed {
+		b.config.Logger.Info("Rejecting forward, target client does not allow source", "forward", request.Id, "source", request.Source, "target", request.Target)
+		b.rejectForward(client, request, forwardOutcomeDenied)
+	} else if !offered {
+		b.config.Logger.Info("Rejecting forward, target client does not offer service", "forward", request.Id, "source", request.Source, "target", request.Target, "service", request.TargetService)
+		b.rejectForward(client, request, forwardOutcomeNoService)
 	} else {
 		forward := &brokerForward{
-			source: client,
-			target: nil,
+			id:      request.Id,
+			source:  client,
+			target:  target,
+			request: request,
+			created: time.Now(),
 		}
 
-		log.Printf("Adding new connection %s\n", request.Id)
+		if remote != nil {
+			b.config.Logger.Info("Relaying forward to broker of target client", "forward", request.Id, "source", request.Source, "target", request.Target, "broker", remote.Broker)
+		} else {
+			b.config.Logger.Info("Brokering forward", "forward", request.Id, "source", request.Source, "target", request.Target)
+		}
 
 		b.mutex.Lock()
 		b.forwards[request.Id] = forward
@@ -160,31 +426,409 @@ func (b *broker) handleForwardRequest(client *brokerClient, request *internal.Fo
 		err := target.proto.send(messageTypeForwardRequest, &internal.ForwardRequest{
 			Id:                request.Id,
 			Source:            request.Source,
-			SourceAddr:        fmt.Sprintf("%s:%d", client.addr.IP, client.addr.Port),
+			SourceAddr:        sourceAddr,
 			Target:            request.Target,
-			TargetAddr:        fmt.Sprintf("%s:%d", target.addr.IP, target.addr.Port),
+			TargetAddr:        fmt.Sprintf("%s:%d", target.addr.IP, target.addr.Port), // Replaced by the target's broker, if relayed
 			TargetForwardAddr: request.TargetForwardAddr,
 			TargetCommand:     request.TargetCommand,
+			TargetService:     request.TargetService,
+			Invite:            request.Invite,
+			Compression:       request.Compression,
+			SingleSession:     request.SingleSession,
 		})
 		if err != nil {
-			log.Printf("Failed to respond to forward request: " + err.Error())
+			b.config.Logger.Error("Failed to relay forward request", "forward", request.Id, "target", request.Target, "error", err)
 		}
 	}
 }
 
-func (b *broker) handleForwardResponse(client *brokerClient, response *internal.ForwardResponse) {
+// handleInviteRequest mints a single-use invite token for the given TCP address on the requesting
+// client. A forward request with the token is brokered to the client, see handleForwardRequest.
+func (b *broker) handleInviteRequest(client *brokerClient, request *internal.InviteRequest) {
+	ttl := time.Duration(request.Ttl) * time.Second
+	if ttl <= 0 {
+		ttl = brokerInviteTtl
+	} else if ttl > brokerInviteMaxTtl {
+		ttl = brokerInviteMaxTtl
+	}
+
+	response := &internal.InviteResponse{Id: request.Id}
+
+	token, err := randomCode(brokerInviteTokenLen)
+	if err != nil {
+		b.config.Logger.Error("Cannot generate invite token", "client", client.id, "error", err)
+	} else if request.TargetForwardAddr == "" {
+		b.config.Logger.Info("Rejecting invite, address is empty", "client", client.id)
+	} else {
+		invite := &brokerInvite{
+			token:             token,
+			client:            client.id,
+			targetForwardAddr: request.TargetForwardAddr,
+			expires:           time.Now().Add(ttl),
+		}
+
+		b.mutex.Lock()
+		b.invites[token] = invite
+		b.mutex.Unlock()
+
+		b.config.Logger.Info("Invite created", "client", client.id, "expires", invite.expires)
+		b.register(client) // Other brokers of the cluster find the invite via the registry
+
+		response.Success = true
+		response.Token = token
+		response.Expires = invite.expires.Unix()
+	}
+
+	if err := client.proto.send(messageTypeInviteResponse, response); err != nil {
+		b.config.Logger.Error("Failed to respond to invite request", "client", client.id, "error", err)
+	}
+}
+
+// handlePeersRequest responds with the list of connected clients that the requesting
+// client is allowed to connect to, along with the services they advertised.
+func (b *broker) handlePeersRequest(client *brokerClient, request *internal.PeersRequest) {
+	peers := make([]*internal.Peer, 0)
+
 	b.mutex.RLock()
-	forward, ok := b.forwards[response.Id]
+	for id, peer := range b.clients {
+		if id == client.id || time.Since(peer.lastCheckin) > brokerClientTimeout || !peer.allows(client.id) {
+			continue
+		}
+
+		peers = append(peers, &internal.Peer{
+			Id:       id,
+			NatType:  peer.natType,
+			Services: peer.services,
+		})
+	}
 	b.mutex.RUnlock()
 
+	for _, entry := range b.remoteClients() {
+		if entry.ClientId != client.id && entry.allows(client.id) {
+			peers = append(peers, &internal.Peer{
+				Id:       entry.ClientId,
+				NatType:  entry.NatType,
+				Services: entry.Services,
+			})
+		}
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Id < peers[j].Id })
+
+	err := client.proto.send(messageTypePeersResponse, peersPage(request.Id, peers, int(request.Offset)))
+	if err != nil {
+		b.config.Logger.Error("Failed to respond to peers request", "client", client.id, "error", err)
+	}
+}
+
+// peersPage returns the response with the peers from the given offset that fit into a single
+// message (see maxMessageLength), along with the offset of the next page, if there are more.
+// Peers that do not even fit into a message on their own are skipped.
+func peersPage(id string, peers []*internal.Peer, offset int) *internal.PeersResponse {
+	response := &internal.PeersResponse{
+		Id:    id,
+		Peers: make([]*internal.Peer, 0),
+	}
+
+	size := proto.Size(&internal.PeersResponse{Id: id, Next: math.MaxInt32})
+	for i := offset; i < len(peers); i++ {
+		peerSize := proto.Size(peers[i]) + 4 // Field tag and length
+		if size+peerSize > maxMessageLength {
+			if len(response.Peers) > 0 {
+				response.Next = int32(i)
+				break
+			}
+			continue
+		}
+
+		response.Peers = append(response.Peers, peers[i])
+		size += peerSize
+	}
+
+	return response
+}
+
+// handlePresenceRequest replaces the list of peers the client wants presence updates for,
+// and immediately sends an update for each of them that is currently online.
+func (b *broker) handlePresenceRequest(client *brokerClient, request *internal.PresenceRequest) {
+	online := make([]string, 0)
+
+	b.mutex.Lock()
+	client.watching = request.Peers
+	for _, id := range request.Peers {
+		peer, ok := b.clients[id]
+		if ok && peer != client && time.Since(peer.lastCheckin) <= brokerClientTimeout && peer.allows(client.id) {
+			online = append(online, id)
+		} else if entry, ok := b.remote[id]; ok && entry.allows(client.id) {
+			online = append(online, id)
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, id := range online {
+		err := client.proto.send(messageTypePresenceUpdate, &internal.PresenceUpdate{Peer: id, Online: true})
+		if err != nil {
+			b.config.Logger.Error("Failed to send presence update", "client", client.id, "peer", id, "error", err)
+		}
+	}
+}
+
+// notifyPresence informs all clients that are watching the given client that it
+// came online or went away. Clients that are not allowed to see it are skipped.
+func (b *broker) notifyPresence(peer *brokerClient, online bool) {
+	watchers := make([]*brokerClient, 0)
+
+	b.mutex.RLock()
+	for _, client := range b.clients {
+		if client != peer && client.watches(peer.id) && peer.allows(client.id) {
+			watchers = append(watchers, client)
+		}
+	}
+	b.mutex.RUnlock()
+
+	for _, client := range watchers {
+		err := client.proto.send(messageTypePresenceUpdate, &internal.PresenceUpdate{Peer: peer.id, Online: online})
+		if err != nil {
+			b.config.Logger.Error("Failed to send presence update", "client", client.id, "peer", peer.id, "error", err)
+		}
+	}
+}
+
+// rejectForward records a forward that was rejected by the broker itself, and
+// informs the requesting client.
+func (b *broker) rejectForward(client *brokerClient, request *internal.ForwardRequest, outcome string) {
+	b.mutex.Lock()
+	b.finishForward(&brokerForward{
+		id:      request.Id,
+		source:  client,
+		request: request,
+		created: time.Now(),
+	}, outcome)
+	b.mutex.Unlock()
+
+	err := client.proto.send(messageTypeForwardResponse, &internal.ForwardResponse{
+		Id:      request.Id,
+		Success: false,
+	})
+	if err != nil {
+		b.config.Logger.Error("Failed to respond to forward request", "forward", request.Id, "error", err)
+	}
+}
+
+func (b *broker) handleForwardResponse(client *brokerClient, response *internal.ForwardResponse) {
+	b.mutex.Lock()
+	forward, ok := b.forwards[response.Id]
+	if ok && forward.target == client {
+		delete(b.forwards, response.Id)
+
+		if response.Success {
+			b.finishForward(forward, forwardOutcomeAccepted)
+		} else {
+			b.finishForward(forward, forwardOutcomeRefused)
+		}
+	}
+	b.mutex.Unlock()
+
 	if !ok {
-		log.Println("Cannot forward response, cannot find connection")
+		b.config.Logger.Info("Cannot relay forward response, forward not found", "forward", response.Id)
+	} else if forward.target != client {
+		b.config.Logger.Info("Cannot relay forward response, not sent by target client", "forward", response.Id, "client", client.id)
 	} else {
+		// Add what the broker knows about both sides, so clients can diagnose the path (see Client.Ping)
+		// (for relayed forwards, each broker adds what it knows about its own client)
+		b.mutex.RLock()
+		if forward.source.broker == "" {
+			response.SourceNatType = forward.source.natType
+		}
+		if client.broker == "" {
+			response.TargetNatType = client.natType
+			response.TargetLocalAddr = client.localAddr
+		}
+		b.mutex.RUnlock()
+
 		err := forward.source.proto.send(messageTypeForwardResponse, response)
 		if err != nil {
-			log.Printf("Failed to forward to forward response: " + err.Error())
+			b.config.Logger.Error("Failed to relay forward response", "forward", response.Id, "error", err)
+		}
+	}
+}
+
+func (b *broker) removeClient(client *brokerClient) {
+	b.mutex.Lock()
+	existing, ok := b.clients[client.id]
+	removed := ok && existing == client
+	if removed {
+		delete(b.clients, client.id)
+	}
+	b.mutex.Unlock()
+
+	if removed {
+		b.config.Logger.Info("Client disconnected", "client", client.id, "addr", client.addr)
+		b.events.publish(Event{Type: EventClientDisconnected, Client: client.id, Addr: client.addr.String()})
+		b.notifyPresence(client, false)
+		b.unregister(client)
+	}
+
+	b.removeForwards(client)
+}
+
+func (b *broker) removeForwards(client *brokerClient) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for id, forward := range b.forwards {
+		if forward.source == client || forward.target == client {
+			delete(b.forwards, id)
+			b.finishForward(forward, forwardOutcomeAborted)
+		}
+	}
+}
+
+func (b *broker) cleanupLoop() {
+	for {
+		time.Sleep(brokerCleanupInterval)
+
+		b.evictClients()
+		b.expireForwards()
+		b.expireInvites()
+		b.expireEnrollments()
+		b.syncRegistry()
+
+		if err := b.store.flush(); err != nil {
+			b.config.Logger.Error("Cannot save known clients", "error", err)
+		}
+	}
+}
+
+func (b *broker) evictClients() {
+	evicted := make([]*brokerClient, 0)
+
+	b.mutex.Lock()
+	for id, client := range b.clients {
+		if time.Since(client.lastCheckin) > brokerClientTimeout {
+			b.config.Logger.Info("Client stopped checking in, evicting", "client", id, "addr", client.addr)
+			delete(b.clients, id)
+			evicted = append(evicted, client)
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, client := range evicted {
+		b.removeForwards(client)
+		client.session.Close()
+		b.events.publish(Event{Type: EventClientDisconnected, Client: client.id, Addr: client.addr.String()})
+		b.notifyPresence(client, false)
+		b.unregister(client)
+	}
+}
+
+func (b *broker) expireForwards() {
+	expired := make([]*brokerForward, 0)
+
+	b.mutex.Lock()
+	for id, forward := range b.forwards {
+		if time.Since(forward.created) > brokerForwardTimeout {
+			b.config.Logger.Info("Forward was not answered in time, expiring", "forward", id)
+			delete(b.forwards, id)
+			b.finishForward(forward, forwardOutcomeExpired)
+			expired = append(expired, forward)
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, forward := range expired {
+		err := forward.source.proto.send(messageTypeForwardResponse, &internal.ForwardResponse{
+			Id:      forward.id,
+			Success: false,
+		})
+		if err != nil {
+			b.config.Logger.Error("Failed to respond to forward request", "forward", forward.id, "error", err)
+		}
+	}
+}
+
+func (b *broker) expireInvites() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for token, invite := range b.invites {
+		if time.Now().After(invite.expires) {
+			b.config.Logger.Debug("Invite was not used in time, expiring", "client", invite.client)
+			delete(b.invites, token)
+		}
+	}
+}
+
+// finishForward records the outcome of a forward in the list of recent
+// forwards. It must be called with the broker mutex held.
+func (b *broker) finishForward(forward *brokerForward, outcome string) {
+	forward.outcome = outcome
+	forward.finished = time.Now()
+
+	b.recent = append(b.recent, forward)
+	if len(b.recent) > brokerRecentForwards {
+		b.recent = b.recent[len(b.recent)-brokerRecentForwards:]
+	}
+
+	b.metrics.forwardRequests.inc(outcome)
+	b.events.publish(Event{Type: EventForwardFinished, Client: forward.request.Source, Forward: forward.id, Outcome: outcome})
+}
+
+// offers returns true if the client advertised the given service at its last
+// check-in. It must be called with the broker mutex held.
+func (client *brokerClient) offers(service string) bool {
+	for _, s := range client.services {
+		if s == service {
+			return true
 		}
 	}
+
+	return false
+}
+
+// allows returns true if the client allows connections from the given peer. Clients
+// that did not advertise an allow-list accept all peers. It must be called with the
+// broker mutex held.
+func (client *brokerClient) allows(peer string) bool {
+	return allowsPeer(client.allowPeers, peer)
+}
+
+// watches returns true if the client subscribed to presence updates of the
+// given peer. It must be called with the broker mutex held.
+func (client *brokerClient) watches(peer string) bool {
+	for _, id := range client.watching {
+		if id == peer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// guessNatType compares the address a client thinks it has with the address
+// the broker observes to make an educated guess about the client's NAT.
+func guessNatType(localAddr string, remoteAddr string) string {
+	if localAddr == "" {
+		return natTypeUnknown
+	}
+
+	localHost, localPort, err := net.SplitHostPort(localAddr)
+	if err != nil {
+		return natTypeUnknown
+	}
+
+	remoteHost, remotePort, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return natTypeUnknown
+	}
+
+	if localHost == remoteHost && localPort == remotePort {
+		return natTypeNone
+	} else if localPort == remotePort {
+		return natTypePortPreserving
+	}
+
+	return natTypePortTranslating
 }
 
 func populateBrokerConfig(config *Config) (*Config, error) {
@@ -192,8 +836,71 @@ func populateBrokerConfig(config *Config) (*Config, error) {
 		return nil, errors.New("invalid config: BrokerAddr cannot be empty")
 	}
 
+	if config.ClusterAddr != "" && config.ClusterSecret == "" {
+		return nil, errors.New("invalid config: ClusterSecret cannot be empty if ClusterAddr is set")
+	}
+
 	newConfig := &Config{
-		BrokerAddr: config.BrokerAddr,
+		BrokerAddr:          config.BrokerAddr,
+		AdminAddr:           config.AdminAddr,
+		MetricsAddr:         config.MetricsAddr,
+		ClusterAddr:         config.ClusterAddr,
+		ClusterSecret:       config.ClusterSecret,
+		Registry:            config.Registry,
+		RegistryDir:         config.RegistryDir,
+		ClientsFile:         config.ClientsFile,
+		RestrictClients:     config.RestrictClients,
+		CAPool:              config.CAPool,
+		BrokerFingerprint:   config.BrokerFingerprint,
+		CAKeyPair:           config.CAKeyPair,
+		CertificateValidity: config.CertificateValidity,
+		Logger:              config.Logger,
+		QuicConfig:          config.QuicConfig,
+		TLSServerConfig:     config.TLSServerConfig,
+	}
+
+	if config.ClusterAddr == "" {
+		newConfig.ClusterAddr = config.BrokerAddr
+	}
+
+	if config.Registry == nil && config.RegistryDir != "" {
+		registry, err := NewFileRegistry(config.RegistryDir)
+		if err != nil {
+			return nil, err
+		}
+		newConfig.Registry = registry
+	} else if config.Registry == nil {
+		newConfig.Registry = NewMemoryRegistry()
+	}
+
+	if config.CertificateValidity == 0 {
+		newConfig.CertificateValidity = brokerCertificateValidity
+	}
+
+	// Clients with certificates signed by the broker's own CA must be able to check in
+	if config.CAKeyPair != nil {
+		if len(config.CAKeyPair.Certificate) == 0 {
+			return nil, errors.New("invalid config: CAKeyPair has no certificate")
+		}
+
+		ca, err := x509.ParseCertificate(config.CAKeyPair.Certificate[0])
+		if err != nil {
+			return nil, errors.New("invalid config: cannot parse CA certificate: " + err.Error())
+		}
+
+		if config.CAPool == nil {
+			newConfig.CAPool = x509.NewCertPool()
+			newConfig.CAPool.AddCert(ca)
+		}
+	}
+
+	// The cluster secret only proves that the other broker knows it, not who it is
+	if config.ClusterAddr != "" && newConfig.CAPool == nil && config.BrokerFingerprint == "" {
+		return nil, errors.New("invalid config: CAPool or BrokerFingerprint must be set if ClusterAddr is set, so that brokers can verify each other")
+	}
+
+	if config.Logger == nil {
+		newConfig.Logger = newDefaultLogger()
 	}
 
 	if config.QuicConfig == nil {
@@ -0,0 +1,382 @@
+package natter
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type adminClient struct {
+	Id             string    `json:"id"`
+	Addr           string    `json:"addr"`
+	NatType        string    `json:"natType"`
+	Services       []string  `json:"services"`
+	AllowPeers     []string  `json:"allowPeers,omitempty"`
+	ConnectedSince time.Time `json:"connectedSince"`
+	LastCheckin    time.Time `json:"lastCheckin"`
+	Broker         string    `json:"broker,omitempty"` // Only set for clients of other brokers of the cluster
+}
+
+type adminForward struct {
+	Id                string     `json:"id"`
+	Source            string     `json:"source"`
+	Target            string     `json:"target"`
+	TargetForwardAddr string     `json:"targetForwardAddr,omitempty"`
+	TargetCommand     []string   `json:"targetCommand,omitempty"`
+	TargetService     string     `json:"targetService,omitempty"`
+	Created           time.Time  `json:"created"`
+	Finished          *time.Time `json:"finished,omitempty"`
+	Outcome           string     `json:"outcome,omitempty"`
+}
+
+// adminKnownClient is a known client (see clientStore), and whether it is currently connected
+type adminKnownClient struct {
+	*knownClient
+	Connected bool `json:"connected"`
+}
+
+type adminKnownClientRequest struct {
+	PublicKey string   `json:"publicKey"`
+	Groups    []string `json:"groups"`
+}
+
+type adminEnrollment struct {
+	Client  string    `json:"client"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+type adminEnrollmentRequest struct {
+	Ttl   string `json:"ttl"`   // Duration, e.g. 24h
+	Force bool   `json:"force"` // Replace a valid certificate, see createEnrollment
+}
+
+type adminForwards struct {
+	Pending []*adminForward `json:"pending"`
+	Recent  []*adminForward `json:"recent"`
+}
+
+// listenAndServeAdmin starts the admin HTTP API. It exposes the following endpoints:
+//
+//	GET    /clients        - List connected clients, including those of other brokers of the cluster
+//	DELETE /clients/ID     - Kick a client, i.e. close its session
+//	GET    /forwards       - List pending and recently finished forwards
+//	GET    /revoked        - List revoked client IDs
+//	PUT    /revoked/ID     - Revoke a client ID, and kick the client if it is connected
+//	DELETE /revoked/ID     - Allow a revoked client ID to connect again
+//	GET    /known          - List known clients, i.e. registered clients and clients that connected before
+//	PUT    /known/ID       - Register a client, optionally with a public key and groups
+//	DELETE /known/ID       - Forget a client, and kick it if only registered clients may connect
+//	PUT    /enrollments/ID - Create a token with which a client can enroll with the broker's CA
+//
+// The API is not authenticated, so only GET requests are allowed from other hosts, see adminHandler.
+func (b *broker) listenAndServeAdmin() {
+	b.config.Logger.Info("Admin API listening", "addr", b.config.AdminAddr)
+
+	if err := http.ListenAndServe(b.config.AdminAddr, b.adminHandler()); err != nil {
+		b.config.Logger.Error("Admin API failed", "addr", b.config.AdminAddr, "error", err)
+	}
+}
+
+// adminHandler returns the handler of the admin API. Requests that change anything (i.e. all
+// but GET requests) can only be made via localhost, since e.g. registering a key for a client ID
+// lets the holder of the key take over the ID.
+func (b *broker) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", b.handleAdminClients)
+	mux.HandleFunc("/clients/", b.handleAdminClient)
+	mux.HandleFunc("/forwards", b.handleAdminForwards)
+	mux.HandleFunc("/revoked", b.handleAdminRevokedList)
+	mux.HandleFunc("/revoked/", b.handleAdminRevoked)
+	mux.HandleFunc("/known", b.handleAdminKnownList)
+	mux.HandleFunc("/known/", b.handleAdminKnown)
+	mux.HandleFunc("/enrollments/", b.handleAdminEnrollment)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !isLoopbackAddr(r.RemoteAddr) {
+			b.config.Logger.Info("Rejecting admin API request from other host", "method", r.Method, "path", r.URL.Path, "addr", r.RemoteAddr)
+			http.Error(w, "changes can only be made via localhost", http.StatusForbidden)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (b *broker) handleAdminClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b.mutex.RLock()
+	clients := make([]*adminClient, 0, len(b.clients))
+	for _, client := range b.clients {
+		clients = append(clients, &adminClient{
+			Id:             client.id,
+			Addr:           client.addr.String(),
+			NatType:        client.natType,
+			Services:       client.services,
+			AllowPeers:     client.allowPeers,
+			ConnectedSince: client.connected,
+			LastCheckin:    client.lastCheckin,
+		})
+	}
+	b.mutex.RUnlock()
+
+	for _, entry := range b.remoteClients() {
+		clients = append(clients, &adminClient{
+			Id:          entry.ClientId,
+			Addr:        entry.Addr,
+			NatType:     entry.NatType,
+			Services:    entry.Services,
+			AllowPeers:  entry.AllowPeers,
+			LastCheckin: entry.LastCheckin,
+			Broker:      entry.Broker,
+		})
+	}
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Id < clients[j].Id })
+	b.writeAdminJson(w, clients)
+}
+
+func (b *broker) handleAdminClient(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/clients/")
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !b.kickClient(id) {
+		http.Error(w, "client not connected", http.StatusNotFound)
+		return
+	}
+
+	b.config.Logger.Info("Client kicked via admin API", "client", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *broker) handleAdminForwards(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b.mutex.RLock()
+	forwards := &adminForwards{
+		Pending: make([]*adminForward, 0, len(b.forwards)),
+		Recent:  make([]*adminForward, 0, len(b.recent)),
+	}
+	for _, forward := range b.forwards {
+		forwards.Pending = append(forwards.Pending, newAdminForward(forward))
+	}
+	for i := len(b.recent) - 1; i >= 0; i-- {
+		forwards.Recent = append(forwards.Recent, newAdminForward(b.recent[i]))
+	}
+	b.mutex.RUnlock()
+
+	sort.Slice(forwards.Pending, func(i, j int) bool { return forwards.Pending[i].Created.Before(forwards.Pending[j].Created) })
+	b.writeAdminJson(w, forwards)
+}
+
+func (b *broker) handleAdminRevokedList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b.writeAdminJson(w, b.store.revokedList())
+}
+
+func (b *broker) handleAdminRevoked(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/revoked/")
+	if id == "" {
+		http.Error(w, "client ID missing", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if err := b.store.revoke(id, true); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		b.config.Logger.Info("Client revoked via admin API", "client", id)
+		b.kickClient(id)
+	case http.MethodDelete:
+		if err := b.store.revoke(id, false); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		b.config.Logger.Info("Client unrevoked via admin API", "client", id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *broker) handleAdminKnownList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	known := b.store.list()
+	clients := make([]*adminKnownClient, 0, len(known))
+
+	b.mutex.RLock()
+	for _, client := range known {
+		_, connected := b.clients[client.Id]
+		clients = append(clients, &adminKnownClient{knownClient: client, Connected: connected})
+	}
+	b.mutex.RUnlock()
+
+	b.writeAdminJson(w, clients)
+}
+
+func (b *broker) handleAdminKnown(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/known/")
+	if id == "" {
+		http.Error(w, "client ID missing", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var request adminKnownClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		client, err := b.store.register(id, request.PublicKey, request.Groups)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		b.config.Logger.Info("Client registered via admin API", "client", id, "fingerprint", client.Fingerprint, "groups", client.Groups)
+		b.writeAdminJson(w, client)
+	case http.MethodDelete:
+		removed, err := b.store.remove(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !removed {
+			http.Error(w, "client not known", http.StatusNotFound)
+			return
+		}
+
+		b.config.Logger.Info("Client removed via admin API", "client", id)
+		if b.config.RestrictClients {
+			b.kickClient(id)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (b *broker) handleAdminEnrollment(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/enrollments/")
+	if id == "" {
+		http.Error(w, "client ID missing", http.StatusBadRequest)
+		return
+	} else if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request adminEnrollmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ttl time.Duration
+	if request.Ttl != "" {
+		var err error
+		if ttl, err = time.ParseDuration(request.Ttl); err != nil {
+			http.Error(w, "invalid ttl: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	enrollment, err := b.createEnrollment(id, ttl, request.Force)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b.writeAdminJson(w, &adminEnrollment{
+		Client:  enrollment.client,
+		Token:   enrollment.token,
+		Expires: enrollment.expires,
+	})
+}
+
+// isLoopbackAddr returns true if the host of the given address is a loopback IP address
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// kickClient closes the session of the given client and removes it from the
+// control table. It returns false if the client is not connected.
+func (b *broker) kickClient(id string) bool {
+	b.mutex.RLock()
+	client, ok := b.clients[id]
+	b.mutex.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	client.session.Close()
+	b.removeClient(client)
+
+	return true
+}
+
+func newAdminForward(forward *brokerForward) *adminForward {
+	f := &adminForward{
+		Id:                forward.id,
+		Source:            forward.request.Source,
+		Target:            forward.request.Target,
+		TargetForwardAddr: forward.request.TargetForwardAddr,
+		TargetCommand:     forward.request.TargetCommand,
+		TargetService:     forward.request.TargetService,
+		Created:           forward.created,
+		Outcome:           forward.outcome,
+	}
+
+	if !forward.finished.IsZero() {
+		finished := forward.finished
+		f.Finished = &finished
+	}
+
+	return f
+}
+
+func (b *broker) writeAdminJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		b.config.Logger.Error("Cannot write admin API response", "error", err)
+	}
+}
@@ -0,0 +1,52 @@
+package natter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandlerAccess(t *testing.T) {
+	b, err := NewBroker(&Config{BrokerAddr: ":2586"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := b.(*broker).adminHandler()
+
+	tests := []struct {
+		method   string
+		path     string
+		addr     string
+		expected int
+	}{
+		{http.MethodGet, "/clients", "127.0.0.1:1234", http.StatusOK},
+		{http.MethodGet, "/clients", "203.0.113.7:1234", http.StatusOK},
+		{http.MethodGet, "/known", "203.0.113.7:1234", http.StatusOK},
+		{http.MethodGet, "/revoked", "[2001:db8::1]:1234", http.StatusOK},
+		{http.MethodPut, "/known/alice", "203.0.113.7:1234", http.StatusForbidden},
+		{http.MethodDelete, "/known/alice", "203.0.113.7:1234", http.StatusForbidden},
+		{http.MethodPut, "/revoked/alice", "203.0.113.7:1234", http.StatusForbidden},
+		{http.MethodDelete, "/revoked/alice", "[2001:db8::1]:1234", http.StatusForbidden},
+		{http.MethodDelete, "/clients/alice", "203.0.113.7:1234", http.StatusForbidden},
+		{http.MethodPut, "/enrollments/alice", "203.0.113.7:1234", http.StatusForbidden},
+		{http.MethodPost, "/known/alice", "203.0.113.7:1234", http.StatusForbidden},
+		{http.MethodPut, "/known/alice", "invalid", http.StatusForbidden},
+		{http.MethodPut, "/known/alice", "127.0.0.1:1234", http.StatusOK},
+		{http.MethodPut, "/revoked/alice", "[::1]:1234", http.StatusNoContent},
+		{http.MethodDelete, "/revoked/alice", "127.0.0.1:1234", http.StatusNoContent},
+		{http.MethodDelete, "/known/alice", "127.0.0.1:1234", http.StatusNoContent},
+		{http.MethodDelete, "/clients/alice", "127.0.0.1:1234", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader("{}"))
+		r.RemoteAddr = test.addr
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, r)
+		if w.Code != test.expected {
+			t.Errorf("%s %s from %s: expected status %d, got %d: %s", test.method, test.path, test.addr, test.expected, w.Code, w.Body.String())
+		}
+	}
+}
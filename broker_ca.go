@@ -0,0 +1,212 @@
+package natter
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"heckel.io/natter/internal"
+	"math/big"
+	"time"
+)
+
+const (
+	brokerEnrollTtl           = 24 * time.Hour
+	brokerEnrollMaxTtl        = 30 * 24 * time.Hour
+	brokerEnrollTokenLen      = 16
+	brokerCertificateValidity = 30 * 24 * time.Hour
+)
+
+// brokerEnrollment allows a client to enroll with the broker's CA once, see Config.EnrollToken.
+// The token is never sent; the client proves that it knows it, see enrollMac.
+type brokerEnrollment struct {
+	client  string
+	token   string
+	expires time.Time
+}
+
+// createEnrollment creates an enrollment token for the given client ID, replacing any previous
+// token for this client ID. A TTL of zero means the default TTL. Unless force is set, it refuses
+// to create a token for a client ID that is registered with a certificate that is still valid,
+// since the token would allow anyone who has it to take over the client ID.
+func (b *broker) createEnrollment(clientId string, ttl time.Duration, force bool) (*brokerEnrollment, error) {
+	if b.config.CAKeyPair == nil {
+		return nil, errors.New("broker does not sign certificates, CA private key is not configured")
+	}
+
+	if certificate := b.registeredCertificate(clientId); certificate != nil && !force {
+		return nil, errors.New("client " + clientId + " has a valid certificate until " + certificate.NotAfter.String() + ", force to replace it")
+	}
+
+	if ttl <= 0 {
+		ttl = brokerEnrollTtl
+	} else if ttl > brokerEnrollMaxTtl {
+		ttl = brokerEnrollMaxTtl
+	}
+
+	token, err := randomCode(brokerEnrollTokenLen)
+	if err != nil {
+		return nil, err
+	}
+
+	enrollment := &brokerEnrollment{
+		client:  clientId,
+		token:   token,
+		expires: time.Now().Add(ttl),
+	}
+
+	b.mutex.Lock()
+	b.enrollments[clientId] = enrollment
+	b.mutex.Unlock()
+
+	b.config.Logger.Info("Enrollment token created", "client", clientId, "expires", enrollment.expires)
+
+	return enrollment, nil
+}
+
+// handleEnrollRequest signs the certificate request of a client. New clients prove that they know
+// their enrollment token; clients that checked in with a valid certificate can renew it without token.
+func (b *broker) handleEnrollRequest(client *brokerClient, request *internal.EnrollRequest) {
+	remoteAddr := fmt.Sprintf("%s:%d", client.addr.IP, client.addr.Port)
+	response := &internal.EnrollResponse{Id: request.Id}
+
+	token, err := b.authorizeEnrollment(client, request)
+
+	var certificate []byte
+	if err == nil {
+		certificate, err = b.signCertificate(request.ClientId, request.Csr)
+	}
+
+	if err != nil {
+		b.config.Logger.Info("Rejecting enrollment", "client", request.ClientId, "addr", remoteAddr, "error", err)
+		response.Error = err.Error()
+	} else {
+		response.Success = true
+		response.Certificates = [][]byte{certificate, b.config.CAKeyPair.Certificate[0]}
+		if token != "" {
+			response.Mac = enrollMac(token, response.Certificates...)
+			b.config.Logger.Info("Client enrolled", "client", request.ClientId, "addr", remoteAddr)
+		} else {
+			b.config.Logger.Info("Client certificate renewed", "client", request.ClientId, "addr", remoteAddr)
+		}
+
+		// Enrolled clients are registered, so that they can connect if RestrictClients is set
+		var groups []string
+		if known, ok := b.store.get(request.ClientId); ok {
+			groups = known.Groups
+		}
+		certificatePem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+		if _, err := b.store.register(request.ClientId, string(certificatePem), groups); err != nil {
+			b.config.Logger.Error("Cannot register enrolled client", "client", request.ClientId, "error", err)
+		}
+	}
+
+	if err := client.proto.send(messageTypeEnrollResponse, response); err != nil {
+		b.config.Logger.Error("Cannot respond to enroll request", "client", request.ClientId, "error", err)
+	}
+}
+
+// authorizeEnrollment checks that the client may get a certificate for the requested client ID,
+// and returns the enrollment token if the client used one. Tokens can only be used once.
+func (b *broker) authorizeEnrollment(client *brokerClient, request *internal.EnrollRequest) (string, error) {
+	if b.config.CAKeyPair == nil {
+		return "", errors.New("broker does not sign certificates")
+	}
+
+	if b.store.revoked(request.ClientId) {
+		return "", errors.New("client is revoked")
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Renewals are sent by clients that checked in with their certificate, see verifyCheckin
+	if len(request.Mac) == 0 {
+		if client.id == "" || client.id != request.ClientId {
+			return "", errors.New("enrollment token missing")
+		}
+		return "", nil
+	}
+
+	enrollment, ok := b.enrollments[request.ClientId]
+	if !ok || time.Now().After(enrollment.expires) {
+		return "", errors.New("no enrollment token for client, or token expired")
+	} else if !hmac.Equal(request.Mac, enrollMac(enrollment.token, []byte(request.ClientId), request.Csr)) {
+		return "", errors.New("invalid enrollment token")
+	}
+
+	delete(b.enrollments, request.ClientId)
+	return enrollment.token, nil
+}
+
+// signCertificate signs the DER encoded certificate request with the broker's CA. The certificate
+// is bound to the client ID via its common name, and can be used for both client and server auth,
+// since clients also present it to their peers.
+func (b *broker) signCertificate(clientId string, csrDer []byte) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(csrDer)
+	if err != nil {
+		return nil, errors.New("invalid certificate request: " + err.Error())
+	} else if err := csr.CheckSignature(); err != nil {
+		return nil, errors.New("invalid certificate request: " + err.Error())
+	} else if csr.Subject.CommonName != clientId {
+		return nil, errors.New("certificate request is for " + csr.Subject.CommonName + ", not " + clientId)
+	}
+
+	ca, err := x509.ParseCertificate(b.config.CAKeyPair.Certificate[0])
+	if err != nil {
+		return nil, errors.New("invalid CA certificate: " + err.Error())
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: clientId},
+		NotBefore:    now.Add(-time.Minute), // Allow for some clock skew
+		NotAfter:     now.Add(b.config.CertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+
+	return x509.CreateCertificate(rand.Reader, template, ca, csr.PublicKey, b.config.CAKeyPair.PrivateKey)
+}
+
+// registeredCertificate returns the certificate of the given client ID from the client store, if
+// the client is registered with a certificate (rather than a public key) that has not expired yet
+func (b *broker) registeredCertificate(clientId string) *x509.Certificate {
+	known, ok := b.store.get(clientId)
+	if !ok || !known.Registered || known.PublicKey == "" {
+		return nil
+	}
+
+	block, _ := pem.Decode([]byte(known.PublicKey))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || time.Now().After(certificate.NotAfter) {
+		return nil
+	}
+
+	return certificate
+}
+
+func (b *broker) expireEnrollments() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for id, enrollment := range b.enrollments {
+		if time.Now().After(enrollment.expires) {
+			b.config.Logger.Debug("Enrollment token was not used in time, expiring", "client", id)
+			delete(b.enrollments, id)
+		}
+	}
+}
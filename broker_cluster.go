@@ -0,0 +1,305 @@
+package natter
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"github.com/lucas-clemente/quic-go"
+	"heckel.io/natter/internal"
+	"net"
+	"time"
+)
+
+// register stores the client in the registry, so that other brokers of the cluster can
+// introduce their clients to it
+func (b *broker) register(client *brokerClient) {
+	b.mutex.RLock()
+	entry := &RegistryEntry{
+		ClientId:    client.id,
+		Broker:      b.self,
+		Addr:        client.addr.String(),
+		LocalAddr:   client.localAddr,
+		NatType:     client.natType,
+		Services:    client.services,
+		AllowPeers:  client.allowPeers,
+		LastCheckin: client.lastCheckin,
+	}
+	for token, invite := range b.invites {
+		if invite.client == client.id {
+			entry.Invites = append(entry.Invites, token)
+		}
+	}
+	b.mutex.RUnlock()
+
+	if err := b.registry.Register(entry); err != nil {
+		b.config.Logger.Error("Cannot register client", "client", client.id, "error", err)
+	}
+}
+
+func (b *broker) unregister(client *brokerClient) {
+	if err := b.registry.Unregister(client.id, b.self); err != nil {
+		b.config.Logger.Error("Cannot unregister client", "client", client.id, "error", err)
+	}
+}
+
+// lookupRemote returns the registry entry of a client that is connected to another broker of
+// the cluster, or nil if there is no such client or it stopped checking in
+func (b *broker) lookupRemote(clientId string) *RegistryEntry {
+	entry, err := b.registry.Lookup(clientId)
+	if err != nil {
+		b.config.Logger.Error("Cannot look up client in registry", "client", clientId, "error", err)
+		return nil
+	} else if entry == nil || entry.Broker == b.self || time.Since(entry.LastCheckin) > brokerClientTimeout {
+		return nil
+	}
+
+	return entry
+}
+
+// lookupInvite returns the registry entry of the client of another broker of the cluster that
+// created the invite with the given token, or nil if there is no such client. That broker redeems
+// the invite when the forward is relayed to it.
+func (b *broker) lookupInvite(token string) *RegistryEntry {
+	for _, entry := range b.remoteClients() {
+		for _, invite := range entry.Invites {
+			if invite == token {
+				return entry
+			}
+		}
+	}
+
+	return nil
+}
+
+// remoteClients returns the registry entries of all clients that are connected to other
+// brokers of the cluster. Clients that (also) check in with this broker are skipped.
+func (b *broker) remoteClients() []*RegistryEntry {
+	entries, err := b.registry.List()
+	if err != nil {
+		b.config.Logger.Error("Cannot list clients in registry", "error", err)
+		return nil
+	}
+
+	remote := make([]*RegistryEntry, 0)
+
+	b.mutex.RLock()
+	for _, entry := range entries {
+		if entry.Broker == b.self || time.Since(entry.LastCheckin) > brokerClientTimeout {
+			continue
+		}
+
+		if local, ok := b.clients[entry.ClientId]; ok && time.Since(local.lastCheckin) <= brokerClientTimeout {
+			continue
+		}
+
+		remote = append(remote, entry)
+	}
+	b.mutex.RUnlock()
+
+	return remote
+}
+
+// syncRegistry informs watching clients about clients that came online or went away on other
+// brokers of the cluster, see notifyPresence
+func (b *broker) syncRegistry() {
+	online := make(map[string]*RegistryEntry)
+	for _, entry := range b.remoteClients() {
+		online[entry.ClientId] = entry
+	}
+
+	b.mutex.Lock()
+	previous := b.remote
+	b.remote = online
+	b.mutex.Unlock()
+
+	for id, entry := range online {
+		if _, ok := previous[id]; !ok {
+			b.notifyPresence(&brokerClient{id: entry.ClientId, allowPeers: entry.AllowPeers}, true)
+		}
+	}
+
+	for id, entry := range previous {
+		if _, ok := online[id]; ok {
+			continue
+		}
+
+		// The client may have moved to this broker, in which case it is still online
+		b.mutex.RLock()
+		_, local := b.clients[id]
+		b.mutex.RUnlock()
+
+		if !local {
+			b.notifyPresence(&brokerClient{id: entry.ClientId, allowPeers: entry.AllowPeers}, false)
+		}
+	}
+}
+
+// link returns the connection to another broker of the cluster, and connects to it if there
+// is none. Forward requests to clients of that broker, and their responses, are relayed via
+// the link; everything else (i.e. the hole punching) happens between the clients as usual.
+func (b *broker) link(addr string) (*brokerClient, error) {
+	b.linksMutex.Lock()
+	defer b.linksMutex.Unlock()
+
+	if link, ok := b.links[addr]; ok {
+		return link, nil
+	}
+
+	session, err := quic.DialAddr(addr, generateDefaultTLSClientConfig(), b.config.QuicConfig)
+	if err != nil {
+		return nil, errors.New("cannot connect to broker: " + err.Error())
+	}
+
+	// The other broker's certificate is checked like clients check it, see verifyBrokerCertificate
+	fingerprint, err := verifyBrokerCertificate(b.config.CAPool, b.config.BrokerFingerprint, addr, session.ConnectionState().PeerCertificates)
+	if err != nil {
+		session.Close()
+		return nil, errors.New("cannot connect to broker: " + err.Error())
+	}
+
+	stream, err := session.OpenStreamSync()
+	if err != nil {
+		session.Close()
+		return nil, errors.New("cannot open stream to broker: " + err.Error())
+	}
+
+	link := &brokerClient{
+		id:        addr,
+		broker:    addr,
+		addr:      session.RemoteAddr().(*net.UDPAddr),
+		session:   session,
+		proto:     &protocol{stream: stream, logger: b.config.Logger, messageSize: b.metrics.messageSize},
+		connected: time.Now(),
+	}
+
+	if err := b.authenticateLink(link, stream, fingerprint); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	b.config.Logger.Info("Connected to broker", "broker", addr)
+	b.links[addr] = link
+	go b.handleClient(link)
+
+	return link, nil
+}
+
+// authenticateLink proves to the other broker that this broker knows the cluster secret: the
+// other broker answers the hello with a nonce, and this broker returns a MAC over the nonce and
+// the fingerprint of the other broker's key. The nonce keeps the MAC from being replayed, and the
+// fingerprint keeps a man in the middle from relaying it to the real broker.
+func (b *broker) authenticateLink(link *brokerClient, stream quic.Stream, fingerprint string) error {
+	if err := link.proto.send(messageTypeBrokerHello, &internal.BrokerHello{Broker: b.self}); err != nil {
+		return errors.New("cannot send hello to broker: " + err.Error())
+	}
+
+	stream.SetReadDeadline(time.Now().Add(connectionHandshakeTimeout))
+	messageType, message, err := link.proto.receive()
+	stream.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		return errors.New("cannot receive challenge from broker: " + err.Error())
+	} else if messageType != messageTypeBrokerHello || len(message.(*internal.BrokerHello).Nonce) == 0 {
+		return errors.New("unexpected response from broker, expected challenge")
+	}
+
+	nonce := message.(*internal.BrokerHello).Nonce
+	err = link.proto.send(messageTypeBrokerHello, &internal.BrokerHello{
+		Broker: b.self,
+		Nonce:  nonce,
+		Mac:    clusterMac(b.config.ClusterSecret, b.self, nonce, fingerprint),
+	})
+	if err != nil {
+		return errors.New("cannot send hello to broker: " + err.Error())
+	}
+
+	return nil
+}
+
+// removeLink forgets a closed connection to another broker, so that the next forward
+// request re-connects, and fails the forwards that were relayed via the connection
+func (b *broker) removeLink(client *brokerClient) {
+	if client.broker == "" {
+		return
+	}
+
+	b.linksMutex.Lock()
+	if link, ok := b.links[client.broker]; ok && link == client {
+		b.config.Logger.Info("Disconnected from broker", "broker", client.broker)
+		delete(b.links, client.broker)
+	}
+	b.linksMutex.Unlock()
+
+	failed := make([]*brokerForward, 0)
+
+	b.mutex.Lock()
+	for id, forward := range b.forwards {
+		if forward.target == client {
+			delete(b.forwards, id)
+			b.finishForward(forward, forwardOutcomeAborted)
+			failed = append(failed, forward)
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, forward := range failed {
+		err := forward.source.proto.send(messageTypeForwardResponse, &internal.ForwardResponse{
+			Id:      forward.id,
+			Success: false,
+		})
+		if err != nil {
+			b.config.Logger.Error("Failed to respond to forward request", "forward", forward.id, "error", err)
+		}
+	}
+}
+
+// handleBrokerHello turns a client connection into a link from another broker of the cluster,
+// if that broker knows the cluster secret. The first hello is answered with a challenge, the
+// second one must carry the MAC over it, see authenticateLink.
+func (b *broker) handleBrokerHello(client *brokerClient, hello *internal.BrokerHello) {
+	if b.config.ClusterSecret == "" {
+		b.config.Logger.Info("Broker hello received, but this broker is not part of a cluster, closing session", "broker", hello.Broker, "addr", client.addr)
+		client.session.Close()
+		return
+	}
+
+	if client.nonce == nil {
+		nonce := make([]byte, 32)
+		if _, err := rand.Read(nonce); err != nil {
+			b.config.Logger.Error("Cannot generate challenge for broker, closing session", "broker", hello.Broker, "error", err)
+			client.session.Close()
+			return
+		}
+
+		client.nonce = nonce
+		if err := client.proto.send(messageTypeBrokerHello, &internal.BrokerHello{Broker: b.self, Nonce: nonce}); err != nil {
+			b.config.Logger.Error("Cannot send challenge to broker, closing session", "broker", hello.Broker, "error", err)
+			client.session.Close()
+		}
+		return
+	}
+
+	if !hmac.Equal(hello.Mac, clusterMac(b.config.ClusterSecret, hello.Broker, client.nonce, b.fingerprint)) {
+		b.config.Logger.Info("Broker failed authentication, closing session", "broker", hello.Broker, "addr", client.addr)
+		client.session.Close()
+		return
+	}
+
+	b.mutex.Lock()
+	client.id = hello.Broker
+	client.broker = hello.Broker
+	client.connected = time.Now()
+	b.mutex.Unlock()
+
+	b.config.Logger.Info("Broker connected", "broker", hello.Broker, "addr", client.addr)
+}
+
+// clusterMac proves that a broker knows the cluster secret, see Config.ClusterSecret. The nonce is the
+// challenge of the other broker, and the fingerprint is the one of the other broker's public key.
+func clusterMac(secret string, broker string, nonce []byte, fingerprint string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("natter broker " + broker + " " + fingerprint + " "))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
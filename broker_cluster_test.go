@@ -0,0 +1,75 @@
+package natter
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPopulateBrokerConfigCluster(t *testing.T) {
+	fingerprint := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		config *Config
+		err    string
+	}{
+		{&Config{BrokerAddr: ":2586"}, ""},
+		{&Config{BrokerAddr: ":2586", ClusterAddr: "b1:2586"}, "ClusterSecret cannot be empty"},
+		{&Config{BrokerAddr: ":2586", ClusterAddr: "b1:2586", ClusterSecret: "s3cr3t"}, "CAPool or BrokerFingerprint must be set"},
+		{&Config{BrokerAddr: ":2586", ClusterAddr: "b1:2586", ClusterSecret: "s3cr3t", BrokerFingerprint: fingerprint}, ""},
+	}
+
+	for i, test := range tests {
+		_, err := populateBrokerConfig(test.config)
+		if test.err == "" && err != nil {
+			t.Errorf("test %d: unexpected error: %s", i, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("test %d: expected error %q, got %v", i, test.err, err)
+		}
+	}
+}
+
+func TestLookupInvite(t *testing.T) {
+	registry := NewMemoryRegistry()
+	b1 := newTestClusterBroker(t, "b1:2586", registry)
+	b2 := newTestClusterBroker(t, "b2:2586", registry)
+
+	alice := &brokerClient{id: "alice", addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, lastCheckin: time.Now()}
+	b1.clients[alice.id] = alice
+	b1.invites["abcdefgh"] = &brokerInvite{token: "abcdefgh", client: alice.id, targetForwardAddr: ":22", expires: time.Now().Add(time.Minute)}
+	b1.register(alice)
+
+	if entry := b2.lookupInvite("abcdefgh"); entry == nil || entry.ClientId != "alice" || entry.Broker != "b1:2586" {
+		t.Errorf("expected invite of alice via b1, got %+v", entry)
+	}
+	if entry := b2.lookupInvite("unknown"); entry != nil {
+		t.Errorf("expected no entry for unknown invite, got %+v", entry)
+	}
+	if entry := b1.lookupInvite("abcdefgh"); entry != nil {
+		t.Errorf("expected no entry for own invite, got %+v", entry)
+	}
+
+	// Redeemed invites disappear from the registry with the next check-in
+	delete(b1.invites, "abcdefgh")
+	b1.register(alice)
+
+	if entry := b2.lookupInvite("abcdefgh"); entry != nil {
+		t.Errorf("expected no entry for redeemed invite, got %+v", entry)
+	}
+}
+
+func newTestClusterBroker(t *testing.T, addr string, registry Registry) *broker {
+	b, err := NewBroker(&Config{
+		BrokerAddr:        ":2586",
+		ClusterAddr:       addr,
+		ClusterSecret:     "s3cr3t",
+		BrokerFingerprint: strings.Repeat("ab", 32),
+		Registry:          registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b.(*broker)
+}
@@ -0,0 +1,281 @@
+package natter
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// knownClient is a client the broker knows about, either because it was registered via the
+// admin API (see natter broker clients add), or because it connected at some point
+type knownClient struct {
+	Id          string    `json:"id"`
+	Registered  bool      `json:"registered"`
+	PublicKey   string    `json:"publicKey,omitempty"`   // PEM encoded public key or certificate
+	Fingerprint string    `json:"fingerprint,omitempty"` // SHA-256 of the DER encoded public key
+	Groups      []string  `json:"groups,omitempty"`
+	Added       time.Time `json:"added"`
+	LastSeen    time.Time `json:"lastSeen"`
+	LastAddr    string    `json:"lastAddr,omitempty"`
+	Revoked     bool      `json:"revoked,omitempty"` // See natter broker clients and PUT /revoked/ID
+}
+
+// clientStore keeps the known clients of a broker, and persists them in a JSON file (see
+// Config.ClientsFile). Registrations are written right away; check-ins only mark the store
+// dirty, and are written with the next flush, i.e. via the broker's cleanup loop.
+type clientStore struct {
+	filename string
+	clients  map[string]*knownClient
+	dirty    bool
+	mutex    sync.Mutex
+}
+
+// newClientStore loads the store from the given file, if it exists. If the filename is empty,
+// the store only lives in memory.
+func newClientStore(filename string) (*clientStore, error) {
+	store := &clientStore{
+		filename: filename,
+		clients:  make(map[string]*knownClient),
+	}
+
+	if filename == "" {
+		return store, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, errors.New("cannot read clients file: " + err.Error())
+	}
+
+	var clients []*knownClient
+	if err := json.Unmarshal(data, &clients); err != nil {
+		return nil, errors.New("cannot parse clients file " + filename + ": " + err.Error())
+	}
+
+	for _, client := range clients {
+		store.clients[client.Id] = client
+	}
+
+	return store, nil
+}
+
+// get returns a copy of the known client with the given ID
+func (s *clientStore) get(id string) (*knownClient, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client, ok := s.clients[id]
+	if !ok {
+		return nil, false
+	}
+
+	copied := *client
+	return &copied, true
+}
+
+// list returns copies of all known clients, sorted by ID
+func (s *clientStore) list() []*knownClient {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	clients := make([]*knownClient, 0, len(s.clients))
+	for _, client := range s.clients {
+		copied := *client
+		clients = append(clients, &copied)
+	}
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Id < clients[j].Id })
+	return clients
+}
+
+// register adds the client, or replaces its public key and groups if it is known already.
+// The public key is optional; if it is set, it must be a PEM encoded public key or certificate.
+func (s *clientStore) register(id string, publicKey string, groups []string) (*knownClient, error) {
+	var fingerprint string
+	if publicKey != "" {
+		var err error
+		if fingerprint, err = publicKeyFingerprint(publicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client, ok := s.clients[id]
+	if !ok {
+		client = &knownClient{Id: id}
+		s.clients[id] = client
+	}
+
+	if !client.Registered {
+		client.Registered = true
+		client.Added = time.Now()
+	}
+
+	client.PublicKey = publicKey
+	client.Fingerprint = fingerprint
+	client.Groups = groups
+
+	copied := *client
+	return &copied, s.save()
+}
+
+// remove forgets the client, including its history, but not its revocation. It returns false
+// if it was not known.
+func (s *clientStore) remove(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client, ok := s.clients[id]
+	if !ok {
+		return false, nil
+	}
+
+	if client.Revoked {
+		s.clients[id] = &knownClient{Id: id, Added: client.Added, Revoked: true}
+	} else {
+		delete(s.clients, id)
+	}
+
+	return true, s.save()
+}
+
+// revoke marks the client ID as revoked, or allows it to connect again. Unknown clients are
+// added, so that a client ID can be revoked before it ever connected.
+func (s *clientStore) revoke(id string, revoked bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client, ok := s.clients[id]
+	if !ok && !revoked {
+		return nil
+	} else if !ok {
+		client = &knownClient{Id: id, Added: time.Now()}
+		s.clients[id] = client
+	}
+
+	client.Revoked = revoked
+	return s.save()
+}
+
+// revoked returns true if the client ID is revoked
+func (s *clientStore) revoked(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client, ok := s.clients[id]
+	return ok && client.Revoked
+}
+
+// revokedList returns the revoked client IDs, sorted
+func (s *clientStore) revokedList() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	revoked := make([]string, 0)
+	for id, client := range s.clients {
+		if client.Revoked {
+			revoked = append(revoked, id)
+		}
+	}
+
+	sort.Strings(revoked)
+	return revoked
+}
+
+// seen records a check-in of the client. Unknown clients are added as unregistered clients.
+func (s *clientStore) seen(id string, addr string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	client, ok := s.clients[id]
+	if !ok {
+		client = &knownClient{Id: id, Added: time.Now()}
+		s.clients[id] = client
+	}
+
+	client.LastSeen = time.Now()
+	client.LastAddr = addr
+	s.dirty = true
+}
+
+// flush writes the store if check-ins were recorded since it was last written
+func (s *clientStore) flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	return s.save()
+}
+
+// save writes the store to its file, replacing the file atomically. It must be called with
+// the mutex held.
+func (s *clientStore) save() error {
+	if s.filename == "" {
+		return nil
+	}
+
+	clients := make([]*knownClient, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Id < clients[j].Id })
+
+	data, err := json.MarshalIndent(clients, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(s.filename+".tmp", data, 0600); err != nil {
+		return errors.New("cannot write clients file: " + err.Error())
+	}
+
+	if err := os.Rename(s.filename+".tmp", s.filename); err != nil {
+		return errors.New("cannot write clients file: " + err.Error())
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// publicKeyFingerprint returns the hex encoded SHA-256 hash of the DER encoded public key in the
+// given PEM block, which may contain a public key or a certificate
+func publicKeyFingerprint(publicKeyPem string) (string, error) {
+	block, _ := pem.Decode([]byte(publicKeyPem))
+	if block == nil {
+		return "", errors.New("invalid public key, expected PEM encoded public key or certificate")
+	}
+
+	var publicKey interface{}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", errors.New("invalid certificate: " + err.Error())
+		}
+		publicKey = certificate.PublicKey
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return "", errors.New("invalid public key: " + err.Error())
+		}
+		publicKey = key
+	default:
+		return "", errors.New("invalid public key, unexpected PEM block " + block.Type)
+	}
+
+	return keyFingerprint(publicKey)
+}
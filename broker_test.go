@@ -0,0 +1,83 @@
+package natter
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"heckel.io/natter/internal"
+	"strings"
+	"testing"
+)
+
+func TestPeersPage(t *testing.T) {
+	tests := []struct {
+		name     string
+		peers    int
+		oversize int // Index of a peer that does not fit into a message, or -1
+		pages    int
+	}{
+		{"empty", 0, -1, 1},
+		{"small", 10, -1, 1},
+		{"large fleet", 2000, -1, 0},
+		{"oversize peer", 500, 250, 0},
+		{"oversize first peer", 500, 0, 0},
+	}
+
+	for _, test := range tests {
+		peers := make([]*internal.Peer, 0, test.peers)
+		for i := 0; i < test.peers; i++ {
+			peer := &internal.Peer{
+				Id:       fmt.Sprintf("client-%04d", i),
+				NatType:  "Full-cone NAT",
+				Services: []string{"ssh", "http", "natter-" + strings.Repeat("x", i%50)},
+			}
+			if i == test.oversize {
+				peer.Services = []string{strings.Repeat("x", maxMessageLength)}
+			}
+			peers = append(peers, peer)
+		}
+
+		ids := make([]string, 0, test.peers)
+		pages := 0
+
+		for offset := 0; ; {
+			response := peersPage("abc", peers, offset)
+			if pages++; pages > test.peers+1 {
+				t.Fatalf("%s: too many pages", test.name)
+			}
+
+			data, err := proto.Marshal(response)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(data) > maxMessageLength {
+				t.Errorf("%s: page at offset %d is %d bytes, max is %d", test.name, offset, len(data), maxMessageLength)
+			}
+
+			for _, peer := range response.Peers {
+				ids = append(ids, peer.Id)
+			}
+
+			if response.Next == 0 {
+				break
+			} else if int(response.Next) <= offset {
+				t.Fatalf("%s: next offset %d is not after offset %d", test.name, response.Next, offset)
+			}
+			offset = int(response.Next)
+		}
+
+		expected := make([]string, 0, test.peers)
+		for _, peer := range peers {
+			if len(peer.Services[0]) < maxMessageLength {
+				expected = append(expected, peer.Id)
+			}
+		}
+
+		if strings.Join(ids, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected %d peers, got %d", test.name, len(expected), len(ids))
+		}
+		if test.pages > 0 && pages != test.pages {
+			t.Errorf("%s: expected %d pages, got %d", test.name, test.pages, pages)
+		} else if test.pages == 0 && pages < 2 {
+			t.Errorf("%s: expected more than one page, got %d", test.name, pages)
+		}
+	}
+}
@@ -1,12 +1,18 @@
 package natter
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"github.com/golang/protobuf/proto"
+	"github.com/lucas-clemente/quic-go"
 	"heckel.io/natter/internal"
-	"log"
+	"io"
 	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"time"
 )
@@ -16,6 +22,58 @@ type client struct {
 	conn          *clientConn
 	forwards      map[string]*forward
 	forwardsMutex sync.RWMutex
+	metrics       *clientMetrics
+	events        *eventBus
+
+	listener    quic.Listener
+	listenMutex sync.Mutex
+
+	peerListeners      map[string]*peerListener
+	peerListenersMutex sync.RWMutex
+
+	peersRequests      map[string]chan *internal.PeersResponse
+	peersRequestsMutex sync.Mutex
+
+	invites             map[string]*invite
+	invitesMutex        sync.Mutex
+	inviteRequests      map[string]chan *internal.InviteResponse
+	inviteRequestsMutex sync.Mutex
+
+	certificate         *tls.Certificate // Signed by the broker's CA, see Config.EnrollToken
+	certificateCAPool   *x509.CertPool   // CA that signed the certificate, see caPool
+	certificateMutex    sync.RWMutex
+	enrollMutex         sync.Mutex
+	enrollRequests      map[string]chan *internal.EnrollResponse
+	enrollRequestsMutex sync.Mutex
+
+	watching      map[string]bool
+	online        map[string]bool
+	presenceMutex sync.Mutex
+
+	policyMutex sync.RWMutex // Protects config.Services and config.AllowPeers, see SetServices
+
+	sourceLimiters      map[string]*rateLimiter // Per peer, see Config.RateLimits
+	sourceLimitersMutex sync.Mutex
+
+	sessions      map[uint64]*streamSession
+	sessionsSeq   uint64
+	sessionsMutex sync.Mutex
+}
+
+// streamSession is a stream between this client and a peer that is currently forwarding,
+// e.g. an SSH connection. It is tracked to list the active sessions via the control API.
+type streamSession struct {
+	id       uint64
+	forward  string
+	peer     string
+	stream   int64
+	started  time.Time
+	sent     int64 // Updated atomically
+	received int64 // Updated atomically
+
+	// Bytes sent and received on the wire, if the forward is compressed (see compressStreams)
+	sentCompressed     int64 // Updated atomically
+	receivedCompressed int64 // Updated atomically
 }
 
 type forward struct {
@@ -26,22 +84,155 @@ type forward struct {
 	target            string
 	targetForwardAddr string
 	targetCommand     []string
+	targetService     string
+	waitForPeer       bool
+	invite            string // Invite token and secret, if the forward was created via an invite, see Client.Join
+	inviteSecret      string
+	limiter           *rateLimiter              // Outgoing forwards only, see ForwardOptions.RateLimit
+	compression       string                    // Requested compression (outgoing), or the one agreed to (incoming)
+	accepted          *internal.ForwardResponse // Last response that accepted the forward, see Client.Ping
+	singleSession     bool                      // Incoming forwards of DialPeer, Send, Bench and Ping, see ForwardRequest.SingleSession
+	client            *client
+	listener          net.Listener
+
+	state   int
+	updated chan struct{} // Closed and replaced whenever the state changes, see wait
 
 	sync.RWMutex
 }
 
+const (
+	forwardStateRequested = iota
+	forwardStateAccepted
+	forwardStateRejected
+	forwardStateClosed
+)
+
 func (forward *forward) PeerUdpAddr() *net.UDPAddr {
 	forward.RLock()
 	defer forward.RUnlock()
 	return forward.peerUdpAddr
 }
 
+// durable returns true if the forward should be re-requested when it is rejected, or when
+// the peer goes away. Forwards from a local TCP port behave like durable tunnels, so do
+// forwards that were created with the WaitForPeer option. Invites can only be used once.
+func (forward *forward) durable() bool {
+	return forward.invite == "" && (forward.sourceAddr != "" || forward.waitForPeer)
+}
+
+// setState updates the state and peer address of the forward, and wakes up
+// everyone waiting for the forward to change (see wait).
+func (forward *forward) setState(state int, peerUdpAddr *net.UDPAddr) {
+	forward.Lock()
+	defer forward.Unlock()
+
+	forward.state = state
+	forward.peerUdpAddr = peerUdpAddr
+
+	if forward.updated != nil {
+		close(forward.updated)
+	}
+	forward.updated = make(chan struct{})
+}
+
+// wait blocks until the forward was accepted by the peer, and returns its current ID and
+// the peer address. If the forward is rejected, it returns an error, unless the forward is
+// durable. Durable forwards wait until they are re-requested and accepted, or until the
+// context is done.
+func (forward *forward) wait(ctx context.Context) (string, *net.UDPAddr, error) {
+	for {
+		forward.RLock()
+		id, state, peerUdpAddr, updated := forward.id, forward.state, forward.peerUdpAddr, forward.updated
+		forward.RUnlock()
+
+		if state == forwardStateAccepted {
+			return id, peerUdpAddr, nil
+		} else if state == forwardStateClosed {
+			return id, nil, errors.New("forward was closed")
+		} else if state == forwardStateRejected && !forward.durable() {
+			return id, nil, errors.New("forward was rejected")
+		}
+
+		select {
+		case <-ctx.Done():
+			return id, nil, ctx.Err()
+		case <-updated:
+		}
+	}
+}
+
+// Close removes the forward and stops listening on the local TCP address. Established
+// connections are not affected; they keep running until either side closes them.
+func (forward *forward) Close() error {
+	if forward.client == nil {
+		return errors.New("forward cannot be closed")
+	}
+
+	return forward.client.closeForward(forward)
+}
+
+func (forward *forward) Compression() string {
+	if forward.client == nil {
+		return forward.compression // Incoming forwards only agree to supported compressions
+	}
+
+	forward.RLock()
+	defer forward.RUnlock()
+
+	// Older peers ignore the requested compression, and don't confirm it
+	if forward.accepted == nil || forward.accepted.Compression != forward.compression {
+		return ""
+	}
+
+	return forward.compression
+}
+
+func (forward *forward) Spec() *ForwardSpec {
+	return &ForwardSpec{
+		LocalAddr:         forward.sourceAddr,
+		Target:            forward.target,
+		TargetForwardAddr: forward.targetForwardAddr,
+		TargetCommand:     forward.targetCommand,
+		Service:           forward.targetService,
+		RateLimit:         forward.RateLimit(),
+		Compression:       forward.compression,
+	}
+}
+
+func (forward *forward) SetRateLimit(limit *RateLimit) {
+	if forward.limiter != nil {
+		forward.limiter.setLimit(limit)
+	}
+}
+
+func (forward *forward) RateLimit() *RateLimit {
+	if forward.limiter == nil {
+		return nil
+	}
+
+	return forward.limiter.limit()
+}
+
+// peer returns the client ID of the other side of the forward
+func (forward *forward) peer(clientId string) string {
+	if forward.source == clientId {
+		return forward.target
+	}
+
+	return forward.source
+}
+
 const (
 	letterBytes                = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 	punchInterval              = 15 * time.Second
 	connectionIdLength         = 8
 	connectionIdleTimeout      = 5 * time.Second
 	connectionHandshakeTimeout = 5 * time.Second
+	forwardWaitTimeout         = 30 * time.Second
+	forwardMaxAttempts         = 3
+	reconnectMinDelay          = 1 * time.Second
+	reconnectMaxDelay          = 30 * time.Second
 )
 
 // NewClient creates a new client struct. It checks the configuration
@@ -58,13 +249,42 @@ func NewClient(config *Config) (Client, error) {
 
 	client.config = newConfig
 	client.forwards = make(map[string]*forward)
+	client.peerListeners = make(map[string]*peerListener)
+	client.peersRequests = make(map[string]chan *internal.PeersResponse)
+	client.invites = make(map[string]*invite)
+	client.inviteRequests = make(map[string]chan *internal.InviteResponse)
+	client.enrollRequests = make(map[string]chan *internal.EnrollResponse)
+	client.watching = make(map[string]bool)
+	client.online = make(map[string]bool)
+	client.sessions = make(map[uint64]*streamSession)
+	client.sourceLimiters = make(map[string]*rateLimiter)
+	client.metrics = newClientMetrics(client)
+	client.events = newEventBus()
+
+	if newConfig.EnrollToken != "" {
+		if err := client.setupEnrollment(); err != nil {
+			return nil, err
+		}
+	}
 
-	conn, err := newClientConn(newConfig, client.handleBrokerMessage, client.handleConnError)
+	conn, err := newClientConn(newConfig, client.handleBrokerMessage, client.handleConnConnected, client.handleConnError, client.advertised, client.enroll, client.caPool)
 	if err != nil {
 		return nil, err
 	}
 	client.conn = conn
 
+	if newConfig.EnrollToken != "" {
+		go client.renewLoop()
+	}
+
+	if newConfig.MetricsAddr != "" {
+		go client.metrics.registry.listenAndServe(newConfig.MetricsAddr, newConfig.Logger)
+	}
+
+	if newConfig.ControlSocket != "" {
+		go client.listenAndServeControl()
+	}
+
 	return client, nil
 }
 
@@ -76,41 +296,419 @@ func (c *client) handleBrokerMessage(messageType messageType, message proto.Mess
 		c.handleForwardRequest(message.(*internal.ForwardRequest))
 	case messageTypeForwardResponse:
 		c.handleForwardResponse(message.(*internal.ForwardResponse))
+	case messageTypePeersResponse:
+		c.handlePeersResponse(message.(*internal.PeersResponse))
+	case messageTypePresenceUpdate:
+		c.handlePresenceUpdate(message.(*internal.PresenceUpdate))
+	case messageTypeInviteResponse:
+		c.handleInviteResponse(message.(*internal.InviteResponse))
+	case messageTypeEnrollResponse:
+		c.handleEnrollResponse(message.(*internal.EnrollResponse))
 	default:
-		log.Println("Unknown message type", int(messageType))
+		c.config.Logger.Error("Unknown message type", "type", int(messageType))
 	}
 }
 
-func (c *client) handleConnError() {
-	log.Println("Connection error.")
+func (c *client) Subscribe(handler EventHandler) func() {
+	return c.events.subscribe(handler)
 }
 
-func (c *client) punch(udpAddr *net.UDPAddr) {
-	// TODO add exitChan support!!
+func (c *client) handleConnConnected(broker string, addr string) {
+	c.events.publish(Event{Type: EventBrokerConnected, Addr: broker})
+
+	// Re-subscribe to presence updates, in case this is a reconnect
+	c.presenceMutex.Lock()
+	watching := len(c.watching) > 0
+	c.presenceMutex.Unlock()
+
+	if watching {
+		if err := c.sendPresenceRequest(); err != nil {
+			c.config.Logger.Error("Cannot subscribe to presence updates", "error", err)
+		}
+	}
+}
+
+func (c *client) handleConnError(broker string) {
+	c.config.Logger.Error("Connection to broker lost", "broker", broker)
+	c.events.publish(Event{Type: EventBrokerDisconnected, Addr: broker})
+
+	// Presence is unknown until a broker connection is back
+	if !c.conn.connected() {
+		c.presenceMutex.Lock()
+		c.online = make(map[string]bool)
+		c.presenceMutex.Unlock()
+	}
+
+	go c.reconnect(broker)
+}
+
+// reconnect tries to re-establish the connection to the given broker with an increasing delay.
+// If it is the first broker that is back, forward requests that were not answered are sent
+// again, since the brokers have likely forgotten about them. Rejected forwards are retried via
+// presence updates. If other brokers were connected, they took care of the requests already.
+func (c *client) reconnect(broker string) {
+	delay := reconnectMinDelay
+	var connected bool
 
 	for {
+		time.Sleep(delay)
+		c.config.Logger.Info("Reconnecting to broker", "broker", broker)
+
+		connected = c.conn.connected()
+		if err := c.conn.reconnect(broker); err != nil {
+			c.config.Logger.Error("Cannot reconnect to broker", "broker", broker, "error", err)
+			if delay *= 2; delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+			continue
+		}
+
+		break
+	}
+
+	if connected {
+		return
+	}
+
+	c.forwardsMutex.RLock()
+	pending := make([]*forward, 0)
+	for _, forward := range c.forwards {
+		if forward.source == c.config.ClientId {
+			pending = append(pending, forward)
+		}
+	}
+	c.forwardsMutex.RUnlock()
+
+	for _, forward := range pending {
+		forward.RLock()
+		id, state := forward.id, forward.state
+		forward.RUnlock()
+
+		if state == forwardStateRequested {
+			c.rerequestForward(forward, id)
+		}
+	}
+}
+
+// SetServices replaces the services from the config, and advertises them to the broker.
+// Established connections to removed services are not affected.
+func (c *client) SetServices(services map[string]string) error {
+	c.peerListenersMutex.RLock()
+	for name := range services {
+		if isBuiltinService(name) {
+			c.peerListenersMutex.RUnlock()
+			return fmt.Errorf("service %s is reserved", name)
+		} else if _, ok := c.peerListeners[name]; ok {
+			c.peerListenersMutex.RUnlock()
+			return fmt.Errorf("service %s is already registered via ListenPeer", name)
+		}
+	}
+	c.peerListenersMutex.RUnlock()
+
+	c.policyMutex.Lock()
+	c.config.Services = services
+	c.policyMutex.Unlock()
+
+	if len(services) > 0 {
+		if err := c.Listen(); err != nil {
+			return err
+		}
+	}
+
+	c.advertise()
+	return nil
+}
+
+// SetAllowPeers replaces the list of peers that are allowed to connect to this
+// client, and advertises it to the broker.
+func (c *client) SetAllowPeers(allowPeers []string) error {
+	c.policyMutex.Lock()
+	c.config.AllowPeers = allowPeers
+	c.policyMutex.Unlock()
+
+	c.advertise()
+	return nil
+}
+
+// SetRateLimits replaces the rate limits for connections from peers. The limiters of peers
+// that are already connected are updated in place, so running connections are affected, too.
+func (c *client) SetRateLimits(limits map[string]*RateLimit) error {
+	c.sourceLimitersMutex.Lock()
+	defer c.sourceLimitersMutex.Unlock()
+
+	c.policyMutex.Lock()
+	c.config.RateLimits = limits
+	c.policyMutex.Unlock()
+
+	for peer, limiter := range c.sourceLimiters {
+		limiter.setLimit(c.sourceRateLimit(peer))
+	}
+
+	return nil
+}
+
+// sourceLimiter returns the rate limiter shared by all connections from the given peer,
+// or nil if connections from this peer are not limited
+func (c *client) sourceLimiter(peer string) *rateLimiter {
+	c.sourceLimitersMutex.Lock()
+	defer c.sourceLimitersMutex.Unlock()
+
+	if limiter, ok := c.sourceLimiters[peer]; ok {
+		return limiter
+	}
+
+	limit := c.sourceRateLimit(peer)
+	if limit == nil {
+		return nil
+	}
+
+	limiter := newRateLimiter(limit)
+	c.sourceLimiters[peer] = limiter
+
+	return limiter
+}
+
+// sourceRateLimit returns the configured rate limit for the given peer, or the default ("*")
+func (c *client) sourceRateLimit(peer string) *RateLimit {
+	c.policyMutex.RLock()
+	defer c.policyMutex.RUnlock()
+
+	if limit, ok := c.config.RateLimits[peer]; ok {
+		return limit
+	}
+
+	return c.config.RateLimits["*"]
+}
+
+// rateLimitedWriters wraps the peer and local streams of a connection with the rate limits of
+// the forward (outgoing forwards) or of the source peer (incoming forwards). For incoming forwards,
+// data "sent" to the peer is what the peer receives, so the buckets are swapped.
+func (c *client) rateLimitedWriters(forward *forward, peerStream io.Writer, localStream io.Writer) (io.Writer, io.Writer) {
+	var sent, received []*tokenBucket
+
+	if forward.limiter != nil {
+		sent = append(sent, forward.limiter.sent)
+		received = append(received, forward.limiter.received)
+	}
+
+	if forward.source != c.config.ClientId {
+		if limiter := c.sourceLimiter(forward.source); limiter != nil {
+			sent = append(sent, limiter.received)
+			received = append(received, limiter.sent)
+		}
+	}
+
+	if len(sent) == 0 {
+		return peerStream, localStream
+	}
+
+	return &rateLimitedWriter{writer: peerStream, buckets: sent}, &rateLimitedWriter{writer: localStream, buckets: received}
+}
+
+// advertise sends a check-in request to the broker right away, so that changed services and
+// allowed peers take effect immediately. If the client is not connected, they are sent with
+// the first check-in after connecting.
+func (c *client) advertise() {
+	if err := c.conn.checkin(); err != nil {
+		c.config.Logger.Debug("Cannot send check-in request, will be sent when connected", "error", err)
+	}
+}
+
+// advertised returns the services and the allowed peers, as they are sent to the broker
+func (c *client) advertised() ([]string, []string) {
+	c.policyMutex.RLock()
+	defer c.policyMutex.RUnlock()
+
+	return c.services(), c.config.AllowPeers
+}
+
+// service returns the TCP address of the given service from the config
+func (c *client) service(name string) (string, bool) {
+	c.policyMutex.RLock()
+	defer c.policyMutex.RUnlock()
+
+	addr, ok := c.config.Services[name]
+	return addr, ok
+}
+
+// allows returns true if the given peer is allowed to connect to this client
+func (c *client) allows(peer string) bool {
+	c.policyMutex.RLock()
+	defer c.policyMutex.RUnlock()
+
+	return allowsPeer(c.config.AllowPeers, peer)
+}
+
+// services returns the names of all services this client offers, i.e. the services from
+// the config and the ones registered via ListenPeer. It must be called with the policyMutex held.
+func (c *client) services() []string {
+	services := make([]string, 0, len(c.config.Services))
+	for name := range c.config.Services {
+		services = append(services, name)
+	}
+
+	c.peerListenersMutex.RLock()
+	for name := range c.peerListeners {
+		services = append(services, name)
+	}
+	c.peerListenersMutex.RUnlock()
+
+	sort.Strings(services)
+	return services
+}
+
+func (c *client) hasForward(forward *forward) bool {
+	c.forwardsMutex.RLock()
+	defer c.forwardsMutex.RUnlock()
+
+	for _, f := range c.forwards {
+		if f == forward {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsPeer returns true if the allow-list permits connections from the
+// given client ID. An empty allow-list permits all clients.
+func allowsPeer(allowPeers []string, peer string) bool {
+	if len(allowPeers) == 0 {
+		return true
+	}
+
+	for _, allowed := range allowPeers {
+		if allowed == peer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// punch sends UDP packets to the peer to open and keep open the NAT mapping. It stops when
+// the forward is removed, or re-requested, i.e. when the peer address of the forward changes.
+func (c *client) punch(forward *forward, udpAddr *net.UDPAddr) {
+	for c.hasForward(forward) && forward.PeerUdpAddr() == udpAddr {
 		udpConn := c.conn.UdpConn()
 
 		if udpConn != nil {
 			udpConn.WriteTo([]byte("punch!"), udpAddr)
+			c.metrics.punchAttempts.inc()
 		}
 
 		time.Sleep(punchInterval)
 	}
 }
 
+// forwardStreams copies data between the peer stream and the local stream in both
+// directions, and keeps track of the active streams and the bytes transferred. If one
+// side is done writing, the write direction of the other side is closed as well.
+func (c *client) forwardStreams(forward *forward, peerStream quic.Stream, localStream io.ReadWriter) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	session := c.openSession(forward, peerStream)
+	peerWriter, peerReader, finishCompression := c.compressStreams(forward, session, peerStream)
+	peerWriter, localWriter := c.rateLimitedWriters(forward, peerWriter, localStream)
+
+	go func() {
+		io.Copy(&countingWriter{writer: peerWriter, metric: c.metrics.forwardBytes, labelValues: []string{forward.peer(c.config.ClientId), "sent"}, counter: &session.sent}, localStream)
+		finishCompression()
+		peerStream.Close()
+		wg.Done()
+	}()
+
+	go func() {
+		io.Copy(&countingWriter{writer: localWriter, metric: c.metrics.forwardBytes, labelValues: []string{forward.peer(c.config.ClientId), "received"}, counter: &session.received}, peerReader)
+		if closer, ok := localStream.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite()
+		}
+		wg.Done()
+	}()
+
+	go func() {
+		wg.Wait()
+		closeLocalStream(localStream)
+		c.closeSession(session)
+	}()
+}
+
+// openSession registers an active stream with a peer, and updates metrics and events accordingly
+func (c *client) openSession(forward *forward, stream quic.Stream) *streamSession {
+	session := &streamSession{
+		forward: forward.id,
+		peer:    forward.peer(c.config.ClientId),
+		stream:  int64(stream.StreamID()),
+		started: time.Now(),
+	}
+
+	c.sessionsMutex.Lock()
+	c.sessionsSeq++
+	session.id = c.sessionsSeq
+	c.sessions[session.id] = session
+	c.sessionsMutex.Unlock()
+
+	c.metrics.streams.inc()
+	c.events.publish(Event{Type: EventStreamOpened, Client: session.peer, Forward: session.forward, Stream: session.stream})
+
+	return session
+}
+
+// closeSession removes a stream that was registered via openSession
+func (c *client) closeSession(session *streamSession) {
+	c.sessionsMutex.Lock()
+	delete(c.sessions, session.id)
+	c.sessionsMutex.Unlock()
+
+	c.metrics.streams.dec()
+	c.events.publish(Event{Type: EventStreamClosed, Client: session.peer, Forward: session.forward, Stream: session.stream})
+}
+
 func populateClientConfig(config *Config) (*Config, error) {
 	if config.ClientId == "" {
 		return nil, errors.New("invalid config: ClientId cannot be empty")
 	}
 
-	if config.BrokerAddr == "" {
+	if config.BrokerAddr == "" && len(config.BrokerAddrs) == 0 {
 		return nil, errors.New("invalid config: ServerAddr cannot be empty")
 	}
 
+	for name := range config.Services {
+		if isBuiltinService(name) {
+			return nil, errors.New("invalid config: service " + name + " is reserved")
+		}
+	}
+
+	if config.EnrollToken != "" && (config.CertificateFile == "" || config.PrivateKeyFile == "") {
+		return nil, errors.New("invalid config: EnrollToken requires CertificateFile and PrivateKeyFile")
+	}
+
 	newConfig := &Config{
-		ClientId:   config.ClientId,
-		BrokerAddr: config.BrokerAddr,
+		ClientId:          config.ClientId,
+		BrokerAddr:        config.BrokerAddr,
+		BrokerAddrs:       config.BrokerAddrs,
+		MetricsAddr:       config.MetricsAddr,
+		ControlSocket:     config.ControlSocket,
+		Listen:            config.Listen,
+		Forwards:          config.Forwards,
+		Services:          config.Services,
+		AllowPeers:        config.AllowPeers,
+		RateLimits:        config.RateLimits,
+		ReceiveDir:        config.ReceiveDir,
+		CAPool:            config.CAPool,
+		BrokerFingerprint: config.BrokerFingerprint,
+		EnrollToken:       config.EnrollToken,
+		CertificateFile:   config.CertificateFile,
+		PrivateKeyFile:    config.PrivateKeyFile,
+		Logger:            config.Logger,
+		QuicConfig:        config.QuicConfig,
+		TLSServerConfig:   config.TLSServerConfig,
+		TLSClientConfig:   config.TLSClientConfig,
+	}
+
+	if config.Logger == nil {
+		newConfig.Logger = newDefaultLogger()
 	}
 
 	if config.QuicConfig == nil {
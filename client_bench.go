@@ -0,0 +1,275 @@
+package natter
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// benchService is built into every listening client. Depending on the header the peer
+	// sends, it discards everything it receives (upload), or sends data for a while (download).
+	benchService = "natter:bench"
+
+	benchDirectionUpload   = byte('u')
+	benchDirectionDownload = byte('d')
+
+	benchBufferSize      = 32 * 1024
+	benchDefaultDuration = 5 * time.Second
+	benchMaxDuration     = 1 * time.Minute
+	benchDefaultStreams  = 1
+	benchMaxStreams      = 64
+	benchHandshakes      = 3
+)
+
+func (c *client) Bench(ctx context.Context, peer string, options *BenchOptions) (*BenchResult, error) {
+	duration, streams, handshakes, err := benchOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BenchResult{
+		Peer:       peer,
+		Handshakes: make([]BenchHandshake, 0, handshakes),
+		Runs:       make([]BenchRun, 0),
+	}
+
+	// Handshake cost: every session but the last is closed right away,
+	// the last one is used for the throughput runs
+	var session quic.Session
+	var forward *forward
+
+	for i := 0; i < handshakes; i++ {
+		var timings dialTimings
+
+		session, forward, err = c.dialPeerSession(ctx, peer, benchService, &timings)
+		if err != nil && ctx.Err() != nil && len(result.Handshakes) > 0 {
+			return result, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		result.Handshakes = append(result.Handshakes, BenchHandshake{Broker: timings.broker, Handshake: timings.handshake})
+
+		if i < handshakes-1 {
+			session.Close()
+			c.removeForward(forward.id)
+		}
+	}
+
+	defer func() {
+		session.Close()
+		c.removeForward(forward.id)
+	}()
+
+	// Stream count scaling: 1, 2, 4, ... streams, and finally the requested number of streams
+	for n := 1; ; n *= 2 {
+		if n > streams {
+			n = streams
+		}
+
+		for _, direction := range []byte{benchDirectionUpload, benchDirectionDownload} {
+			run, err := c.benchRun(ctx, session, forward, direction, n, duration)
+			if err != nil && ctx.Err() != nil {
+				return result, nil
+			} else if err != nil {
+				return result, errors.New("benchmark failed: " + err.Error())
+			}
+
+			result.Runs = append(result.Runs, run)
+		}
+
+		if n == streams {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func benchOptions(options *BenchOptions) (time.Duration, int, int, error) {
+	duration, streams, handshakes := benchDefaultDuration, benchDefaultStreams, benchHandshakes
+
+	if options != nil {
+		if options.Duration != 0 {
+			duration = options.Duration
+		}
+		if options.Streams != 0 {
+			streams = options.Streams
+		}
+		if options.Handshakes != 0 {
+			handshakes = options.Handshakes
+		}
+	}
+
+	if duration < 0 || duration > benchMaxDuration {
+		return 0, 0, 0, fmt.Errorf("invalid duration %s, must be at most %s", duration, benchMaxDuration)
+	} else if streams < 0 || streams > benchMaxStreams {
+		return 0, 0, 0, fmt.Errorf("invalid number of streams %d, must be between 1 and %d", streams, benchMaxStreams)
+	} else if handshakes < 0 {
+		return 0, 0, 0, fmt.Errorf("invalid number of handshakes %d", handshakes)
+	}
+
+	return duration, streams, handshakes, nil
+}
+
+// benchRun transfers data in the given direction on the given number of parallel streams for
+// the given duration. All streams share the same QUIC session, i.e. the same hole punched path.
+func (c *client) benchRun(ctx context.Context, session quic.Session, forward *forward, direction byte, streams int, duration time.Duration) (BenchRun, error) {
+	c.config.Logger.Debug("Running benchmark", "forward", forward.id, "direction", string(direction), "streams", streams, "duration", duration)
+
+	var wg sync.WaitGroup
+	var total int64
+	errs := make(chan error, streams)
+
+	// Abort the streams if the context is canceled; this does not close the session
+	done := make(chan struct{})
+	defer close(done)
+
+	start := time.Now()
+
+	for i := 0; i < streams; i++ {
+		stream, err := c.openServiceStream(session)
+		if err != nil {
+			return BenchRun{}, err
+		}
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				stream.CancelRead(0)
+				stream.CancelWrite(0)
+			case <-done:
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			n, err := c.benchStream(stream, forward, direction, duration)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			atomic.AddInt64(&total, n)
+		}()
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	select {
+	case err := <-errs:
+		return BenchRun{}, err
+	default:
+	}
+
+	run := BenchRun{
+		Streams:  streams,
+		Upload:   direction == benchDirectionUpload,
+		Bytes:    total,
+		Duration: elapsed,
+	}
+
+	return run, nil
+}
+
+// benchStream runs a single benchmark stream and returns the number of bytes the peer received
+// (upload) or this client received (download). Upload streams are counted by the peer, so that
+// data still buffered locally when the time is up is not counted.
+func (c *client) benchStream(stream quic.Stream, forward *forward, direction byte, duration time.Duration) (int64, error) {
+	streamSession := c.openSession(forward, stream)
+	defer c.closeSession(streamSession)
+
+	header := make([]byte, 9)
+	header[0] = direction
+	binary.BigEndian.PutUint64(header[1:], uint64(duration))
+
+	if _, err := stream.Write(header); err != nil {
+		return 0, err
+	}
+
+	if direction == benchDirectionDownload {
+		n, err := io.Copy(&countingWriter{writer: ioutil.Discard, metric: c.metrics.forwardBytes, labelValues: []string{forward.peer(c.config.ClientId), "received"}, counter: &streamSession.received}, stream)
+		stream.Close()
+		return n, err
+	}
+
+	buf := make([]byte, benchBufferSize)
+	writer := &countingWriter{writer: stream, metric: c.metrics.forwardBytes, labelValues: []string{forward.peer(c.config.ClientId), "sent"}, counter: &streamSession.sent}
+	deadline := time.Now().Add(duration)
+
+	for time.Now().Before(deadline) {
+		if _, err := writer.Write(buf); err != nil {
+			return 0, err
+		}
+	}
+
+	// Closing the stream only closes the write direction, the peer then replies with
+	// the number of bytes it received
+	if err := stream.Close(); err != nil {
+		return 0, err
+	}
+
+	received := make([]byte, 8)
+	if _, err := io.ReadFull(stream, received); err != nil {
+		return 0, err
+	}
+
+	return int64(binary.BigEndian.Uint64(received)), nil
+}
+
+// handleBench answers a benchmark stream, see Client.Bench
+func (c *client) handleBench(stream quic.Stream, forward *forward) {
+	session := c.openSession(forward, stream)
+	defer c.closeSession(session)
+	defer stream.Close()
+
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		c.config.Logger.Debug("Cannot read benchmark header", "forward", forward.id, "error", err)
+		stream.CancelRead(0)
+		return
+	}
+
+	direction, duration := header[0], time.Duration(binary.BigEndian.Uint64(header[1:]))
+	c.config.Logger.Debug("Answering benchmark", "forward", forward.id, "peer", forward.source, "direction", string(direction), "duration", duration)
+
+	switch direction {
+	case benchDirectionUpload:
+		n, err := io.Copy(&countingWriter{writer: ioutil.Discard, metric: c.metrics.forwardBytes, labelValues: []string{forward.peer(c.config.ClientId), "received"}, counter: &session.received}, stream)
+		if err != nil {
+			return
+		}
+
+		received := make([]byte, 8)
+		binary.BigEndian.PutUint64(received, uint64(n))
+		stream.Write(received)
+	case benchDirectionDownload:
+		if duration > benchMaxDuration {
+			duration = benchMaxDuration
+		}
+
+		buf := make([]byte, benchBufferSize)
+		writer := &countingWriter{writer: stream, metric: c.metrics.forwardBytes, labelValues: []string{forward.peer(c.config.ClientId), "sent"}, counter: &session.sent}
+		deadline := time.Now().Add(duration)
+
+		for time.Now().Before(deadline) {
+			if _, err := writer.Write(buf); err != nil {
+				return
+			}
+		}
+	default:
+		c.config.Logger.Info("Invalid benchmark direction, closing stream", "forward", forward.id)
+		stream.CancelRead(0)
+	}
+}
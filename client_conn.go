@@ -1,12 +1,12 @@
 package natter
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/lucas-clemente/quic-go"
 	"heckel.io/natter/internal"
-	"log"
 	"math/rand"
 	"net"
 	"sync"
@@ -15,30 +15,72 @@ import (
 
 const (
 	checkLoopSleep = 15 * time.Second
+	pendingRequestTimeout = 2 * brokerForwardTimeout
 )
 
 type messageCallback func (messageType messageType, message proto.Message)
-type errorCallback func ()
-
+type connectCallback func (broker string, addr string)
+type errorCallback func (broker string)
+type advertiseCallback func () (services []string, allowPeers []string)
+type enrollCallback func () error
+type caPoolCallback func () *x509.CertPool
+
+// clientConn holds the connections to all brokers (see Config.BrokerAddrs), all of them sharing
+// one UDP socket. The client checks in with every broker, and sends its requests to the first
+// connected broker; forward requests that are rejected are tried with the next broker, since
+// the target may only be connected to that one.
 type clientConn struct {
-	config          *Config
-	messageCallback messageCallback
-	errorCallback   errorCallback
-
-	session       quic.Session
-	proto         *protocol
-	udpBrokerAddr *net.UDPAddr
-	udpConn       net.PacketConn
+	config            *Config
+	messageCallback   messageCallback
+	connectCallback   connectCallback
+	errorCallback     errorCallback
+	advertiseCallback advertiseCallback
+	enrollCallback    enrollCallback
+	caPoolCallback    caPoolCallback
+
+	brokers   []*brokerConn
+	udpConn   net.PacketConn
+	localAddr string
+	routes    map[string]*brokerConn     // Forward ID -> broker that relayed the forward request to this client
+	pending   map[string]*pendingRequest // Forward ID -> forward request sent by this client
+
+	mutex sync.RWMutex
+}
 
-	exitChan      chan int
-	connectedChan chan int
+// brokerConn is the connection to one broker. All fields but addr and connectMutex are
+// guarded by the clientConn mutex.
+type brokerConn struct {
+	addr        string
+	session     quic.Session
+	proto       *protocol
+	exitChan    chan int
+	ready       bool            // True once the broker answered the first check-in
+	online      map[string]bool // Peers the broker reported online, see handlePresenceUpdate
+	fingerprint string          // Fingerprint of the broker's public key, see verifyBrokerCertificate
+
+	connectMutex sync.Mutex
+}
 
-	disconnectOnce sync.Once
-	mutex          sync.RWMutex
+// pendingRequest is a forward request that was not answered yet, along with the brokers
+// it was sent to
+type pendingRequest struct {
+	request *internal.ForwardRequest
+	tried   map[*brokerConn]bool
+	last    *brokerConn
+	sent    time.Time
 }
 
-func newClientConn(config *Config, messageCallback messageCallback, errorCallback errorCallback) (*clientConn, error) {
-	udpBrokerAddr, err := net.ResolveUDPAddr("udp4", config.BrokerAddr)
+func newClientConn(config *Config, messageCallback messageCallback, connectCallback connectCallback, errorCallback errorCallback, advertiseCallback advertiseCallback, enrollCallback enrollCallback, caPoolCallback caPoolCallback) (*clientConn, error) {
+	addrs := brokerAddrs(config)
+
+	var udpBrokerAddr *net.UDPAddr
+	var err error
+
+	for _, addr := range addrs {
+		if udpBrokerAddr, err = net.ResolveUDPAddr("udp4", addr); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -48,139 +90,636 @@ func newClientConn(config *Config, messageCallback messageCallback, errorCallbac
 		return nil, err
 	}
 
+	brokers := make([]*brokerConn, 0, len(addrs))
+	for _, addr := range addrs {
+		brokers = append(brokers, &brokerConn{addr: addr, online: make(map[string]bool)})
+	}
+
 	return &clientConn{
-		config:          config,
-		udpBrokerAddr:   udpBrokerAddr,
-		udpConn:         udpConn,
-		messageCallback: messageCallback,
-		errorCallback:   errorCallback,
+		config:            config,
+		brokers:           brokers,
+		udpConn:           udpConn,
+		localAddr:         findLocalAddr(udpBrokerAddr, udpConn),
+		routes:            make(map[string]*brokerConn),
+		pending:           make(map[string]*pendingRequest),
+		messageCallback:   messageCallback,
+		connectCallback:   connectCallback,
+		errorCallback:     errorCallback,
+		advertiseCallback: advertiseCallback,
+		enrollCallback:    enrollCallback,
+		caPoolCallback:    caPoolCallback,
 	}, nil
 }
 
+// connect connects to all brokers, unless the client is connected to at least one of them
+// already. It returns as soon as one broker is connected; brokers that cannot be reached are
+// reported via the error callback, so that they are retried in the background. If no broker
+// can be reached, the last error is returned. Clients that need a certificate from the broker's
+// CA get it before connecting, see client.enroll.
 func (b *clientConn) connect() error {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	if b.connected() {
+		return nil
+	}
+
+	if err := b.enrollCallback(); err != nil {
+		return err
+	}
+
+	type result struct {
+		broker *brokerConn
+		err    error
+	}
 
+	results := make(chan *result, len(b.brokers))
+	for _, broker := range b.brokers {
+		go func(broker *brokerConn) {
+			results <- &result{broker, b.connectBroker(broker)}
+		}(broker)
+	}
+
+	failed := make([]*brokerConn, 0)
 	var err error
 
+	for i := range b.brokers {
+		r := <- results
+		if r.err == nil {
+			go func(remaining int) {
+				for i := 0; i < remaining; i++ {
+					if r := <- results; r.err != nil {
+						failed = append(failed, r.broker)
+					}
+				}
+				for _, broker := range failed {
+					b.config.Logger.Error("Cannot connect to broker", "broker", broker.addr)
+					b.errorCallback(broker.addr)
+				}
+			}(len(b.brokers) - i - 1)
+			return nil
+		}
+
+		failed = append(failed, r.broker)
+		err = r.err
+	}
+
+	return err
+}
+
+// reconnect connects to the broker with the given address, if it is not connected already.
+// Like connect, it enrolls first, in case the certificate expired while the client was offline.
+func (b *clientConn) reconnect(addr string) error {
+	if err := b.enrollCallback(); err != nil {
+		return err
+	}
+
+	for _, broker := range b.brokers {
+		if broker.addr == addr {
+			return b.connectBroker(broker)
+		}
+	}
+
+	return errors.New("unknown broker " + addr)
+}
+
+func (b *clientConn) connectBroker(broker *brokerConn) error {
+	broker.connectMutex.Lock()
+	defer broker.connectMutex.Unlock()
+
 	// Check if already connected
-	if b.proto != nil {
+	b.mutex.RLock()
+	connected := broker.proto != nil
+	b.mutex.RUnlock()
+
+	if connected {
 		return nil
 	}
 
-	log.Printf("Connecting to broker at %s\n", b.udpBrokerAddr.String())
+	b.config.Logger.Info("Connecting to broker", "broker", broker.addr)
 
-	tlsClientConfig := *b.config.TLSClientConfig // copy, because quic-go alters it!
-	b.session, err = quic.Dial(b.udpConn, b.udpBrokerAddr, b.udpBrokerAddr.String(), &tlsClientConfig, b.config.QuicConfig)
+	session, fingerprint, err := b.dial(broker.addr)
 	if err != nil {
 		return err
 	}
 
-	stream, err := b.session.OpenStream()
+	stream, err := session.OpenStream()
 	if err != nil {
+		session.Close()
 		return err
 	}
 
-	b.proto = &protocol{stream: stream}
-	b.exitChan = make(chan int)
-	b.connectedChan = make(chan int)
+	// The goroutines are bound to this connection's protocol and exit channel, so
+	// that they cannot tear down a newer connection after a reconnect
+	proto := &protocol{stream: stream, logger: b.config.Logger}
+	exitChan := make(chan int)
+	connectedChan := make(chan int, 1)
 
-	go b.handleIncoming()
-	go b.handleCheckinLoop()
+	b.mutex.Lock()
+	broker.session = session
+	broker.proto = proto
+	broker.exitChan = exitChan
+	broker.fingerprint = fingerprint
+	b.mutex.Unlock()
+
+	go b.handleIncoming(broker, proto, exitChan, connectedChan)
+	go b.handleCheckinLoop(broker, proto, fingerprint, exitChan)
 
 	select {
-	case <- b.connectedChan:
+	case <- connectedChan:
 		return nil
 	case <- time.After(5 * time.Second):
+		b.disconnect(broker, exitChan, false)
 		return errors.New("timed out while connecting")
 	}
 }
 
-func (b *clientConn) disconnect() {
+// dial opens a QUIC session to the broker with the given address, and returns it along with the
+// fingerprint of the broker's public key, see verifyBrokerCertificate
+func (b *clientConn) dial(addr string) (quic.Session, string, error) {
+	udpBrokerAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tlsClientConfig := b.config.TLSClientConfig.Clone() // copy, because quic-go alters it!
+	session, err := quic.Dial(b.udpConn, udpBrokerAddr, udpBrokerAddr.String(), tlsClientConfig, b.config.QuicConfig)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fingerprint, err := verifyBrokerCertificate(b.caPoolCallback(), b.config.BrokerFingerprint, addr, session.ConnectionState().PeerCertificates)
+	if err != nil {
+		session.Close()
+		return nil, "", err
+	}
+
+	return session, fingerprint, nil
+}
+
+// enroll sends the enroll request to the broker with the given address via a separate session,
+// since the client cannot check in before it has a certificate, and waits for the response
+func (b *clientConn) enroll(addr string, request *internal.EnrollRequest) (*internal.EnrollResponse, error) {
+	session, _, err := b.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+
+	proto := &protocol{stream: stream, logger: b.config.Logger}
+	if err := proto.send(messageTypeEnrollRequest, request); err != nil {
+		return nil, err
+	}
+
+	stream.SetReadDeadline(time.Now().Add(enrollTimeout))
+
+	messageType, message, err := proto.receive()
+	if err != nil {
+		return nil, err
+	} else if messageType != messageTypeEnrollResponse {
+		return nil, errors.New("unexpected response from broker")
+	}
+
+	response := message.(*internal.EnrollResponse)
+	if !response.Success {
+		return nil, errors.New("broker rejected enrollment: " + response.Error)
+	}
+
+	return response, nil
+}
+
+// disconnect shuts down the broker connection identified by the exit channel, unless
+// it was shut down already, or replaced by a newer connection. Forward requests that
+// were waiting for this broker are sent to the next one, and peers that only this broker
+// reported online are reported offline, if the client is still connected to another broker.
+func (b *clientConn) disconnect(broker *brokerConn, exitChan chan int, notify bool) {
 	b.mutex.Lock()
-	defer b.mutex.Unlock()
 
-	// Check if connected
-	if b.proto == nil {
+	if broker.proto == nil || broker.exitChan != exitChan {
+		b.mutex.Unlock()
 		return
 	}
 
-	// Run showdown method
-	b.disconnectOnce.Do(func() {
-		log.Println("Shutting down broker connection ...")
+	b.config.Logger.Info("Shutting down broker connection", "broker", broker.addr)
+
+	close(broker.exitChan)
+
+	broker.proto.close()
+	broker.session.Close()
+
+	broker.proto = nil
+	broker.session = nil
+	broker.exitChan = nil
+	broker.ready = false
+
+	offline := make([]string, 0)
+	for peer, online := range broker.online {
+		if online && !b.online(peer) {
+			offline = append(offline, peer)
+		}
+	}
+	broker.online = make(map[string]bool)
+
+	retries := make([]*pendingRequest, 0)
+	for _, pending := range b.pending {
+		if pending.last == broker {
+			retries = append(retries, pending)
+		}
+	}
 
-		close(b.exitChan)
-		close(b.connectedChan)
+	connected := b.primary() != nil
+	b.mutex.Unlock()
 
-		b.proto.close()
-		b.session.Close()
+	if notify {
+		b.errorCallback(broker.addr)
+	}
 
-		b.proto = nil
-		b.session = nil
+	if !connected {
+		return // Presence and forwards are handled by the client once a broker is back
+	}
 
-		b.errorCallback()
-	})
+	for _, peer := range offline {
+		b.messageCallback(messageTypePresenceUpdate, &internal.PresenceUpdate{Peer: peer, Online: false})
+	}
+
+	for _, pending := range retries {
+		if !b.retry(pending) {
+			b.messageCallback(messageTypeForwardResponse, &internal.ForwardResponse{Id: pending.request.Id, Success: false})
+		}
+	}
 }
 
+// Send sends a message to the first connected broker. Forward responses are sent to the broker
+// that relayed the forward request, and presence requests are sent to all connected brokers.
 func (b *clientConn) Send(messageType messageType, message proto.Message) error {
-	return b.proto.send(messageType, message)
+	switch messageType {
+	case messageTypeForwardResponse:
+		return b.sendForwardResponse(message.(*internal.ForwardResponse))
+	case messageTypeForwardRequest:
+		return b.sendForwardRequest(message.(*internal.ForwardRequest))
+	case messageTypePresenceRequest:
+		return b.sendAll(messageType, message)
+	}
+
+	b.mutex.RLock()
+	broker := b.primary()
+	b.mutex.RUnlock()
+
+	if broker == nil {
+		return errors.New("not connected to broker")
+	}
+
+	return b.sendTo(broker, messageType, message)
+}
+
+func (b *clientConn) sendForwardRequest(request *internal.ForwardRequest) error {
+	b.mutex.Lock()
+	broker := b.primary()
+	if broker == nil {
+		b.mutex.Unlock()
+		return errors.New("not connected to broker")
+	}
+
+	for id, pending := range b.pending {
+		if time.Since(pending.sent) > pendingRequestTimeout {
+			delete(b.pending, id)
+		}
+	}
+
+	b.pending[request.Id] = &pendingRequest{
+		request: request,
+		tried:   map[*brokerConn]bool{broker: true},
+		last:    broker,
+		sent:    time.Now(),
+	}
+	b.mutex.Unlock()
+
+	return b.sendTo(broker, messageTypeForwardRequest, request)
+}
+
+func (b *clientConn) sendForwardResponse(response *internal.ForwardResponse) error {
+	b.mutex.Lock()
+	broker, ok := b.routes[response.Id]
+	delete(b.routes, response.Id)
+	if !ok || !broker.ready {
+		broker = b.primary()
+	}
+	b.mutex.Unlock()
+
+	if broker == nil {
+		return errors.New("not connected to broker")
+	}
+
+	return b.sendTo(broker, messageTypeForwardResponse, response)
+}
+
+// sendAll sends a message to all connected brokers. It only fails if it cannot be sent to any.
+func (b *clientConn) sendAll(messageType messageType, message proto.Message) error {
+	b.mutex.Lock()
+	brokers := make([]*brokerConn, 0)
+	for _, broker := range b.brokers {
+		if broker.ready {
+			brokers = append(brokers, broker)
+
+			// Brokers answer presence requests with updates for all online peers
+			if messageType == messageTypePresenceRequest {
+				broker.online = make(map[string]bool)
+			}
+		}
+	}
+	b.mutex.Unlock()
+
+	err := errors.New("not connected to broker")
+	sent := false
+
+	for _, broker := range brokers {
+		if err = b.sendTo(broker, messageType, message); err == nil {
+			sent = true
+		} else {
+			b.config.Logger.Error("Cannot send message to broker", "broker", broker.addr, "type", messageTypes[messageType], "error", err)
+		}
+	}
+
+	if sent {
+		return nil
+	}
+
+	return err
+}
+
+// retry sends a rejected forward request to the next connected broker that did not see it yet.
+// It returns false if there is no such broker.
+func (b *clientConn) retry(pending *pendingRequest) bool {
+	b.mutex.Lock()
+	var next *brokerConn
+	for _, broker := range b.brokers {
+		if broker.ready && !pending.tried[broker] {
+			next = broker
+			break
+		}
+	}
+
+	if next == nil {
+		delete(b.pending, pending.request.Id)
+		b.mutex.Unlock()
+		return false
+	}
+
+	pending.tried[next] = true
+	pending.last = next
+	b.mutex.Unlock()
+
+	b.config.Logger.Info("Trying forward request with next broker", "forward", pending.request.Id, "broker", next.addr)
+
+	if err := b.sendTo(next, messageTypeForwardRequest, pending.request); err != nil {
+		b.config.Logger.Error("Cannot send forward request", "forward", pending.request.Id, "broker", next.addr, "error", err)
+		return b.retry(pending)
+	}
+
+	return true
+}
+
+// sendTo sends a message to the given broker, unless the connection was shut down in the meantime
+func (b *clientConn) sendTo(broker *brokerConn, messageType messageType, message proto.Message) error {
+	b.mutex.RLock()
+	proto := broker.proto // If the connection is closed after this, sending fails
+	b.mutex.RUnlock()
+
+	if proto == nil {
+		return errors.New("not connected to broker")
+	}
+
+	return proto.send(messageType, message)
+}
+
+// primary returns the first connected broker, or nil. It must be called with the mutex held.
+func (b *clientConn) primary() *brokerConn {
+	for _, broker := range b.brokers {
+		if broker.ready {
+			return broker
+		}
+	}
+
+	return nil
+}
+
+// online returns true if any connected broker reported the peer online. It must be called
+// with the mutex held.
+func (b *clientConn) online(peer string) bool {
+	for _, broker := range b.brokers {
+		if broker.ready && broker.online[peer] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// connected returns true if the client is currently connected to at least one broker
+func (b *clientConn) connected() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.primary() != nil
+}
+
+// connectedTo returns true if the client is currently connected to the given broker
+func (b *clientConn) connectedTo(addr string) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for _, broker := range b.brokers {
+		if broker.addr == addr {
+			return broker.ready
+		}
+	}
+
+	return false
 }
 
 func (b *clientConn) UdpConn() net.PacketConn {
 	return b.udpConn
 }
 
-func (b *clientConn) handleIncoming() {
+func (b *clientConn) handleIncoming(broker *brokerConn, proto *protocol, exitChan chan int, connectedChan chan int) {
 	defer func() {
-		log.Println("Exiting read loop due to error")
-		b.disconnect()
+		b.config.Logger.Debug("Exiting read loop", "broker", broker.addr)
+		b.disconnect(broker, exitChan, true)
 	}()
 
 	var connected bool
 
 	for {
 		select {
-		case <- b.exitChan:
+		case <- exitChan:
 			return
 		default:
 		}
 
-		messageType, message, err := b.proto.receive()
+		messageType, message, err := proto.receive()
 		if err != nil {
-			log.Println("Error reading message from broker connection: " + err.Error())
+			b.config.Logger.Error("Error reading message from broker connection", "broker", broker.addr, "error", err)
 			return
 		}
 
 		switch messageType {
 		case messageTypeCheckinResponse:
 			if !connected {
-				log.Println("Successfully connected to broker")
+				b.config.Logger.Info("Successfully connected to broker", "broker", broker.addr, "addr", message.(*internal.CheckinResponse).Addr)
 				connected = true
-				b.connectedChan <- 1
+
+				b.mutex.Lock()
+				broker.ready = true
+				b.mutex.Unlock()
+
+				connectedChan <- 1
+				b.connectCallback(broker.addr, message.(*internal.CheckinResponse).Addr)
+			}
+		case messageTypeForwardRequest:
+			b.mutex.Lock()
+			b.routes[message.(*internal.ForwardRequest).Id] = broker
+			b.mutex.Unlock()
+		case messageTypeForwardResponse:
+			if !b.handleForwardResponse(message.(*internal.ForwardResponse)) {
+				continue
 			}
+		case messageTypePresenceUpdate:
+			update := message.(*internal.PresenceUpdate)
+
+			b.mutex.Lock()
+			broker.online[update.Peer] = update.Online
+			message = &internal.PresenceUpdate{Peer: update.Peer, Online: b.online(update.Peer)}
+			b.mutex.Unlock()
 		}
 
 		b.messageCallback(messageType, message)
 	}
 }
 
-func (b *clientConn) handleCheckinLoop() {
+// handleForwardResponse returns true if the response is to be passed on to the client, i.e.
+// unless the forward was rejected and is now tried with the next broker
+func (b *clientConn) handleForwardResponse(response *internal.ForwardResponse) bool {
+	b.mutex.Lock()
+	pending, ok := b.pending[response.Id]
+	if ok && response.Success {
+		delete(b.pending, response.Id)
+	}
+	b.mutex.Unlock()
+
+	if !ok || response.Success {
+		return true
+	}
+
+	return !b.retry(pending)
+}
+
+func (b *clientConn) handleCheckinLoop(broker *brokerConn, proto *protocol, fingerprint string, exitChan chan int) {
 	defer func() {
-		log.Println("Exiting checkin loop due to error")
-		b.disconnect()
+		b.config.Logger.Debug("Exiting checkin loop", "broker", broker.addr)
+		b.disconnect(broker, exitChan, true)
 	}()
 
 	for {
-		err := b.proto.send(messageTypeCheckinRequest, &internal.CheckinRequest{Source: b.config.ClientId})
+		err := b.sendCheckin(proto, fingerprint)
 		if err != nil {
-			log.Println("Error sending checking request to broker: " + err.Error())
+			b.config.Logger.Error("Error sending checkin request to broker", "broker", broker.addr, "error", err)
 			return
 		}
 
 		select {
-		case <- b.exitChan:
+		case <- exitChan:
 			return
 		case <- time.After(checkLoopSleep):
 		}
 	}
 }
+
+// checkin sends a check-in request to all connected brokers, advertising the services this
+// client offers. It is called whenever the services or allowed peers change; the periodic
+// check-ins are sent by handleCheckinLoop.
+func (b *clientConn) checkin() error {
+	b.mutex.RLock()
+	brokers := make([]*brokerConn, 0)
+	protos := make(map[*brokerConn]*protocol)
+	fingerprints := make(map[*brokerConn]string)
+	for _, broker := range b.brokers {
+		if broker.ready && broker.proto != nil {
+			brokers = append(brokers, broker)
+			protos[broker] = broker.proto
+			fingerprints[broker] = broker.fingerprint
+		}
+	}
+	b.mutex.RUnlock()
+
+	err := errors.New("not connected to broker")
+	sent := false
+
+	for _, broker := range brokers {
+		if err = b.sendCheckin(protos[broker], fingerprints[broker]); err == nil {
+			sent = true
+		} else {
+			b.config.Logger.Error("Cannot send check-in request to broker", "broker", broker.addr, "error", err)
+		}
+	}
+
+	if sent {
+		return nil
+	}
+
+	return err
+}
+
+// sendCheckin sends a check-in request via the given broker connection. Check-ins are signed for
+// the broker, identified by the fingerprint of its public key, if the client has a certificate.
+func (b *clientConn) sendCheckin(proto *protocol, fingerprint string) error {
+	services, allowPeers := b.advertiseCallback()
+
+	request := &internal.CheckinRequest{
+		Source:     b.config.ClientId,
+		LocalAddr:  b.localAddr,
+		Services:   services,
+		AllowPeers: allowPeers,
+	}
+
+	if certificate := clientCertificate(b.config); certificate != nil {
+		if err := signCheckin(request, certificate, fingerprint); err != nil {
+			return err
+		}
+	}
+
+	return proto.send(messageTypeCheckinRequest, request)
+}
+
+// brokerAddrs returns the addresses of all brokers the client connects to, in the order in
+// which they are used: BrokerAddr first, then BrokerAddrs. Duplicates are skipped.
+func brokerAddrs(config *Config) []string {
+	addrs := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, addr := range append([]string{config.BrokerAddr}, config.BrokerAddrs...) {
+		if addr != "" && !seen[addr] {
+			addrs = append(addrs, addr)
+			seen[addr] = true
+		}
+	}
+
+	return addrs
+}
+
+// findLocalAddr determines the local IP address used to talk to the broker, and
+// combines it with the port of the UDP socket. The broker compares it to the observed
+// address to guess the type of NAT the client is behind. No packets are sent here.
+func findLocalAddr(udpBrokerAddr *net.UDPAddr, udpConn net.PacketConn) string {
+	probeConn, err := net.DialUDP("udp4", nil, udpBrokerAddr)
+	if err != nil {
+		return ""
+	}
+	defer probeConn.Close()
+
+	localIP := probeConn.LocalAddr().(*net.UDPAddr).IP
+	localPort := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	return fmt.Sprintf("%s:%d", localIP, localPort)
+}
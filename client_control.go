@@ -0,0 +1,411 @@
+package natter
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ControlStatus is the response of a GET /status request to the control API
+type ControlStatus struct {
+	ClientId   string           `json:"clientId"`
+	BrokerAddr string           `json:"brokerAddr"`
+	Brokers    []*ControlBroker `json:"brokers"`
+	Connected  bool             `json:"connected"`
+	Listening  bool             `json:"listening"`
+	Services   []string         `json:"services"`
+	AllowPeers []string         `json:"allowPeers,omitempty"`
+	Forwards   int              `json:"forwards"`
+	Sessions   int              `json:"sessions"`
+}
+
+// ControlBroker is one of the brokers in ControlStatus, and whether the client is connected to it
+type ControlBroker struct {
+	Addr      string `json:"addr"`
+	Connected bool   `json:"connected"`
+}
+
+// ControlForward describes an outgoing or incoming forward in the responses of the
+// /forwards endpoints of the control API
+type ControlForward struct {
+	Id                string   `json:"id"`
+	Spec              string   `json:"spec"`
+	Direction         string   `json:"direction"`
+	Peer              string   `json:"peer"`
+	PeerAddr          string   `json:"peerAddr,omitempty"`
+	LocalAddr         string   `json:"localAddr,omitempty"`
+	TargetForwardAddr string   `json:"targetForwardAddr,omitempty"`
+	TargetCommand     []string `json:"targetCommand,omitempty"`
+	TargetService     string   `json:"targetService,omitempty"`
+	Limit             string   `json:"limit,omitempty"`
+	Compression       string   `json:"compression,omitempty"`
+	State             string   `json:"state"`
+}
+
+// ControlSession is a stream that is currently forwarding, see GET /sessions
+type ControlSession struct {
+	Forward            string    `json:"forward"`
+	Peer               string    `json:"peer"`
+	Stream             int64     `json:"stream"`
+	Started            time.Time `json:"started"`
+	Sent               int64     `json:"sent"`
+	Received           int64     `json:"received"`
+	SentCompressed     int64     `json:"sentCompressed,omitempty"`
+	ReceivedCompressed int64     `json:"receivedCompressed,omitempty"`
+}
+
+// ControlForwardRequest is the body of a POST /forwards request. Spec uses the
+// forward spec syntax (see ParseForwardSpec), e.g. 8022:bob:22 or 8022:bob/ssh.
+type ControlForwardRequest struct {
+	Spec        string   `json:"spec"`
+	Command     []string `json:"command,omitempty"`
+	Wait        bool     `json:"wait,omitempty"`
+	Limit       string   `json:"limit,omitempty"`
+	Compression string   `json:"compression,omitempty"`
+}
+
+// ControlLimitRequest is the body of a PUT /forwards/KEY request. Limit uses the rate
+// limit syntax (see ParseRateLimit), e.g. 1M or 1M:4M. If it is empty, the limit is removed.
+type ControlLimitRequest struct {
+	Limit string `json:"limit"`
+}
+
+var forwardStateNames = map[int]string{
+	forwardStateRequested: "requested",
+	forwardStateAccepted:  "accepted",
+	forwardStateRejected:  "rejected",
+	forwardStateClosed:    "closed",
+}
+
+// listenAndServeControl starts the control API on the Unix socket. It exposes the following endpoints:
+//
+//	GET    /status        - Show broker connection, services, allowed peers and counts
+//	GET    /forwards      - List outgoing and incoming forwards
+//	POST   /forwards      - Add a forward, see ControlForwardRequest
+//	PUT    /forwards/KEY  - Change the rate limit of an outgoing forward, see ControlLimitRequest
+//	DELETE /forwards/KEY  - Remove an outgoing forward by its ID or spec
+//	GET    /sessions      - List the streams that are currently forwarding
+func (c *client) listenAndServeControl() {
+	socket := c.config.ControlSocket
+
+	listener, err := listenControlSocket(socket)
+	if err != nil {
+		c.config.Logger.Error("Cannot listen on control socket, control API disabled", "socket", socket, "error", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", c.handleControlStatus)
+	mux.HandleFunc("/forwards", c.handleControlForwards)
+	mux.HandleFunc("/forwards/", c.handleControlForward)
+	mux.HandleFunc("/sessions", c.handleControlSessions)
+
+	c.config.Logger.Info("Control API listening", "socket", socket)
+
+	if err := http.Serve(listener, mux); err != nil {
+		c.config.Logger.Error("Control API failed", "socket", socket, "error", err)
+	}
+}
+
+// listenControlSocket creates the Unix socket of the control API. The socket is created in a temporary
+// directory that only the current user can access, and is moved to its path after its permissions are
+// restricted, so that other users cannot connect to it in the meantime. The parent directory of the socket
+// is created with 0700 permissions if it does not exist. Sockets of other users are never replaced.
+func listenControlSocket(socket string) (net.Listener, error) {
+	dir := filepath.Dir(socket)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// Remove the socket file of a previous run, unless another client is still using it
+	if info, err := os.Lstat(socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("file exists and is not a socket")
+		} else if ownedByOtherUser(info) {
+			return nil, errors.New("socket is owned by another user")
+		}
+
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return nil, errors.New("socket is in use by another process")
+		}
+
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+
+	tempDir, err := ioutil.TempDir(dir, ".natter-control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	tempSocket := filepath.Join(tempDir, "natter.sock")
+	listener, err := net.Listen("unix", tempSocket)
+	if err != nil {
+		return nil, err
+	}
+
+	// The listener would remove the temporary path when closed, the socket is replaced on the next start instead
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tempSocket, 0600); err != nil {
+		listener.Close()
+		return nil, errors.New("cannot restrict permissions: " + err.Error())
+	}
+
+	if err := os.Rename(tempSocket, socket); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func (c *client) handleControlStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	services, allowPeers := c.advertised()
+
+	c.listenMutex.Lock()
+	listening := c.listener != nil
+	c.listenMutex.Unlock()
+
+	c.forwardsMutex.RLock()
+	forwards := len(c.forwards)
+	c.forwardsMutex.RUnlock()
+
+	c.sessionsMutex.Lock()
+	sessions := len(c.sessions)
+	c.sessionsMutex.Unlock()
+
+	brokers := make([]*ControlBroker, 0)
+	for _, addr := range brokerAddrs(c.config) {
+		brokers = append(brokers, &ControlBroker{Addr: addr, Connected: c.conn.connectedTo(addr)})
+	}
+
+	c.writeControlJson(w, http.StatusOK, &ControlStatus{
+		ClientId:   c.config.ClientId,
+		BrokerAddr: c.config.BrokerAddr,
+		Brokers:    brokers,
+		Connected:  c.conn.connected(),
+		Listening:  listening,
+		Services:   services,
+		AllowPeers: allowPeers,
+		Forwards:   forwards,
+		Sessions:   sessions,
+	})
+}
+
+func (c *client) handleControlForwards(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		c.forwardsMutex.RLock()
+		forwards := make([]*ControlForward, 0, len(c.forwards))
+		for _, forward := range c.forwards {
+			forwards = append(forwards, c.newControlForward(forward))
+		}
+		c.forwardsMutex.RUnlock()
+
+		sort.Slice(forwards, func(i, j int) bool {
+			if forwards[i].Direction != forwards[j].Direction {
+				return forwards[i].Direction > forwards[j].Direction // Outgoing first
+			}
+			return forwards[i].Spec < forwards[j].Spec
+		})
+
+		c.writeControlJson(w, http.StatusOK, forwards)
+	case http.MethodPost:
+		var request ControlForwardRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		spec, err := ParseForwardSpec(request.Spec, request.Command)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if spec.LocalAddr == "" {
+			http.Error(w, "forwarding STDIN is not possible via the control API", http.StatusBadRequest)
+			return
+		}
+
+		options := &ForwardOptions{Service: spec.Service, WaitForPeer: request.Wait, Compression: request.Compression}
+		if request.Limit != "" {
+			options.RateLimit, err = ParseRateLimit(request.Limit)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		added, err := c.ForwardWithOptions(spec.LocalAddr, spec.Target, spec.TargetForwardAddr, spec.TargetCommand, options)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		c.config.Logger.Info("Forward added via control API", "forward", spec.String())
+		c.writeControlJson(w, http.StatusCreated, c.newControlForward(added.(*forward)))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *client) handleControlForward(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/forwards/")
+
+	if r.Method != http.MethodDelete && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Forwards can be identified by their ID, or by their spec, since the ID changes
+	// whenever a forward is re-requested
+	var found *forward
+
+	c.forwardsMutex.RLock()
+	for _, forward := range c.forwards {
+		if forward.source == c.config.ClientId && forward.client != nil {
+			if forward.id == key || forward.Spec().String() == key {
+				found = forward
+				break
+			}
+		}
+	}
+	c.forwardsMutex.RUnlock()
+
+	if found == nil {
+		http.Error(w, "forward not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var request ControlLimitRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var limit *RateLimit
+		if request.Limit != "" {
+			var err error
+			if limit, err = ParseRateLimit(request.Limit); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		found.SetRateLimit(limit)
+
+		c.config.Logger.Info("Forward rate limit changed via control API", "forward", key, "limit", request.Limit)
+		c.writeControlJson(w, http.StatusOK, c.newControlForward(found))
+		return
+	}
+
+	if err := found.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.config.Logger.Info("Forward removed via control API", "forward", key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *client) handleControlSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.sessionsMutex.Lock()
+	sessions := make([]*ControlSession, 0, len(c.sessions))
+	for _, session := range c.sessions {
+		sessions = append(sessions, &ControlSession{
+			Forward:            session.forward,
+			Peer:               session.peer,
+			Stream:             session.stream,
+			Started:            session.started,
+			Sent:               atomic.LoadInt64(&session.sent),
+			Received:           atomic.LoadInt64(&session.received),
+			SentCompressed:     atomic.LoadInt64(&session.sentCompressed),
+			ReceivedCompressed: atomic.LoadInt64(&session.receivedCompressed),
+		})
+	}
+	c.sessionsMutex.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	c.writeControlJson(w, http.StatusOK, sessions)
+}
+
+func (c *client) newControlForward(forward *forward) *ControlForward {
+	compression := forward.Compression() // Locks the forward itself
+
+	forward.RLock()
+	defer forward.RUnlock()
+
+	f := &ControlForward{
+		Id:                forward.id,
+		TargetForwardAddr: forward.targetForwardAddr,
+		TargetCommand:     forward.targetCommand,
+		TargetService:     forward.targetService,
+		Compression:       compression,
+		State:             forwardStateNames[forward.state],
+	}
+
+	if forward.peerUdpAddr != nil {
+		f.PeerAddr = forward.peerUdpAddr.String()
+	}
+
+	if forward.limiter != nil {
+		if limit := forward.limiter.limit(); limit != nil {
+			f.Limit = limit.String()
+		}
+	} else if forward.source != c.config.ClientId {
+		if limit := c.sourceRateLimit(forward.source); limit != nil {
+			f.Limit = limit.String() + " (peer)"
+		}
+	}
+
+	// Incoming forwards are always accepted, and their source address is the peer's UDP address
+	if forward.source == c.config.ClientId {
+		f.Direction = "outgoing"
+		f.Peer = forward.target
+		f.LocalAddr = forward.sourceAddr
+		f.Spec = forward.Spec().String()
+	} else {
+		f.Direction = "incoming"
+		f.Peer = forward.source
+		f.State = forwardStateNames[forwardStateAccepted]
+		f.Spec = forward.source + " -> " + forward.targetForwardAddr
+		if forward.targetService != "" {
+			f.Spec = forward.source + " -> " + forward.targetService
+		} else if len(forward.targetCommand) > 0 {
+			f.Spec = forward.source + " -> " + strings.Join(forward.targetCommand, " ")
+		}
+	}
+
+	return f
+}
+
+func (c *client) writeControlJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		c.config.Logger.Error("Cannot write control API response", "error", err)
+	}
+}
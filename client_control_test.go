@@ -0,0 +1,79 @@
+package natter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenControlSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natter-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "run", "natter.sock")
+
+	listener, err := listenControlSocket(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(socket); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("expected socket permissions 0600, got %o", info.Mode().Perm())
+	}
+	if info, err := os.Stat(filepath.Dir(socket)); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0700 {
+		t.Errorf("expected directory permissions 0700, got %o", info.Mode().Perm())
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(socket)); len(files) != 1 {
+		t.Errorf("expected temporary directory to be removed, got %d files", len(files))
+	}
+
+	go func(listener net.Listener) {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}(listener)
+	if conn, err := net.Dial("unix", socket); err != nil {
+		t.Errorf("expected socket to be reachable after moving it, got %s", err)
+	} else {
+		conn.Close()
+	}
+
+	if _, err := listenControlSocket(socket); err == nil {
+		t.Errorf("expected socket in use to be refused")
+	}
+
+	// Stale sockets of a previous run are replaced
+	listener.Close()
+	listener, err = listenControlSocket(socket)
+	if err != nil {
+		t.Fatalf("expected stale socket to be replaced, got %s", err)
+	}
+	listener.Close()
+
+	// Sockets of other users are never replaced, this can only be set up as root
+	if os.Getuid() == 0 {
+		if err := os.Chown(socket, 65534, 65534); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := listenControlSocket(socket); err == nil {
+			t.Errorf("expected socket of another user to be refused")
+		}
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenControlSocket(file); err == nil {
+		t.Errorf("expected regular file to be refused")
+	}
+}
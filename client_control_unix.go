@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package natter
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownedByOtherUser returns true if the file is not owned by the user running natter
+func ownedByOtherUser(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(stat.Uid) != os.Getuid()
+}
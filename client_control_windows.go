@@ -0,0 +1,10 @@
+package natter
+
+import (
+	"os"
+)
+
+// ownedByOtherUser always returns false, since Windows does not expose file owners via os.FileInfo
+func ownedByOtherUser(info os.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,87 @@
+package natter
+
+import (
+	"context"
+	"errors"
+	"heckel.io/natter/internal"
+)
+
+func (c *client) Peers(ctx context.Context) ([]*Peer, error) {
+	err := c.conn.connect()
+	if err != nil {
+		return nil, errors.New("cannot connect to broker: " + err.Error())
+	}
+
+	// The broker returns the peers in pages that fit into a single message, see peersPage
+	peers := make([]*Peer, 0)
+	seen := make(map[string]bool)
+
+	for offset := int32(0); ; {
+		response, err := c.peersPage(ctx, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, peer := range response.Peers {
+			if seen[peer.Id] {
+				continue // Clients may connect between pages, which shifts the offsets
+			}
+			seen[peer.Id] = true
+
+			peers = append(peers, &Peer{
+				Id:       peer.Id,
+				NatType:  peer.NatType,
+				Services: peer.Services,
+			})
+		}
+
+		if response.Next <= offset {
+			return peers, nil
+		}
+		offset = response.Next
+	}
+}
+
+func (c *client) peersPage(ctx context.Context, offset int32) (*internal.PeersResponse, error) {
+	id := c.generateConnId()
+	responseChan := make(chan *internal.PeersResponse, 1)
+
+	c.peersRequestsMutex.Lock()
+	c.peersRequests[id] = responseChan
+	c.peersRequestsMutex.Unlock()
+
+	defer func() {
+		c.peersRequestsMutex.Lock()
+		delete(c.peersRequests, id)
+		c.peersRequestsMutex.Unlock()
+	}()
+
+	if err := c.conn.Send(messageTypePeersRequest, &internal.PeersRequest{Id: id, Offset: offset}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case response := <-responseChan:
+		return response, nil
+	}
+}
+
+func (c *client) handlePeersResponse(response *internal.PeersResponse) {
+	c.peersRequestsMutex.Lock()
+	defer c.peersRequestsMutex.Unlock()
+
+	responseChan, ok := c.peersRequests[response.Id]
+	if !ok {
+		c.config.Logger.Info("Peers response with unknown ID received, ignoring", "request", response.Id)
+		return
+	}
+
+	// Each request gets a single response, late or duplicate ones must not block the broker connection
+	delete(c.peersRequests, response.Id)
+	select {
+	case responseChan <- response:
+	default:
+	}
+}
@@ -0,0 +1,323 @@
+package natter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"heckel.io/natter/internal"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	enrollTimeout   = 30 * time.Second
+	renewRetryDelay = time.Minute
+)
+
+// setupEnrollment prepares a client that gets its certificate from the broker's CA (see
+// Config.EnrollToken): it loads the certificate from CertificateFile, if the client enrolled
+// before, and makes the TLS server config use the current certificate, since it is renewed
+// while the client is running.
+func (c *client) setupEnrollment() error {
+	if _, err := os.Stat(c.config.CertificateFile); err == nil {
+		certificate, err := tls.LoadX509KeyPair(c.config.CertificateFile, c.config.PrivateKeyFile)
+		if err != nil {
+			return errors.New("cannot load certificate: " + err.Error())
+		}
+
+		if err := c.setCertificate(&certificate); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.New("cannot load certificate: " + err.Error())
+	}
+
+	tlsServerConfig := c.config.TLSServerConfig.Clone()
+	tlsServerConfig.GetCertificate = c.getCertificate
+	c.config.TLSServerConfig = tlsServerConfig
+
+	return nil
+}
+
+// getCertificate returns the certificate from the broker's CA, or nil if the client has not
+// enrolled yet, in which case the certificates of the TLS server config are used
+func (c *client) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.certificateMutex.RLock()
+	defer c.certificateMutex.RUnlock()
+
+	return c.certificate, nil
+}
+
+// setCertificate replaces the client's certificate, and remembers the CA that issued it (the
+// last certificate of the chain), see caPool
+func (c *client) setCertificate(certificate *tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return errors.New("invalid certificate: " + err.Error())
+	} else if leaf.Subject.CommonName != c.config.ClientId {
+		return errors.New("certificate is issued to " + leaf.Subject.CommonName + ", not " + c.config.ClientId)
+	}
+	certificate.Leaf = leaf
+
+	var pool *x509.CertPool
+	if len(certificate.Certificate) > 1 {
+		ca, err := x509.ParseCertificate(certificate.Certificate[len(certificate.Certificate)-1])
+		if err != nil {
+			return errors.New("invalid CA certificate: " + err.Error())
+		}
+
+		pool = x509.NewCertPool()
+		pool.AddCert(ca)
+	}
+
+	c.certificateMutex.Lock()
+	c.certificate = certificate
+	if pool != nil {
+		c.certificateCAPool = pool
+	}
+	c.certificateMutex.Unlock()
+
+	return nil
+}
+
+// caPool returns the CAs with which brokers and peers are verified: the config's CA pool, if
+// it is set, or the CA that issued the client's certificate, if the client enrolled. Otherwise,
+// it returns nil, i.e. brokers and peers are not verified.
+func (c *client) caPool() *x509.CertPool {
+	if c.config.CAPool != nil {
+		return c.config.CAPool
+	}
+
+	c.certificateMutex.RLock()
+	defer c.certificateMutex.RUnlock()
+
+	return c.certificateCAPool
+}
+
+// enroll gets a certificate from the broker's CA, if the client does not have one yet, or if it
+// expired (e.g. because the client was offline for too long to renew it). It is called before
+// connecting to the brokers, since they may only let clients with a valid certificate check in.
+// The enrollment token is never sent: the request carries a MAC that proves that the client knows
+// it, and the broker proves the same in its response, so that the client can trust the CA.
+func (c *client) enroll() error {
+	if c.config.EnrollToken == "" {
+		return nil
+	}
+
+	c.enrollMutex.Lock()
+	defer c.enrollMutex.Unlock()
+
+	var expired string
+	if certificate, _ := c.getCertificate(nil); certificate != nil {
+		if time.Now().Before(certificate.Leaf.NotAfter) {
+			return nil
+		}
+
+		expired = certificate.Leaf.NotAfter.String()
+		c.config.Logger.Info("Certificate expired, enrolling again", "expired", expired)
+	}
+
+	key, csr, err := newCertificateRequest(c.config.ClientId)
+	if err != nil {
+		return err
+	}
+
+	request := &internal.EnrollRequest{
+		Id:       c.generateConnId(),
+		ClientId: c.config.ClientId,
+		Csr:      csr,
+		Mac:      enrollMac(c.config.EnrollToken, []byte(c.config.ClientId), csr),
+	}
+
+	for _, addr := range brokerAddrs(c.config) {
+		c.config.Logger.Info("Enrolling with broker", "broker", addr)
+
+		var response *internal.EnrollResponse
+		if response, err = c.conn.enroll(addr, request); err != nil {
+			c.config.Logger.Error("Cannot enroll with broker", "broker", addr, "error", err)
+			continue
+		}
+
+		if !hmac.Equal(response.Mac, enrollMac(c.config.EnrollToken, response.Certificates...)) {
+			err = errors.New("broker does not know the enrollment token")
+			c.config.Logger.Error("Cannot enroll with broker", "broker", addr, "error", err)
+			continue
+		}
+
+		certificate, err := c.saveCertificate(key, response.Certificates)
+		if err != nil {
+			return err
+		}
+
+		c.config.Logger.Info("Enrolled with broker", "broker", addr, "expires", certificate.Leaf.NotAfter)
+		return nil
+	}
+
+	// Enrollment tokens can only be used once, so an expired certificate needs a new one
+	if expired != "" {
+		return errors.New("certificate expired at " + expired + ", cannot enroll again, a new EnrollToken may be needed: " + err.Error())
+	}
+
+	return errors.New("cannot enroll: " + err.Error())
+}
+
+// renewLoop renews the client's certificate after two thirds of its validity, via the broker the
+// client is connected to. Renewals do not need the enrollment token, since the client checked in
+// with its current certificate.
+func (c *client) renewLoop() {
+	for {
+		certificate, _ := c.getCertificate(nil)
+		if certificate == nil {
+			time.Sleep(renewRetryDelay) // Not enrolled yet, see enroll
+			continue
+		}
+
+		validity := certificate.Leaf.NotAfter.Sub(certificate.Leaf.NotBefore)
+		if wait := time.Until(certificate.Leaf.NotBefore.Add(validity * 2 / 3)); wait > 0 {
+			time.Sleep(wait)
+			continue
+		}
+
+		if err := c.renew(); err != nil {
+			c.config.Logger.Error("Cannot renew certificate", "expires", certificate.Leaf.NotAfter, "error", err)
+			time.Sleep(renewRetryDelay)
+		}
+	}
+}
+
+func (c *client) renew() error {
+	key, csr, err := newCertificateRequest(c.config.ClientId)
+	if err != nil {
+		return err
+	}
+
+	id := c.generateConnId()
+	responseChan := make(chan *internal.EnrollResponse, 1)
+
+	c.enrollRequestsMutex.Lock()
+	c.enrollRequests[id] = responseChan
+	c.enrollRequestsMutex.Unlock()
+
+	defer func() {
+		c.enrollRequestsMutex.Lock()
+		delete(c.enrollRequests, id)
+		c.enrollRequestsMutex.Unlock()
+	}()
+
+	request := &internal.EnrollRequest{
+		Id:       id,
+		ClientId: c.config.ClientId,
+		Csr:      csr,
+	}
+
+	if err := c.conn.Send(messageTypeEnrollRequest, request); err != nil {
+		return err
+	}
+
+	var response *internal.EnrollResponse
+
+	select {
+	case <-time.After(enrollTimeout):
+		return errors.New("timed out waiting for broker")
+	case response = <-responseChan:
+	}
+
+	if !response.Success {
+		return errors.New("broker rejected renewal: " + response.Error)
+	}
+
+	certificate, err := c.saveCertificate(key, response.Certificates)
+	if err != nil {
+		return err
+	}
+
+	c.config.Logger.Info("Certificate renewed", "expires", certificate.Leaf.NotAfter)
+	return nil
+}
+
+func (c *client) handleEnrollResponse(response *internal.EnrollResponse) {
+	c.enrollRequestsMutex.Lock()
+	defer c.enrollRequestsMutex.Unlock()
+
+	responseChan, ok := c.enrollRequests[response.Id]
+	if !ok {
+		c.config.Logger.Info("Enroll response with unknown ID received, ignoring", "request", response.Id)
+		return
+	}
+
+	// Each request gets a single response, late or duplicate ones must not block the broker connection
+	delete(c.enrollRequests, response.Id)
+	select {
+	case responseChan <- response:
+	default:
+	}
+}
+
+// saveCertificate writes the private key and the certificate chain signed by the broker to
+// PrivateKeyFile and CertificateFile, and makes it the client's certificate. It returns the
+// certificate, since it may be replaced again right away, see renewLoop.
+func (c *client) saveCertificate(key *ecdsa.PrivateKey, certificates [][]byte) (*tls.Certificate, error) {
+	if len(certificates) == 0 {
+		return nil, errors.New("broker did not return a certificate")
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate := &tls.Certificate{
+		Certificate: certificates,
+		PrivateKey:  key,
+	}
+
+	// The certificate is checked before the files are written
+	if err := c.setCertificate(certificate); err != nil {
+		return nil, err
+	}
+
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	certificatePem := make([]byte, 0)
+	for _, der := range certificates {
+		certificatePem = append(certificatePem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	if err := ioutil.WriteFile(c.config.PrivateKeyFile+".tmp", keyPem, 0600); err != nil {
+		return nil, errors.New("cannot write private key file: " + err.Error())
+	} else if err := ioutil.WriteFile(c.config.CertificateFile+".tmp", certificatePem, 0644); err != nil {
+		return nil, errors.New("cannot write certificate file: " + err.Error())
+	} else if err := os.Rename(c.config.PrivateKeyFile+".tmp", c.config.PrivateKeyFile); err != nil {
+		return nil, errors.New("cannot write private key file: " + err.Error())
+	} else if err := os.Rename(c.config.CertificateFile+".tmp", c.config.CertificateFile); err != nil {
+		return nil, errors.New("cannot write certificate file: " + err.Error())
+	}
+
+	return certificate, nil
+}
+
+// newCertificateRequest generates a new private key, and a DER encoded certificate request
+// for the given client ID
+func newCertificateRequest(clientId string) (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.New("cannot generate private key: " + err.Error())
+	}
+
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: clientId},
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, nil, errors.New("cannot create certificate request: " + err.Error())
+	}
+
+	return key, csr, nil
+}
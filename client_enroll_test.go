@@ -0,0 +1,187 @@
+package natter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"heckel.io/natter/internal"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnrollAndSaveCertificate(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	b, err := NewBroker(&Config{BrokerAddr: ":2586", CAKeyPair: ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := b.(*broker)
+
+	enrollment, err := broker.createEnrollment("alice", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, csr, err := newCertificateRequest("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := &internal.EnrollRequest{ClientId: "alice", Csr: csr, Mac: enrollMac(enrollment.token, []byte("alice"), csr)}
+	if _, err := broker.authorizeEnrollment(&brokerClient{}, request); err != nil {
+		t.Fatalf("expected enrollment to be authorized, got %s", err)
+	}
+	if _, err := broker.authorizeEnrollment(&brokerClient{}, request); err == nil {
+		t.Fatalf("expected enrollment token to be usable only once")
+	}
+
+	certificateDer, err := broker.signCertificate("alice", csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "natter-enroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &client{config: &Config{
+		ClientId:        "alice",
+		CertificateFile: filepath.Join(dir, "alice.pem"),
+		PrivateKeyFile:  filepath.Join(dir, "alice.key"),
+	}}
+
+	if c.caPool() != nil {
+		t.Fatalf("expected no CA pool before enrolling")
+	}
+
+	certificate, err := c.saveCertificate(key, [][]byte{certificateDer, ca.Certificate[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyPeerCertificate(c.caPool(), "alice", []*x509.Certificate{certificate.Leaf}); err != nil {
+		t.Errorf("expected certificate to be verified with the CA it was issued by, got %s", err)
+	}
+	if err := verifyPeerCertificate(c.caPool(), "bob", []*x509.Certificate{certificate.Leaf}); err == nil {
+		t.Errorf("expected certificate of alice to be rejected for bob")
+	}
+	if _, err := tls.LoadX509KeyPair(c.config.CertificateFile, c.config.PrivateKeyFile); err != nil {
+		t.Errorf("expected saved certificate to be loadable, got %s", err)
+	}
+
+	// Clients with a valid registered certificate can only get a new token if forced
+	certificatePem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDer})
+	if _, err := broker.store.register("alice", string(certificatePem), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.createEnrollment("alice", 0, false); err == nil {
+		t.Errorf("expected enrollment of client with valid certificate to be refused")
+	}
+	if _, err := broker.createEnrollment("alice", 0, true); err != nil {
+		t.Errorf("expected forced enrollment to succeed, got %s", err)
+	}
+}
+
+func TestSetCertificateWrongClient(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	certificate := newTestCertificate(t, ca, "bob")
+
+	c := &client{config: &Config{ClientId: "alice"}}
+	if err := c.setCertificate(certificate); err == nil {
+		t.Errorf("expected certificate of bob to be rejected for alice")
+	}
+	if certificate, _ := c.getCertificate(nil); certificate != nil {
+		t.Errorf("expected no certificate to be set")
+	}
+}
+
+func TestHandleEnrollResponseDoesNotBlock(t *testing.T) {
+	c := &client{
+		config:         &Config{Logger: newDefaultLogger()},
+		enrollRequests: make(map[string]chan *internal.EnrollResponse),
+	}
+	responseChan := make(chan *internal.EnrollResponse, 1)
+	c.enrollRequests["abc"] = responseChan
+
+	done := make(chan struct{})
+	go func() {
+		c.handleEnrollResponse(&internal.EnrollResponse{Id: "abc", Success: true})
+		c.handleEnrollResponse(&internal.EnrollResponse{Id: "abc", Success: true}) // Duplicate
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("duplicate enroll response blocked")
+	}
+
+	if response := <-responseChan; !response.Success {
+		t.Errorf("expected first response to be delivered")
+	}
+}
+
+// newTestCA creates a self-signed CA certificate and key
+func newTestCA(t *testing.T, name string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// newTestCertificate creates a certificate for the given client ID, signed by the CA, followed
+// by the CA certificate
+func newTestCertificate(t *testing.T, ca *tls.Certificate, clientId string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: clientId},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der, ca.Certificate[0]}, PrivateKey: key}
+}
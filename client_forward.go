@@ -1,12 +1,12 @@
 package natter
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/lucas-clemente/quic-go"
 	"heckel.io/natter/internal"
 	"io"
-	"log"
 	"math/rand"
 	"net"
 	"os"
@@ -14,59 +14,118 @@ import (
 )
 
 func (c *client) Forward(localAddr string, target string, targetForwardAddr string, targetCommand []string) (Forward, error) {
-	log.Printf("Adding forward from local address %s to %s %s\n", localAddr, target, targetForwardAddr)
+	return c.ForwardWithOptions(localAddr, target, targetForwardAddr, targetCommand, nil)
+}
+
+func (c *client) ForwardService(localAddr string, target string, service string) (Forward, error) {
+	if service == "" {
+		return nil, errors.New("service cannot be empty")
+	}
+
+	return c.ForwardWithOptions(localAddr, target, "", nil, &ForwardOptions{Service: service})
+}
+
+func (c *client) ForwardWithOptions(localAddr string, target string, targetForwardAddr string, targetCommand []string, options *ForwardOptions) (Forward, error) {
+	if options == nil {
+		options = &ForwardOptions{}
+	}
+
+	c.config.Logger.Info("Adding forward", "local", localAddr, "target", target, "addr", targetForwardAddr, "command", targetCommand, "service", options.Service)
 
 	if target == c.config.ClientId {
 		return nil, errors.New("cannot forward to yourself")
 	}
 
-	err := c.conn.connect()
-	if err != nil {
-		return nil, errors.New("cannot connect to broker: " + err.Error())
+	if options.Compression != "" && !supportedCompression(options.Compression) {
+		return nil, errors.New("unsupported compression " + options.Compression)
 	}
 
-	// Create forward entry
 	forward := &forward{
-		id:                c.generateConnId(),
-		source:            c.config.ClientId,
-		sourceAddr:        localAddr,
-		target:            target,
-		targetForwardAddr: targetForwardAddr,
-		targetCommand:     targetCommand,
+		id:            c.generateConnId(),
+		source:        c.config.ClientId,
+		sourceAddr:    localAddr,
+		target:        target,
+		targetService: options.Service,
+		waitForPeer:   options.WaitForPeer,
+		limiter:       newRateLimiter(options.RateLimit),
+		compression:   options.Compression,
+		client:        c,
+		updated:       make(chan struct{}),
 	}
 
-	c.forwardsMutex.Lock()
-	defer c.forwardsMutex.Unlock()
+	if options.Service == "" {
+		forward.targetForwardAddr = targetForwardAddr
+		forward.targetCommand = targetCommand
+	}
 
-	c.forwards[forward.id] = forward
+	if err := c.startForward(forward); err != nil {
+		return nil, err
+	}
+
+	// Watch the target, so the forward can be re-requested when it comes (back) online
+	if forward.durable() {
+		if err := c.WatchPeer(target); err != nil {
+			return nil, err
+		}
+	}
+
+	return forward, nil
+}
+
+func (c *client) Forwards() []Forward {
+	c.forwardsMutex.RLock()
+	defer c.forwardsMutex.RUnlock()
+
+	// Forwards without a client are dialed peer connections, see dialPeerSession
+	forwards := make([]Forward, 0)
+	for _, forward := range c.forwards {
+		if forward.source == c.config.ClientId && forward.client != nil {
+			forwards = append(forwards, forward)
+		}
+	}
+
+	return forwards
+}
+
+func (c *client) startForward(forward *forward) error {
+	err := c.conn.connect()
+	if err != nil {
+		return errors.New("cannot connect to broker: " + err.Error())
+	}
 
 	// Listen to local TCP address
-	if localAddr == "" {
+	if forward.sourceAddr == "" {
 		c.forwardFromStdin(forward)
 	} else {
 		if err := c.forwardFromTcp(forward); err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	// Sending forward request
-	log.Printf("Requesting connection to target %s on TCP address %s\n", target, targetForwardAddr)
-	err = c.conn.Send(messageTypeForwardRequest, &internal.ForwardRequest{
+	c.forwardsMutex.Lock()
+	c.forwards[forward.id] = forward
+	c.forwardsMutex.Unlock()
+
+	return c.sendForwardRequest(forward)
+}
+
+func (c *client) sendForwardRequest(forward *forward) error {
+	c.config.Logger.Info("Requesting forward from broker", "forward", forward.id, "target", forward.target, "addr", forward.targetForwardAddr, "service", forward.targetService)
+
+	return c.conn.Send(messageTypeForwardRequest, &internal.ForwardRequest{
 		Id:                forward.id,
 		Source:            forward.source,
 		Target:            forward.target,
 		TargetForwardAddr: forward.targetForwardAddr,
 		TargetCommand:     forward.targetCommand,
+		TargetService:     forward.targetService,
+		Invite:            forward.invite,
+		Compression:       forward.compression,
 	})
-	if err != nil {
-		return nil, err
-	}
-
-	return forward, nil
 }
 
 func (c *client) forwardFromStdin(forward *forward) {
-	log.Println("Reading from STDIN")
+	c.config.Logger.Info("Reading from STDIN", "forward", forward.id)
 
 	rw := struct {
 		io.Reader
@@ -80,13 +139,14 @@ func (c *client) forwardFromStdin(forward *forward) {
 }
 
 func (c *client) forwardFromTcp(forward *forward) error {
-	log.Printf("Listening on local TCP address %s\n", forward.sourceAddr)
+	c.config.Logger.Info("Listening on local TCP address", "forward", forward.id, "local", forward.sourceAddr)
 
 	localTcpListener, err := net.Listen("tcp", forward.sourceAddr)
 	if err != nil {
 		return err
 	}
 
+	forward.listener = localTcpListener
 	go c.listenTcp(forward, localTcpListener)
 	return nil
 }
@@ -102,8 +162,11 @@ func (c *client) generateConnId() string {
 func (c *client) listenTcp(forward *forward, listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
-		if err != nil {
-			log.Println("Accepting TCP connection failed: " + err.Error())
+		if err != nil && !c.hasForward(forward) {
+			c.config.Logger.Debug("Stopped listening on local TCP address", "forward", forward.id, "local", forward.sourceAddr)
+			return
+		} else if err != nil {
+			c.config.Logger.Error("Accepting TCP connection failed", "forward", forward.id, "error", err)
 			continue
 		}
 
@@ -112,72 +175,170 @@ func (c *client) listenTcp(forward *forward, listener net.Listener) {
 }
 
 func (c *client) openPeerStream(forward *forward, localStream io.ReadWriter) {
-	log.Print("Opening stream to peer")
+	c.config.Logger.Debug("Opening stream to peer", "forward", forward.id)
 
 	var peerStream quic.Stream
 
-	// TODO fix this ugly wait loop
-	for forward.PeerUdpAddr() == nil {
-		log.Println("Client connected on TCP socket, opening stream ...")
-		time.Sleep(1 * time.Second)
-	}
-
-	for {
-		peerUdpAddr := forward.PeerUdpAddr()
-		tlsClientConfig := *c.config.TLSClientConfig // copy, because quic-go alters it!
-		sniHost := fmt.Sprintf("%s:%d", forward.id, 2586) // Connection ID in the SNI host, port doesn't matter!
-		session, err := quic.Dial(c.conn.UdpConn(), peerUdpAddr, sniHost, &tlsClientConfig, c.config.QuicConfig)
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), forwardWaitTimeout)
+		id, peerUdpAddr, err := forward.wait(ctx)
+		cancel()
 
 		if err != nil {
-			log.Println("Cannot connect to remote peer via " + peerUdpAddr.String() + ". Closing.")
-			return // TODO close forward
+			c.config.Logger.Error("Forward not available, closing local connection", "forward", id, "target", forward.target, "error", err)
+			closeLocalStream(localStream)
+			return
 		}
 
-		peerStream, err = session.OpenStreamSync()
+		tlsClientConfig := c.config.TLSClientConfig.Clone() // copy, because quic-go alters it!
+		sniHost := fmt.Sprintf("%s:%d", id, 2586)           // Connection ID in the SNI host, port doesn't matter!
+		handshakeStart := time.Now()
+		session, err := quic.Dial(c.conn.UdpConn(), peerUdpAddr, sniHost, tlsClientConfig, c.config.QuicConfig)
 
-		if err != nil {
-			log.Println("Not connected yet.")
-			time.Sleep(1 * time.Second)
-			continue
+		if err == nil {
+			if err = verifyPeerCertificate(c.caPool(), forward.target, session.ConnectionState().PeerCertificates); err != nil {
+				session.Close()
+			}
+		}
+
+		if err == nil {
+			c.metrics.handshakeDuration.observe(time.Since(handshakeStart).Seconds())
+			c.events.publish(Event{Type: EventPeerConnected, Client: forward.target, Forward: id, Addr: peerUdpAddr.String()})
+
+			peerStream, err = session.OpenStreamSync()
+			if err == nil && forward.targetService != "" {
+				_, err = peerStream.Write([]byte{peerStreamHello})
+			}
+			if err == nil && forward.inviteSecret != "" {
+				err = c.authenticateInvite(peerStream, forward.inviteSecret, id, true)
+			}
+			if err != nil {
+				session.Close()
+			}
 		}
 
-		break
+		if err == nil {
+			break
+		} else if attempt >= forwardMaxAttempts {
+			c.config.Logger.Error("Cannot connect to peer, closing local connection", "forward", id, "peer", peerUdpAddr, "error", err)
+			closeLocalStream(localStream)
+			return
+		}
+
+		// The peer may have restarted, or its address may have changed, so ask the broker again
+		c.config.Logger.Info("Cannot connect to peer, re-requesting forward", "forward", id, "peer", peerUdpAddr, "error", err)
+		c.rerequestForward(forward, id)
 	}
 
-	log.Println("Connected. Starting to forward.")
+	c.config.Logger.Info("Connected to peer, starting to forward", "forward", forward.id, "peer", forward.PeerUdpAddr())
+	c.forwardStreams(forward, peerStream, localStream)
+}
+
+// rerequestForward sends a new forward request to the broker under a new ID, e.g. because
+// the peer went away. It does nothing if the forward was re-requested by someone else already,
+// i.e. if its ID is not the given ID anymore, or if the forward was closed.
+func (c *client) rerequestForward(forward *forward, id string) {
+	c.forwardsMutex.Lock()
 
-	go func() { io.Copy(peerStream, localStream) }()
-	go func() { io.Copy(localStream, peerStream) }()
+	forward.Lock()
+	if forward.id != id || forward.state == forwardStateClosed {
+		forward.Unlock()
+		c.forwardsMutex.Unlock()
+		return
+	}
+	forward.id = c.generateConnId()
+	forward.Unlock()
+
+	delete(c.forwards, id)
+	c.forwards[forward.id] = forward
+	c.forwardsMutex.Unlock()
+
+	forward.setState(forwardStateRequested, nil)
+
+	if err := c.sendForwardRequest(forward); err != nil {
+		c.config.Logger.Error("Cannot send forward request", "forward", forward.id, "error", err)
+	}
 }
 
-func (c *client) handleForwardResponse(response *internal.ForwardResponse) {
+// closeForward removes the forward, stops listening on its local TCP address, and wakes up all
+// connections waiting for it. Streams that are already forwarding are not affected. If it was the
+// last durable forward to the target, presence updates for the target are not needed anymore.
+func (c *client) closeForward(forward *forward) error {
 	c.forwardsMutex.Lock()
-	defer c.forwardsMutex.Unlock()
+	forward.RLock()
+	id := forward.id
+	forward.RUnlock()
+
+	if _, ok := c.forwards[id]; !ok {
+		c.forwardsMutex.Unlock()
+		return errors.New("forward is already closed")
+	}
 
+	delete(c.forwards, id)
+	c.forwardsMutex.Unlock()
+
+	c.config.Logger.Info("Closing forward", "forward", id, "local", forward.sourceAddr, "target", forward.target)
+	forward.setState(forwardStateClosed, nil)
+
+	if forward.listener != nil {
+		forward.listener.Close()
+	}
+
+	if forward.durable() && len(c.peerForwards(forward.target)) == 0 {
+		return c.UnwatchPeer(forward.target)
+	}
+
+	return nil
+}
+
+func (c *client) handleForwardResponse(response *internal.ForwardResponse) {
+	c.forwardsMutex.RLock()
 	forward, ok := c.forwards[response.Id]
+	c.forwardsMutex.RUnlock()
 
 	if !ok {
-		log.Println("Forward response with invalid ID received. Ignoring.")
+		c.config.Logger.Info("Forward response with unknown ID received, ignoring", "forward", response.Id)
 		return
 	}
 
 	if !response.Success {
-		log.Println("Failed forward response")
+		if forward.waitForPeer {
+			c.config.Logger.Info("Forward was rejected, waiting for peer to come online", "forward", response.Id, "target", forward.target)
+		} else {
+			c.config.Logger.Error("Forward was rejected", "forward", response.Id, "target", forward.target)
+		}
+
+		forward.setState(forwardStateRejected, nil)
+		c.events.publish(Event{Type: EventForwardRejected, Client: forward.target, Forward: response.Id})
 		return
 	}
 
-	var err error
-	log.Print("Peer address: ", response.TargetAddr)
-
-	forward.Lock()
-	forward.peerUdpAddr, err = net.ResolveUDPAddr("udp4", response.TargetAddr)
-	forward.Unlock()
+	c.config.Logger.Info("Forward accepted by peer", "forward", response.Id, "peer", response.TargetAddr)
 
+	peerUdpAddr, err := net.ResolveUDPAddr("udp4", response.TargetAddr)
 	if err != nil {
-		// TODO close forward
-		log.Println("Failed to resolve peer UDP address: " + err.Error())
+		c.config.Logger.Error("Failed to resolve peer UDP address", "forward", response.Id, "peer", response.TargetAddr, "error", err)
+		forward.setState(forwardStateRejected, nil)
+		c.events.publish(Event{Type: EventForwardRejected, Client: forward.target, Forward: response.Id, Addr: response.TargetAddr, Err: err})
 		return
 	}
 
-	go c.punch(forward.peerUdpAddr)
+	forward.Lock()
+	forward.accepted = response
+	if forward.invite != "" {
+		forward.target = response.Target // Only the broker knows whom the invite is for
+	}
+	forward.Unlock()
+
+	forward.setState(forwardStateAccepted, peerUdpAddr)
+	c.events.publish(Event{Type: EventForwardAccepted, Client: forward.target, Forward: response.Id, Addr: response.TargetAddr})
+
+	go c.punch(forward, peerUdpAddr)
+}
+
+// closeLocalStream closes the local side of a forward, if it can be closed
+func closeLocalStream(localStream io.ReadWriter) {
+	if closer, ok := localStream.(io.Closer); ok {
+		closer.Close()
+	}
 }
@@ -0,0 +1,227 @@
+package natter
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"heckel.io/natter/internal"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	inviteSecretLen  = 12
+	inviteMacTimeout = 10 * time.Second
+)
+
+// inviteEncoding is used for invite tokens and secrets, so that codes are easy to read out
+var inviteEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+// invite is an invite created by this client, see Share
+type invite struct {
+	token             string
+	secret            string
+	targetForwardAddr string
+	expires           time.Time
+}
+
+func (c *client) Share(ctx context.Context, targetForwardAddr string, ttl time.Duration) (*Invite, error) {
+	if targetForwardAddr == "" {
+		return nil, errors.New("address cannot be empty")
+	}
+
+	if err := c.Listen(); err != nil {
+		return nil, err
+	}
+
+	secret, err := randomCode(inviteSecretLen)
+	if err != nil {
+		return nil, err
+	}
+
+	id := c.generateConnId()
+	responseChan := make(chan *internal.InviteResponse, 1)
+
+	c.inviteRequestsMutex.Lock()
+	c.inviteRequests[id] = responseChan
+	c.inviteRequestsMutex.Unlock()
+
+	defer func() {
+		c.inviteRequestsMutex.Lock()
+		delete(c.inviteRequests, id)
+		c.inviteRequestsMutex.Unlock()
+	}()
+
+	request := &internal.InviteRequest{
+		Id:                id,
+		TargetForwardAddr: targetForwardAddr,
+		Ttl:               int64(ttl.Seconds()),
+	}
+
+	if err := c.conn.Send(messageTypeInviteRequest, request); err != nil {
+		return nil, err
+	}
+
+	var response *internal.InviteResponse
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case response = <-responseChan:
+	}
+
+	if !response.Success {
+		return nil, errors.New("broker did not create invite")
+	}
+
+	// The secret is only known to this client and the peer that receives the code
+	shared := &invite{
+		token:             response.Token,
+		secret:            secret,
+		targetForwardAddr: targetForwardAddr,
+		expires:           time.Unix(response.Expires, 0),
+	}
+
+	c.invitesMutex.Lock()
+	c.invites[shared.token] = shared
+	c.invitesMutex.Unlock()
+
+	c.config.Logger.Info("Sharing address via invite", "addr", targetForwardAddr, "expires", shared.expires)
+
+	return &Invite{
+		Code:    shared.token + "-" + shared.secret,
+		Expires: shared.expires,
+	}, nil
+}
+
+func (c *client) Join(ctx context.Context, localAddr string, code string) (Forward, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(code)), "-")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.New("invalid invite code")
+	}
+
+	if localAddr == "" {
+		return nil, errors.New("local address cannot be empty")
+	}
+
+	c.config.Logger.Info("Joining via invite", "local", localAddr)
+
+	forward := &forward{
+		id:           c.generateConnId(),
+		source:       c.config.ClientId,
+		sourceAddr:   localAddr,
+		invite:       parts[0],
+		inviteSecret: parts[1],
+		limiter:      newRateLimiter(nil),
+		client:       c,
+		updated:      make(chan struct{}),
+	}
+
+	if err := c.startForward(forward); err != nil {
+		return nil, err
+	}
+
+	// Invites are single-use, so there's no point in waiting for a retry
+	if _, _, err := forward.wait(ctx); err != nil {
+		forward.Close()
+		if err == ctx.Err() {
+			return nil, err
+		}
+		return nil, errors.New("invite is invalid, expired or was already used")
+	}
+
+	return forward, nil
+}
+
+func (c *client) handleInviteResponse(response *internal.InviteResponse) {
+	c.inviteRequestsMutex.Lock()
+	defer c.inviteRequestsMutex.Unlock()
+
+	responseChan, ok := c.inviteRequests[response.Id]
+	if !ok {
+		c.config.Logger.Info("Invite response with unknown ID received, ignoring", "request", response.Id)
+		return
+	}
+
+	// Each request gets a single response, late or duplicate ones must not block the broker connection
+	delete(c.inviteRequests, response.Id)
+	select {
+	case responseChan <- response:
+	default:
+	}
+}
+
+// redeemInvite returns and removes the invite with the given token, if it was created by this
+// client and has not expired. The broker only redeems an invite once, but it is not trusted.
+func (c *client) redeemInvite(token string) (*invite, bool) {
+	c.invitesMutex.Lock()
+	defer c.invitesMutex.Unlock()
+
+	shared, ok := c.invites[token]
+	delete(c.invites, token)
+
+	if !ok || time.Now().After(shared.expires) {
+		return nil, false
+	}
+
+	return shared, true
+}
+
+// authenticateInvite proves to the peer that this side knows the invite secret, and verifies
+// that the peer knows it, too. It is run on every stream of a forward that was created via an
+// invite, before anything else is sent. The dialing side (source) sends its MAC first.
+func (c *client) authenticateInvite(stream io.ReadWriter, secret string, forwardId string, source bool) error {
+	local, remote := "target", "source"
+	if source {
+		local, remote = remote, local
+	}
+
+	if source {
+		if _, err := stream.Write(inviteMac(secret, local, forwardId)); err != nil {
+			return err
+		}
+	}
+
+	if deadliner, ok := stream.(interface{ SetReadDeadline(time.Time) error }); ok {
+		deadliner.SetReadDeadline(time.Now().Add(inviteMacTimeout))
+		defer deadliner.SetReadDeadline(time.Time{})
+	}
+
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(stream, mac); err != nil {
+		return err
+	}
+
+	if !hmac.Equal(mac, inviteMac(secret, remote, forwardId)) {
+		return errors.New("peer does not know the invite secret")
+	}
+
+	if !source {
+		if _, err := stream.Write(inviteMac(secret, local, forwardId)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inviteMac returns the MAC with which the given side of a forward proves that it knows the invite secret
+func inviteMac(secret string, side string, forwardId string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("natter invite " + side + " " + forwardId))
+	return mac.Sum(nil)
+}
+
+// randomCode returns a random string of the given length for invite tokens and secrets
+func randomCode(length int) (string, error) {
+	b := make([]byte, length) // More than enough, 5 bits per character
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return inviteEncoding.EncodeToString(b)[:length], nil
+}
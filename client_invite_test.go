@@ -0,0 +1,89 @@
+package natter
+
+import (
+	"heckel.io/natter/internal"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRedeemInvite(t *testing.T) {
+	c := &client{invites: make(map[string]*invite)}
+	c.invites["valid"] = &invite{token: "valid", secret: "s3cr3t", targetForwardAddr: ":22", expires: time.Now().Add(time.Minute)}
+	c.invites["expired"] = &invite{token: "expired", secret: "s3cr3t", targetForwardAddr: ":22", expires: time.Now().Add(-time.Second)}
+
+	if shared, ok := c.redeemInvite("valid"); !ok || shared.targetForwardAddr != ":22" {
+		t.Errorf("expected valid invite to be redeemed")
+	}
+	if _, ok := c.redeemInvite("valid"); ok {
+		t.Errorf("expected invite to be redeemed only once")
+	}
+	if _, ok := c.redeemInvite("expired"); ok {
+		t.Errorf("expected expired invite to be rejected")
+	}
+	if _, ok := c.redeemInvite("unknown"); ok {
+		t.Errorf("expected unknown invite to be rejected")
+	}
+	if len(c.invites) != 0 {
+		t.Errorf("expected all redeemed or expired invites to be removed, %d left", len(c.invites))
+	}
+}
+
+func TestAuthenticateInvite(t *testing.T) {
+	tests := []struct {
+		sourceSecret string
+		targetSecret string
+		ok           bool
+	}{
+		{"s3cr3t", "s3cr3t", true},
+		{"s3cr3t", "other", false},
+	}
+
+	c := &client{}
+
+	for _, test := range tests {
+		source, target := net.Pipe()
+		targetErr := make(chan error, 1)
+
+		go func() {
+			targetErr <- c.authenticateInvite(target, test.targetSecret, "forward1", false)
+			target.Close()
+		}()
+
+		sourceErr := c.authenticateInvite(source, test.sourceSecret, "forward1", true)
+		source.Close()
+
+		if err := <-targetErr; (err == nil) != test.ok {
+			t.Errorf("%s/%s: target expected ok=%t, got error %v", test.sourceSecret, test.targetSecret, test.ok, err)
+		}
+		if (sourceErr == nil) != test.ok {
+			t.Errorf("%s/%s: source expected ok=%t, got error %v", test.sourceSecret, test.targetSecret, test.ok, sourceErr)
+		}
+	}
+}
+
+func TestHandleInviteResponseDoesNotBlock(t *testing.T) {
+	c := &client{
+		config:         &Config{Logger: newDefaultLogger()},
+		inviteRequests: make(map[string]chan *internal.InviteResponse),
+	}
+	responseChan := make(chan *internal.InviteResponse, 1)
+	c.inviteRequests["abc"] = responseChan
+
+	done := make(chan struct{})
+	go func() {
+		c.handleInviteResponse(&internal.InviteResponse{Id: "abc", Success: true})
+		c.handleInviteResponse(&internal.InviteResponse{Id: "abc", Success: true}) // Duplicate
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("duplicate invite response blocked")
+	}
+
+	if response := <-responseChan; !response.Success {
+		t.Errorf("expected first response to be delivered")
+	}
+}
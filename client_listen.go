@@ -5,14 +5,19 @@ import (
 	"github.com/lucas-clemente/quic-go"
 	"heckel.io/natter/internal"
 	"io"
-	"log"
 	"net"
 	"os/exec"
-	"strings"
 	"time"
 )
 
 func (c *client) Listen() error {
+	c.listenMutex.Lock()
+	defer c.listenMutex.Unlock()
+
+	if c.listener != nil {
+		return nil // Already listening
+	}
+
 	err := c.conn.connect()
 	if err != nil {
 		return errors.New("cannot connect to broker: " + err.Error())
@@ -23,6 +28,7 @@ func (c *client) Listen() error {
 		return errors.New("cannot listen on UDP socket for incoming connections:" + err.Error())
 	}
 
+	c.listener = listener
 	go c.handleIncomingPeers(listener)
 
 	return nil
@@ -31,25 +37,86 @@ func (c *client) Listen() error {
 func (c *client) handleForwardRequest(request *internal.ForwardRequest) {
 	// TODO ignore if not in "daemon mode"
 
-	log.Printf("Accepted forward request from %s to TCP addr %s", request.Source, request.TargetForwardAddr)
+	c.config.Logger.Info("Accepted forward request", "forward", request.Id, "source", request.Source, "addr", request.TargetForwardAddr, "command", request.TargetCommand, "service", request.TargetService)
+	c.events.publish(Event{Type: EventForwardRequested, Client: request.Source, Forward: request.Id, Addr: request.SourceAddr})
+
+	// Forwards via an invite (see Share) may only go to the shared address, but they are
+	// allowed regardless of AllowPeers, since the peer is authenticated via the invite secret
+	var inviteSecret string
+
+	if request.Invite != "" {
+		shared, ok := c.redeemInvite(request.Invite)
+		if !ok {
+			c.config.Logger.Info("Invite is unknown, used or expired, rejecting forward", "forward", request.Id, "source", request.Source)
+			if err := c.conn.Send(messageTypeForwardResponse, &internal.ForwardResponse{Id: request.Id, Success: false}); err != nil {
+				c.config.Logger.Error("Cannot send forward response", "forward", request.Id, "error", err)
+			}
+			return
+		}
+
+		c.config.Logger.Info("Peer joined via invite", "forward", request.Id, "source", request.Source, "addr", shared.targetForwardAddr)
+		request.TargetForwardAddr = shared.targetForwardAddr
+		request.TargetCommand = nil
+		request.TargetService = ""
+		inviteSecret = shared.secret
+	} else if !c.allows(request.Source) {
+		c.config.Logger.Info("Source is not an allowed peer, rejecting forward", "forward", request.Id, "source", request.Source)
+		if err := c.conn.Send(messageTypeForwardResponse, &internal.ForwardResponse{Id: request.Id, Success: false}); err != nil {
+			c.config.Logger.Error("Cannot send forward response", "forward", request.Id, "error", err)
+		}
+		return
+	}
+
+	// Services are either forwarded to their configured TCP address, or to a listener (see ListenPeer)
+	targetForwardAddr := request.TargetForwardAddr
+
+	if request.TargetService != "" {
+		serviceAddr, isConfigService := c.service(request.TargetService)
+		_, isPeerService := c.peerListener(request.TargetService)
+		_, isBuiltin := c.builtinService(request.TargetService)
+
+		if isBuiltin {
+			targetForwardAddr = ""
+		} else if isConfigService {
+			targetForwardAddr = serviceAddr
+		} else if isPeerService {
+			targetForwardAddr = ""
+		} else {
+			c.config.Logger.Info("Unknown service requested, rejecting forward", "forward", request.Id, "service", request.TargetService)
+			if err := c.conn.Send(messageTypeForwardResponse, &internal.ForwardResponse{Id: request.Id, Success: false}); err != nil {
+				c.config.Logger.Error("Cannot send forward response", "forward", request.Id, "error", err)
+			}
+			return
+		}
+	}
+
+	// Only streams that are forwarded to a TCP address or a command can be compressed
+	var compression string
+	if supportedCompression(request.Compression) && (targetForwardAddr != "" || len(request.TargetCommand) > 0) {
+		compression = request.Compression
+	}
 
 	peerUdpAddr, err := net.ResolveUDPAddr("udp4", request.SourceAddr)
 	if err != nil {
-		log.Println("Cannot resolve peer udp addr: " + err.Error())
-		if err := c.conn.Send(messageTypeForwardResponse, &internal.ForwardResponse{Success: false}); err != nil {
-			log.Println("Cannot send forward response: " + err.Error())
+		c.config.Logger.Error("Cannot resolve peer UDP address", "forward", request.Id, "peer", request.SourceAddr, "error", err)
+		if err := c.conn.Send(messageTypeForwardResponse, &internal.ForwardResponse{Id: request.Id, Success: false}); err != nil {
+			c.config.Logger.Error("Cannot send forward response", "forward", request.Id, "error", err)
 		}
 		return // TODO close forward
 	}
 
 	forward := &forward{
-		id: request.Id,
-		source: request.Source,
-		sourceAddr: request.SourceAddr,
-		target: request.Target,
-		targetForwardAddr: request.TargetForwardAddr,
-		targetCommand: request.TargetCommand,
-		peerUdpAddr: peerUdpAddr,
+		id:                request.Id,
+		source:            request.Source,
+		sourceAddr:        request.SourceAddr,
+		target:            request.Target,
+		targetForwardAddr: targetForwardAddr,
+		targetCommand:     request.TargetCommand,
+		targetService:     request.TargetService,
+		inviteSecret:      inviteSecret,
+		compression:       compression,
+		peerUdpAddr:       peerUdpAddr,
+		singleSession:     request.SingleSession,
 	}
 
 	c.forwardsMutex.Lock()
@@ -58,27 +125,28 @@ func (c *client) handleForwardRequest(request *internal.ForwardRequest) {
 	c.forwards[request.Id] = forward
 
 	err = c.conn.Send(messageTypeForwardResponse, &internal.ForwardResponse{
-		Id:         request.Id,
-		Success:    true,
-		Source:     request.Source,
-		SourceAddr: request.SourceAddr,
-		Target:     request.Target,
-		TargetAddr: request.TargetAddr,
+		Id:          request.Id,
+		Success:     true,
+		Source:      request.Source,
+		SourceAddr:  request.SourceAddr,
+		Target:      request.Target,
+		TargetAddr:  request.TargetAddr,
+		Compression: compression,
 	})
 	if err != nil {
-		log.Println("Cannot send forward response: " + err.Error())
+		c.config.Logger.Error("Cannot send forward response", "forward", request.Id, "error", err)
 		return // TODO close forward
 	}
 
-	go c.punch(peerUdpAddr)
+	go c.punch(forward, peerUdpAddr)
 }
 
 func (c *client) handleIncomingPeers(listener quic.Listener) {
 	for {
-		log.Println("Waiting for connections")
+		c.config.Logger.Debug("Waiting for peer connections")
 		session, err := listener.Accept()
 		if err != nil {
-			log.Println("Cannot accept peer connections: " + err.Error())
+			c.config.Logger.Error("Cannot accept peer connections", "error", err)
 			time.Sleep(5 * time.Second)
 			continue
 		}
@@ -88,7 +156,7 @@ func (c *client) handleIncomingPeers(listener quic.Listener) {
 }
 
 func (c *client) handlePeerSession(session quic.Session) {
-	log.Println("Session from " + session.RemoteAddr().String() + " accepted.")
+	c.config.Logger.Debug("Peer session accepted", "peer", session.RemoteAddr())
 	peerAddr := session.RemoteAddr().(*net.UDPAddr)
 	connectionId := session.ConnectionState().ServerName // Connection ID is the SNI host!
 
@@ -96,78 +164,128 @@ func (c *client) handlePeerSession(session quic.Session) {
 
 	forward, ok := c.forwards[connectionId]
 	if !ok {
-		log.Printf("Cannot find forward for connection ID %s. Closing.", connectionId)
+		c.config.Logger.Info("Cannot find forward for peer session, closing", "forward", connectionId, "peer", peerAddr)
 		session.Close()
 		c.forwardsMutex.Unlock()
 		return
 	}
 
-	targetForwardAddr := forward.targetForwardAddr
-	targetCommand := forward.targetCommand
-
-	if targetCommand != nil && len(targetCommand) > 0 {
-		log.Println("Client accepted from " + peerAddr.String() + ", forward found to command " + strings.Join(forward.targetCommand, " "))
+	if forward.targetService != "" {
+		c.config.Logger.Info("Peer connected to service", "forward", forward.id, "peer", peerAddr, "service", forward.targetService, "addr", forward.targetForwardAddr)
+	} else if forward.targetCommand != nil && len(forward.targetCommand) > 0 {
+		c.config.Logger.Info("Peer connected, forwarding to command", "forward", forward.id, "peer", peerAddr, "command", forward.targetCommand)
 	} else {
-		log.Println("Client accepted from " + peerAddr.String() + ", forward found to " + targetForwardAddr)
+		c.config.Logger.Info("Peer connected, forwarding to TCP address", "forward", forward.id, "peer", peerAddr, "addr", forward.targetForwardAddr)
 	}
 
 	c.forwardsMutex.Unlock()
 
+	c.events.publish(Event{Type: EventPeerConnected, Client: forward.source, Forward: forward.id, Addr: peerAddr.String()})
+
 	for {
 		stream, err := session.AcceptStream()
 		if err != nil {
-			log.Println("Failed to accept peer stream. Closing session: " + err.Error())
+			c.config.Logger.Info("Failed to accept peer stream, closing session", "forward", forward.id, "peer", peerAddr, "error", err)
 			session.Close()
+
+			// Forwards of local TCP listeners open a session for every connection, all with
+			// the same forward ID, so only forwards that are dialed once can be removed here
+			if forward.singleSession {
+				c.removeForward(forward.id)
+			}
 			break
 		}
 
-		go c.handlePeerStream(session, stream, targetForwardAddr, targetCommand)
+		go c.handlePeerStream(session, stream, forward)
 	}
 }
 
-func (c *client) handlePeerStream(session quic.Session, stream quic.Stream, targetForwardAddr string, targetCommand []string) {
-	log.Printf("Stream %d accepted. Starting to forward.\n", stream.StreamID())
+func (c *client) handlePeerStream(session quic.Session, stream quic.Stream, forward *forward) {
+	c.config.Logger.Debug("Peer stream accepted, starting to forward", "forward", forward.id, "stream", stream.StreamID())
+
+	if forward.targetService != "" && !c.readPeerStreamHello(stream, forward) {
+		return
+	}
+
+	if forward.inviteSecret != "" {
+		if err := c.authenticateInvite(stream, forward.inviteSecret, forward.id, false); err != nil {
+			c.config.Logger.Info("Peer failed invite authentication, closing stream", "forward", forward.id, "peer", forward.source, "error", err)
+			stream.CancelRead(0)
+			stream.Close()
+			return
+		}
+	}
 
-	if targetCommand != nil && len(targetCommand) > 0 {
-		c.forwardToCommand(stream, targetCommand)
+	if handler, ok := c.builtinService(forward.targetService); ok {
+		handler(stream, forward)
+	} else if forward.targetService != "" && forward.targetForwardAddr == "" {
+		c.forwardToListener(session, stream, forward)
+	} else if forward.targetCommand != nil && len(forward.targetCommand) > 0 {
+		c.forwardToCommand(stream, forward)
 	} else {
-		c.forwardToTcp(stream, targetForwardAddr)
+		c.forwardToTcp(stream, forward)
 	}
 }
 
-func (c *client) forwardToCommand(stream quic.Stream, targetCommand []string) {
-	cmd := exec.Command(targetCommand[0], targetCommand[1:]...)
+func (c *client) forwardToCommand(stream quic.Stream, forward *forward) {
+	cmd := exec.Command(forward.targetCommand[0], forward.targetCommand[1:]...)
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		log.Println(err.Error())
+		c.config.Logger.Error("Cannot create command pipe", "forward", forward.id, "command", forward.targetCommand, "error", err)
 		return // TODO close forward
 	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Println(err.Error())
+		c.config.Logger.Error("Cannot create command pipe", "forward", forward.id, "command", forward.targetCommand, "error", err)
 		return // TODO close forward
 	}
 
 	err = cmd.Start()
 	if err != nil {
-		log.Println(err.Error())
+		c.config.Logger.Error("Cannot start command", "forward", forward.id, "command", forward.targetCommand, "error", err)
 		return // TODO close forward
 	}
 
-	go func() { io.Copy(stream, stdout) }()
-	go func() { io.Copy(stdin, stream) }()
+	c.forwardStreams(forward, stream, &commandStream{stdout, stdin})
 }
 
-func (c *client) forwardToTcp(stream quic.Stream, targetForwardAddr string) {
-	forwardStream, err := net.Dial("tcp", targetForwardAddr)
+func (c *client) forwardToTcp(stream quic.Stream, forward *forward) {
+	forwardStream, err := net.Dial("tcp", forward.targetForwardAddr)
 	if err != nil {
-		log.Printf("Cannot open connection to %s: %s\n", targetForwardAddr, err.Error())
+		c.config.Logger.Error("Cannot open TCP connection", "forward", forward.id, "addr", forward.targetForwardAddr, "error", err)
 		return // TODO close forward
 	}
 
-	go func() { io.Copy(stream, forwardStream) }()
-	go func() { io.Copy(forwardStream, stream) }()
+	c.forwardStreams(forward, stream, forwardStream)
 }
 
+// builtinService returns the handler of a service that is built into every listening
+// client (see isBuiltinService), or false if there is no such service
+func (c *client) builtinService(service string) (func(quic.Stream, *forward), bool) {
+	switch service {
+	case pingService:
+		return c.handlePing, true
+	case benchService:
+		return c.handleBench, true
+	case sendService:
+		if c.config.ReceiveDir != "" {
+			return c.handleSend, true
+		}
+		return nil, false
+	default:
+		return nil, false
+	}
+}
+
+// commandStream combines STDOUT and STDIN of a command. Closing the write
+// direction closes the command's STDIN, i.e. it signals EOF to the command.
+type commandStream struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func (s *commandStream) CloseWrite() error {
+	return s.WriteCloser.Close()
+}
@@ -0,0 +1,363 @@
+package natter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"heckel.io/natter/internal"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// peerStreamHello is written by the dialing side as the first byte of a service
+	// stream (see DialPeer and ForwardService). QUIC only announces a stream to the peer once data is sent on it, so
+	// without it, protocols in which the server speaks first would never start.
+	peerStreamHello = byte(0x01)
+
+	// peerConnLinger is the time a dialed session stays open after the connection
+	// was closed, so that data in flight can still be delivered.
+	peerConnLinger = 2 * time.Second
+)
+
+// peerConn is a net.Conn backed by a QUIC stream to a peer
+type peerConn struct {
+	stream      quic.Stream
+	session     quic.Session
+	ownsSession bool
+	onClose     func()
+	closeOnce   sync.Once
+}
+
+// peerListener is a net.Listener that yields connections from peers to a named service
+type peerListener struct {
+	client  *client
+	service string
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (c *client) DialPeer(ctx context.Context, target string, service string) (net.Conn, error) {
+	conn, _, err := c.dialPeer(ctx, target, service, nil)
+	return conn, err
+}
+
+// dialTimings records how long the steps of dialing a peer took, see Client.Ping
+type dialTimings struct {
+	broker    time.Duration // Forward request until the forward was accepted
+	handshake time.Duration // QUIC handshake with the peer
+}
+
+// dialPeer connects to a named service on another client, see DialPeer. It returns the forward
+// as well, and fills in the timings, if they are not nil.
+func (c *client) dialPeer(ctx context.Context, target string, service string, timings *dialTimings) (net.Conn, *forward, error) {
+	session, forward, err := c.dialPeerSession(ctx, target, service, timings)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream, err := c.openServiceStream(session)
+	if err != nil {
+		session.Close()
+		c.removeForward(forward.id)
+		return nil, nil, err
+	}
+
+	streamSession := c.openSession(forward, stream)
+
+	return &peerConn{
+		stream:      stream,
+		session:     session,
+		ownsSession: true,
+		onClose: func() {
+			c.closeSession(streamSession)
+			c.removeForward(forward.id)
+		},
+	}, forward, nil
+}
+
+// dialPeerSession brokers a forward to a named service on another client and establishes the
+// QUIC session to it. The caller must close the session and remove the forward when it is done.
+func (c *client) dialPeerSession(ctx context.Context, target string, service string, timings *dialTimings) (quic.Session, *forward, error) {
+	c.config.Logger.Info("Dialing peer service", "target", target, "service", service)
+
+	if target == c.config.ClientId {
+		return nil, nil, errors.New("cannot dial yourself")
+	}
+
+	if service == "" {
+		return nil, nil, errors.New("service cannot be empty")
+	}
+
+	err := c.conn.connect()
+	if err != nil {
+		return nil, nil, errors.New("cannot connect to broker: " + err.Error())
+	}
+
+	forward := &forward{
+		id:            c.generateConnId(),
+		source:        c.config.ClientId,
+		target:        target,
+		targetService: service,
+		updated:       make(chan struct{}),
+	}
+
+	c.forwardsMutex.Lock()
+	c.forwards[forward.id] = forward
+	c.forwardsMutex.Unlock()
+
+	session, err := c.dialPeerService(ctx, forward, timings)
+	if err != nil {
+		c.removeForward(forward.id)
+		return nil, nil, err
+	}
+
+	return session, forward, nil
+}
+
+func (c *client) dialPeerService(ctx context.Context, forward *forward, timings *dialTimings) (quic.Session, error) {
+	requestStart := time.Now()
+
+	err := c.conn.Send(messageTypeForwardRequest, &internal.ForwardRequest{
+		Id:            forward.id,
+		Source:        forward.source,
+		Target:        forward.target,
+		TargetService: forward.targetService,
+		SingleSession: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, peerUdpAddr, err := forward.wait(ctx)
+	if err != nil && err == ctx.Err() {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("peer %s rejected connection to service %s", forward.target, forward.targetService)
+	}
+
+	if timings != nil {
+		timings.broker = time.Since(requestStart)
+	}
+
+	tlsClientConfig := c.config.TLSClientConfig.Clone() // copy, because quic-go alters it!
+	sniHost := fmt.Sprintf("%s:%d", forward.id, 2586)   // Connection ID in the SNI host, port doesn't matter!
+	handshakeStart := time.Now()
+
+	session, err := quic.DialContext(ctx, c.conn.UdpConn(), peerUdpAddr, sniHost, tlsClientConfig, c.config.QuicConfig)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to peer %s via %s: %s", forward.target, peerUdpAddr.String(), err.Error())
+	}
+
+	if err := verifyPeerCertificate(c.caPool(), forward.target, session.ConnectionState().PeerCertificates); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("cannot connect to peer %s via %s: %s", forward.target, peerUdpAddr.String(), err.Error())
+	}
+
+	c.metrics.handshakeDuration.observe(time.Since(handshakeStart).Seconds())
+	if timings != nil {
+		timings.handshake = time.Since(handshakeStart)
+	}
+
+	c.events.publish(Event{Type: EventPeerConnected, Client: forward.target, Forward: forward.id, Addr: peerUdpAddr.String()})
+
+	return session, nil
+}
+
+// openServiceStream opens a new service stream on a dialed session, and announces it to the peer
+func (c *client) openServiceStream(session quic.Session) (quic.Stream, error) {
+	stream, err := session.OpenStreamSync()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := stream.Write([]byte{peerStreamHello}); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (c *client) ListenPeer(service string) (net.Listener, error) {
+	if service == "" {
+		return nil, errors.New("service cannot be empty")
+	}
+
+	if isBuiltinService(service) {
+		return nil, fmt.Errorf("service %s is reserved", service)
+	}
+
+	if _, ok := c.service(service); ok {
+		return nil, fmt.Errorf("service %s is already configured", service)
+	}
+
+	// Only start listening for forwards once the service name is known to be valid
+	if err := c.Listen(); err != nil {
+		return nil, err
+	}
+
+	c.peerListenersMutex.Lock()
+
+	if _, ok := c.peerListeners[service]; ok {
+		c.peerListenersMutex.Unlock()
+		return nil, fmt.Errorf("service %s is already being listened on", service)
+	}
+
+	listener := &peerListener{
+		client:  c,
+		service: service,
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+
+	c.peerListeners[service] = listener
+	c.peerListenersMutex.Unlock()
+
+	c.config.Logger.Info("Listening for peer connections to service", "service", service)
+
+	// Advertise the new service right away, rather than with the next regular check-in
+	if err := c.conn.checkin(); err != nil {
+		c.config.Logger.Error("Cannot advertise service to broker", "service", service, "error", err)
+	}
+
+	return listener, nil
+}
+
+func (c *client) peerListener(service string) (*peerListener, bool) {
+	c.peerListenersMutex.RLock()
+	defer c.peerListenersMutex.RUnlock()
+
+	listener, ok := c.peerListeners[service]
+	return listener, ok
+}
+
+func (c *client) forwardToListener(session quic.Session, stream quic.Stream, forward *forward) {
+	listener, ok := c.peerListener(forward.targetService)
+	if !ok {
+		c.config.Logger.Info("No listener for service, closing stream", "forward", forward.id, "service", forward.targetService)
+		stream.CancelRead(0)
+		stream.Close()
+		return
+	}
+
+	streamSession := c.openSession(forward, stream)
+
+	conn := &peerConn{
+		stream:  stream,
+		session: session,
+		onClose: func() {
+			c.closeSession(streamSession)
+		},
+	}
+
+	select {
+	case listener.conns <- conn:
+	case <-listener.closed:
+		conn.Close()
+	}
+}
+
+// readPeerStreamHello reads the hello marker the dialing side writes on every
+// service stream. It closes the stream and returns false if it is invalid.
+func (c *client) readPeerStreamHello(stream quic.Stream, forward *forward) bool {
+	hello := make([]byte, 1)
+	if _, err := io.ReadFull(stream, hello); err != nil || hello[0] != peerStreamHello {
+		c.config.Logger.Info("Invalid service stream, closing", "forward", forward.id, "service", forward.targetService)
+		stream.CancelRead(0)
+		stream.Close()
+		return false
+	}
+
+	return true
+}
+
+func (c *client) removeForward(id string) {
+	c.forwardsMutex.Lock()
+	defer c.forwardsMutex.Unlock()
+
+	delete(c.forwards, id)
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *peerListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+
+		l.client.peerListenersMutex.Lock()
+		delete(l.client.peerListeners, l.service)
+		l.client.peerListenersMutex.Unlock()
+
+		if err := l.client.conn.checkin(); err != nil {
+			l.client.config.Logger.Error("Cannot withdraw service from broker", "service", l.service, "error", err)
+		}
+	})
+
+	return nil
+}
+
+func (l *peerListener) Addr() net.Addr {
+	return l.client.conn.UdpConn().LocalAddr()
+}
+
+func (c *peerConn) Read(b []byte) (int, error) {
+	return c.stream.Read(b)
+}
+
+func (c *peerConn) Write(b []byte) (int, error) {
+	return c.stream.Write(b)
+}
+
+func (c *peerConn) Close() error {
+	var err error
+
+	c.closeOnce.Do(func() {
+		err = c.stream.Close()
+		c.stream.CancelRead(0)
+
+		if c.ownsSession {
+			go func() {
+				time.Sleep(peerConnLinger)
+				c.session.Close()
+			}()
+		}
+
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+
+	return err
+}
+
+func (c *peerConn) LocalAddr() net.Addr {
+	return c.session.LocalAddr()
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.session.RemoteAddr()
+}
+
+func (c *peerConn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+func (c *peerConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *peerConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
@@ -0,0 +1,19 @@
+package natter
+
+import (
+	"testing"
+)
+
+func TestListenPeerInvalidService(t *testing.T) {
+	// The client has no broker connection, so it must not try to listen before the name is checked
+	c := &client{config: &Config{Services: map[string]string{"ssh": "127.0.0.1:22"}}}
+
+	for _, service := range []string{"", "natter:ping", "ssh"} {
+		if _, err := c.ListenPeer(service); err == nil {
+			t.Errorf("expected service %q to be refused", service)
+		}
+		if c.listener != nil {
+			t.Errorf("expected client not to listen after service %q was refused", service)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package natter
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/lucas-clemente/quic-go"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// pingService is built into every listening client. It echoes everything it receives.
+	pingService = "natter:ping"
+
+	pingCount    = 5
+	pingInterval = 1 * time.Second
+	pingTimeout  = 2 * time.Second
+)
+
+func (c *client) Ping(ctx context.Context, peer string) (*PingResult, error) {
+	var timings dialTimings
+
+	conn, forward, err := c.dialPeer(ctx, peer, pingService, &timings)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	forward.RLock()
+	accepted := forward.accepted
+	forward.RUnlock()
+
+	result := &PingResult{
+		Peer:              peer,
+		LocalAddr:         c.conn.localAddr,
+		PublicAddr:        accepted.SourceAddr,
+		NatType:           accepted.SourceNatType,
+		PeerAddr:          accepted.TargetAddr,
+		PeerLocalAddr:     accepted.TargetLocalAddr,
+		PeerNatType:       accepted.TargetNatType,
+		BrokerDuration:    timings.broker,
+		HandshakeDuration: timings.handshake,
+		Samples:           make([]PingSample, 0, pingCount),
+	}
+
+	for seq := 1; seq <= pingCount; seq++ {
+		if seq > 1 {
+			select {
+			case <-ctx.Done():
+				return result, nil
+			case <-time.After(pingInterval):
+			}
+		}
+
+		sample, err := c.ping(conn, seq)
+		if err != nil {
+			return result, errors.New("ping failed: " + err.Error())
+		}
+
+		result.Samples = append(result.Samples, sample)
+	}
+
+	return result, nil
+}
+
+// ping sends a single probe with the given sequence number and waits for the echo. Echoes of
+// earlier probes that timed out are skipped. If no echo arrives in time, the probe is lost.
+func (c *client) ping(conn net.Conn, seq int) (PingSample, error) {
+	probe := make([]byte, 4)
+	binary.BigEndian.PutUint32(probe, uint32(seq))
+
+	sent := time.Now()
+	if _, err := conn.Write(probe); err != nil {
+		return PingSample{}, err
+	}
+
+	conn.SetReadDeadline(sent.Add(pingTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	echo := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(conn, echo); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return PingSample{Seq: seq, Lost: true}, nil
+			}
+			return PingSample{}, err
+		}
+
+		if int(binary.BigEndian.Uint32(echo)) == seq {
+			return PingSample{Seq: seq, RTT: time.Since(sent)}, nil
+		}
+	}
+}
+
+// handlePing echoes everything the peer sends on the stream, see Client.Ping
+func (c *client) handlePing(stream quic.Stream, forward *forward) {
+	c.config.Logger.Debug("Answering ping", "forward", forward.id, "peer", forward.source)
+
+	session := c.openSession(forward, stream)
+	io.Copy(stream, stream)
+	stream.Close()
+	c.closeSession(session)
+}
@@ -0,0 +1,107 @@
+package natter
+
+import (
+	"errors"
+	"heckel.io/natter/internal"
+	"sort"
+)
+
+func (c *client) WatchPeer(peer string) error {
+	if peer == "" {
+		return errors.New("peer cannot be empty")
+	}
+
+	err := c.conn.connect()
+	if err != nil {
+		return errors.New("cannot connect to broker: " + err.Error())
+	}
+
+	c.presenceMutex.Lock()
+	c.watching[peer] = true
+	c.presenceMutex.Unlock()
+
+	return c.sendPresenceRequest()
+}
+
+func (c *client) UnwatchPeer(peer string) error {
+	c.presenceMutex.Lock()
+	delete(c.watching, peer)
+	delete(c.online, peer)
+	c.presenceMutex.Unlock()
+
+	return c.sendPresenceRequest()
+}
+
+// sendPresenceRequest sends the full list of watched peers to the broker. The
+// broker replaces its list, so this is also used to re-subscribe after reconnecting.
+func (c *client) sendPresenceRequest() error {
+	c.presenceMutex.Lock()
+	peers := make([]string, 0, len(c.watching))
+	for peer := range c.watching {
+		peers = append(peers, peer)
+	}
+	c.presenceMutex.Unlock()
+
+	sort.Strings(peers)
+	return c.conn.Send(messageTypePresenceRequest, &internal.PresenceRequest{Peers: peers})
+}
+
+func (c *client) handlePresenceUpdate(update *internal.PresenceUpdate) {
+	c.presenceMutex.Lock()
+	if !c.watching[update.Peer] || c.online[update.Peer] == update.Online {
+		c.presenceMutex.Unlock()
+		return
+	}
+	c.online[update.Peer] = update.Online
+	c.presenceMutex.Unlock()
+
+	if update.Online {
+		c.config.Logger.Info("Peer came online", "peer", update.Peer)
+		c.events.publish(Event{Type: EventPeerOnline, Client: update.Peer})
+		c.retryWaitingForwards(update.Peer)
+	} else {
+		c.config.Logger.Info("Peer went away", "peer", update.Peer)
+		c.events.publish(Event{Type: EventPeerOffline, Client: update.Peer})
+		c.suspendForwards(update.Peer)
+	}
+}
+
+// peerForwards returns the durable forwards from this client to the given peer
+func (c *client) peerForwards(peer string) []*forward {
+	c.forwardsMutex.RLock()
+	defer c.forwardsMutex.RUnlock()
+
+	forwards := make([]*forward, 0)
+	for _, forward := range c.forwards {
+		if forward.source == c.config.ClientId && forward.target == peer && forward.durable() {
+			forwards = append(forwards, forward)
+		}
+	}
+
+	return forwards
+}
+
+// retryWaitingForwards re-requests the durable forwards to the given peer that were
+// rejected, or whose peer went away. It is called when the peer comes (back) online.
+func (c *client) retryWaitingForwards(peer string) {
+	for _, forward := range c.peerForwards(peer) {
+		forward.RLock()
+		id, state := forward.id, forward.state
+		forward.RUnlock()
+
+		if state == forwardStateRejected {
+			c.config.Logger.Info("Retrying forward, peer is online", "forward", id, "target", peer)
+			c.rerequestForward(forward, id)
+		}
+	}
+}
+
+// suspendForwards marks the durable forwards to the given peer as rejected, because the peer
+// went away. New local connections wait for the peer to come back, instead of trying to
+// connect to an address that is likely gone.
+func (c *client) suspendForwards(peer string) {
+	for _, forward := range c.peerForwards(peer) {
+		c.config.Logger.Info("Suspending forward until peer is back online", "forward", forward.id, "target", peer)
+		forward.setState(forwardStateRejected, nil)
+	}
+}
@@ -0,0 +1,462 @@
+package natter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+	"heckel.io/natter/internal"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// sendService is built into every client that receives files (see Config.ReceiveDir).
+	// For every file or directory, the sending side sends a SendFileRequest, and the
+	// receiving side answers with a SendFileResponse that contains the offset at which
+	// to resume. For files, the sending side then sends the remaining bytes, and the
+	// receiving side answers with a SendFileResult once it verified the checksum.
+	sendService = "natter:send"
+
+	// sendPartialSuffix is appended to files that are still being received. They are
+	// renamed once they are complete and verified, and resumed if the transfer is interrupted.
+	sendPartialSuffix = ".natterpart"
+)
+
+// sendEntry is a file or directory to be sent, with its name relative to the receive directory
+type sendEntry struct {
+	name string
+	path string
+	info os.FileInfo
+}
+
+func (c *client) Send(ctx context.Context, peer string, paths []string, options *SendOptions) (*SendResult, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no files to send")
+	}
+
+	entries, err := sendEntries(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	session, forward, err := c.dialPeerSession(ctx, peer, sendService, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		session.Close()
+		c.removeForward(forward.id)
+	}()
+
+	stream, err := c.openServiceStream(session)
+	if err != nil {
+		return nil, err
+	}
+
+	streamSession := c.openSession(forward, stream)
+	defer c.closeSession(streamSession)
+
+	// Abort the transfer if the context is canceled
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+		case <-done:
+		}
+	}()
+
+	p := &protocol{stream: stream, logger: c.config.Logger}
+	result := &SendResult{}
+
+	for _, entry := range entries {
+		if err := c.sendEntry(p, stream, streamSession, forward, entry, options, result); err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			return result, err
+		}
+	}
+
+	// Wait for the peer to close its side, so that we don't close the session too early
+	stream.Close()
+	io.Copy(ioutil.Discard, stream)
+
+	return result, nil
+}
+
+// sendEntries walks the given paths and returns all files and directories in them. Names
+// are relative to the parent of each path, e.g. sending /home/phil/photos yields photos/cat.jpg.
+// Anything that is neither a regular file nor a directory (e.g. symlinks) is skipped.
+func sendEntries(paths []string) ([]*sendEntry, error) {
+	entries := make([]*sendEntry, 0)
+
+	for _, root := range paths {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+
+		base := filepath.Base(abs)
+		if base == string(filepath.Separator) {
+			return nil, fmt.Errorf("cannot send %s", root)
+		}
+
+		err = filepath.Walk(abs, func(filename string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(abs, filename)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, &sendEntry{
+				name: filepath.ToSlash(filepath.Join(base, rel)),
+				path: filename,
+				info: info,
+			})
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+func (c *client) sendEntry(p *protocol, stream quic.Stream, session *streamSession, forward *forward, entry *sendEntry, options *SendOptions, result *SendResult) error {
+	request := &internal.SendFileRequest{
+		Name:    entry.name,
+		Dir:     entry.info.IsDir(),
+		Mode:    uint32(entry.info.Mode().Perm()),
+		ModTime: entry.info.ModTime().Unix(),
+	}
+
+	var file *os.File
+	var err error
+
+	if !request.Dir {
+		file, err = os.Open(entry.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		request.Checksum, request.Size, err = sendChecksum(file)
+		if err != nil {
+			return errors.New("cannot read " + entry.path + ": " + err.Error())
+		}
+	}
+
+	if err := p.send(messageTypeSendFileRequest, request); err != nil {
+		return err
+	}
+
+	message, err := receiveSendMessage(p, messageTypeSendFileResponse)
+	if err != nil {
+		return err
+	}
+
+	response := message.(*internal.SendFileResponse)
+	if response.Error != "" {
+		return fmt.Errorf("peer cannot receive %s: %s", entry.name, response.Error)
+	} else if response.Offset < 0 || response.Offset > request.Size {
+		return fmt.Errorf("peer cannot receive %s: invalid offset %d", entry.name, response.Offset)
+	}
+
+	progress := SendProgress{
+		Name:     entry.name,
+		Dir:      request.Dir,
+		Size:     request.Size,
+		Offset:   response.Offset,
+		Sent:     response.Offset,
+		Checksum: request.Checksum,
+	}
+
+	reportProgress := func() {
+		if options != nil && options.Progress != nil {
+			options.Progress(progress)
+		}
+	}
+
+	reportProgress()
+
+	if request.Dir {
+		result.Dirs++
+		progress.Done = true
+		reportProgress()
+		return nil
+	}
+
+	if _, err := file.Seek(response.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	writer := &countingWriter{
+		writer:      stream,
+		metric:      c.metrics.forwardBytes,
+		labelValues: []string{forward.peer(c.config.ClientId), "sent"},
+		counter:     &session.sent,
+	}
+
+	progressWriter := &sendProgressWriter{writer: writer, progress: func(n int) {
+		progress.Sent += int64(n)
+		result.Bytes += int64(n)
+		reportProgress()
+	}}
+
+	if _, err := io.CopyN(progressWriter, file, request.Size-response.Offset); err != nil {
+		return err
+	}
+
+	message, err = receiveSendMessage(p, messageTypeSendFileResult)
+	if err != nil {
+		return err
+	}
+
+	if sendResult := message.(*internal.SendFileResult); !sendResult.Success {
+		return fmt.Errorf("peer did not accept %s: %s", entry.name, sendResult.Error)
+	}
+
+	result.Files++
+	if response.Offset > 0 {
+		result.Resumed++
+	}
+
+	progress.Done = true
+	reportProgress()
+
+	return nil
+}
+
+// handleSend receives files and directories from a peer and stores them in the receive directory, see Client.Send
+func (c *client) handleSend(stream quic.Stream, forward *forward) {
+	session := c.openSession(forward, stream)
+	defer c.closeSession(session)
+	defer stream.Close()
+
+	c.config.Logger.Info("Receiving files", "forward", forward.id, "peer", forward.source, "dir", c.config.ReceiveDir)
+
+	p := &protocol{stream: stream, logger: c.config.Logger}
+
+	for {
+		_, message, err := p.receive()
+		if err == io.EOF {
+			c.config.Logger.Info("Finished receiving files", "forward", forward.id, "peer", forward.source)
+			return
+		} else if err != nil {
+			c.config.Logger.Info("Cannot receive files, closing stream", "forward", forward.id, "peer", forward.source, "error", err)
+			stream.CancelRead(0)
+			return
+		}
+
+		request, ok := message.(*internal.SendFileRequest)
+		if !ok {
+			c.config.Logger.Info("Unexpected message, closing stream", "forward", forward.id, "peer", forward.source)
+			stream.CancelRead(0)
+			return
+		}
+
+		if err := c.receiveFile(p, stream, session, forward, request); err != nil {
+			c.config.Logger.Info("Cannot receive file, closing stream", "forward", forward.id, "peer", forward.source, "file", request.Name, "error", err)
+			stream.CancelRead(0)
+			return
+		}
+	}
+}
+
+// receiveFile handles a single SendFileRequest. Errors that are returned are fatal for the
+// stream, errors that only affect this file are sent to the peer instead.
+func (c *client) receiveFile(p *protocol, stream quic.Stream, session *streamSession, forward *forward, request *internal.SendFileRequest) error {
+	filename, err := receivePath(c.config.ReceiveDir, request.Name)
+	if err != nil {
+		return p.send(messageTypeSendFileResponse, &internal.SendFileResponse{Error: err.Error()})
+	}
+
+	mode := os.FileMode(request.Mode).Perm()
+
+	if request.Dir {
+		if err := os.MkdirAll(filename, mode|0700); err != nil {
+			c.config.Logger.Error("Cannot create directory", "dir", filename, "error", err)
+			return p.send(messageTypeSendFileResponse, &internal.SendFileResponse{Error: "cannot create directory"})
+		}
+
+		return p.send(messageTypeSendFileResponse, &internal.SendFileResponse{})
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		c.config.Logger.Error("Cannot create directory", "dir", filepath.Dir(filename), "error", err)
+		return p.send(messageTypeSendFileResponse, &internal.SendFileResponse{Error: "cannot create directory"})
+	}
+
+	// Skip files we already have, and resume partial files
+	if receiveComplete(filename, request) {
+		c.config.Logger.Info("File already received, skipping", "forward", forward.id, "peer", forward.source, "file", filename)
+
+		if err := p.send(messageTypeSendFileResponse, &internal.SendFileResponse{Offset: request.Size}); err != nil {
+			return err
+		}
+
+		return p.send(messageTypeSendFileResult, &internal.SendFileResult{Success: true})
+	}
+
+	partial := filename + sendPartialSuffix
+
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		c.config.Logger.Error("Cannot create file", "file", partial, "error", err)
+		return p.send(messageTypeSendFileResponse, &internal.SendFileResponse{Error: "cannot create file"})
+	}
+	defer file.Close()
+
+	var offset int64
+	if stat, err := file.Stat(); err == nil && stat.Size() <= request.Size {
+		offset = stat.Size()
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		return err
+	} else if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	if offset > 0 {
+		c.config.Logger.Info("Resuming file", "forward", forward.id, "peer", forward.source, "file", filename, "offset", offset, "size", request.Size)
+	} else {
+		c.config.Logger.Info("Receiving file", "forward", forward.id, "peer", forward.source, "file", filename, "size", request.Size)
+	}
+
+	if err := p.send(messageTypeSendFileResponse, &internal.SendFileResponse{Offset: offset}); err != nil {
+		return err
+	}
+
+	// If the transfer is interrupted, the partial file is kept, so it can be resumed
+	writer := &countingWriter{
+		writer:      file,
+		metric:      c.metrics.forwardBytes,
+		labelValues: []string{forward.peer(c.config.ClientId), "received"},
+		counter:     &session.received,
+	}
+
+	if _, err := io.CopyN(writer, stream, request.Size-offset); err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	// Verify the whole file, including the part that was received earlier
+	checksum, err := fileChecksum(partial)
+	if err != nil {
+		return err
+	} else if checksum != request.Checksum {
+		c.config.Logger.Error("Checksum mismatch, discarding file", "forward", forward.id, "peer", forward.source, "file", filename)
+		os.Remove(partial)
+		return p.send(messageTypeSendFileResult, &internal.SendFileResult{Error: "checksum mismatch"})
+	}
+
+	if err := os.Rename(partial, filename); err != nil {
+		c.config.Logger.Error("Cannot rename file", "file", partial, "error", err)
+		return p.send(messageTypeSendFileResult, &internal.SendFileResult{Error: "cannot rename file"})
+	}
+
+	os.Chmod(filename, mode)
+	os.Chtimes(filename, time.Now(), time.Unix(request.ModTime, 0))
+
+	c.config.Logger.Info("Received file", "forward", forward.id, "peer", forward.source, "file", filename, "size", request.Size)
+	return p.send(messageTypeSendFileResult, &internal.SendFileResult{Success: true})
+}
+
+// receivePath returns the path of a received file in the receive directory. Names
+// are relative and slash separated, and must not point outside of the directory.
+func receivePath(dir string, name string) (string, error) {
+	clean := path.Clean(name)
+
+	if name == "" || path.IsAbs(name) || strings.Contains(name, "\\") {
+		return "", errors.New("invalid file name")
+	} else if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.New("invalid file name")
+	} else if strings.HasSuffix(clean, sendPartialSuffix) {
+		return "", errors.New("invalid file name")
+	}
+
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+// receiveComplete returns true if the file exists and matches the request's size and checksum
+func receiveComplete(filename string, request *internal.SendFileRequest) bool {
+	stat, err := os.Stat(filename)
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() != request.Size {
+		return false
+	}
+
+	checksum, err := fileChecksum(filename)
+	return err == nil && checksum == request.Checksum
+}
+
+func receiveSendMessage(p *protocol, expected messageType) (interface{}, error) {
+	messageType, message, err := p.receive()
+	if err != nil {
+		return nil, err
+	} else if messageType != expected {
+		return nil, fmt.Errorf("unexpected message %s, expected %s", messageTypes[messageType], messageTypes[expected])
+	}
+
+	return message, nil
+}
+
+func fileChecksum(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	checksum, _, err := sendChecksum(file)
+	return checksum, err
+}
+
+// sendChecksum returns the hex encoded SHA-256 checksum of everything read from the reader, and its size
+func sendChecksum(reader io.Reader) (string, int64, error) {
+	hash := sha256.New()
+
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// sendProgressWriter passes all writes through to the underlying writer, and reports the number of bytes written
+type sendProgressWriter struct {
+	writer   io.Writer
+	progress func(n int)
+}
+
+func (w *sendProgressWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.progress(n)
+	return n, err
+}
@@ -0,0 +1,46 @@
+package natter
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestReceivePath(t *testing.T) {
+	dir := filepath.FromSlash("/srv/receive")
+
+	tests := []struct {
+		name     string
+		expected string // Empty if the name must be rejected
+	}{
+		{"file.txt", filepath.Join(dir, "file.txt")},
+		{"a/b/file.txt", filepath.Join(dir, "a", "b", "file.txt")},
+		{"a/../file.txt", filepath.Join(dir, "file.txt")},
+		{"./a//file.txt", filepath.Join(dir, "a", "file.txt")},
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"../x", ""},
+		{"a/../../x", ""},
+		{"a/b/../../../x", ""},
+		{"/etc/passwd", ""},
+		{"/x/../etc/passwd", ""},
+		{"..\\x", ""},
+		{"a\\b", ""},
+		{"C:\\x", ""},
+		{"file.txt.natterpart", ""},
+		{"a/file.txt.natterpart", ""},
+	}
+
+	for _, test := range tests {
+		actual, err := receivePath(dir, test.name)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("receivePath(%q) = %q, expected error", test.name, actual)
+			}
+		} else if err != nil {
+			t.Errorf("receivePath(%q) returned error: %s", test.name, err)
+		} else if actual != test.expected {
+			t.Errorf("receivePath(%q) = %q, expected %q", test.name, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"heckel.io/natter"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// adminClient talks to the admin API of a running natter broker, see -admin
+type adminClient struct {
+	addr string
+	http *http.Client
+}
+
+type adminKnownClient struct {
+	Id          string    `json:"id"`
+	Registered  bool      `json:"registered"`
+	Fingerprint string    `json:"fingerprint"`
+	Groups      []string  `json:"groups"`
+	LastSeen    time.Time `json:"lastSeen"`
+	LastAddr    string    `json:"lastAddr"`
+	Connected   bool      `json:"connected"`
+}
+
+// runBrokerClients implements the commands that manage the known clients of a running broker
+// via its admin API:
+//
+//	natter broker clients
+//	natter broker clients add [-key FILE] [-groups GROUP,...] ID
+//	natter broker clients remove ID
+func runBrokerClients(config *natter.Config, args []string) {
+	if config.AdminAddr == "" {
+		fmt.Println("Admin API address cannot be empty, pass -admin ADMINADDR or set AdminAddr in the config file.")
+		fmt.Println()
+		syntax()
+	}
+
+	admin := &adminClient{addr: config.AdminAddr, http: &http.Client{Timeout: 10 * time.Second}}
+
+	var err error
+
+	switch {
+	case len(args) == 0:
+		err = admin.clients()
+	case len(args) >= 2 && args[0] == "add":
+		flags := flag.NewFlagSet("broker clients add", flag.ExitOnError)
+		key := flags.String("key", "", "PEM encoded public key or certificate of the client")
+		groups := flags.String("groups", "", "Comma separated list of groups")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			syntax()
+		}
+		err = admin.addClient(flags.Arg(0), *key, *groups)
+	case len(args) == 2 && args[0] == "remove":
+		err = admin.removeClient(args[1])
+	default:
+		syntax()
+	}
+
+	if err != nil {
+		fail(err)
+	}
+}
+
+type adminEnrollment struct {
+	Client  string    `json:"client"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// runBrokerEnroll creates an enrollment token for a new client via the admin API of a running broker:
+//
+//	natter broker enroll [-ttl DURATION] [-force] ID
+func runBrokerEnroll(config *natter.Config, args []string) {
+	if config.AdminAddr == "" {
+		fmt.Println("Admin API address cannot be empty, pass -admin ADMINADDR or set AdminAddr in the config file.")
+		fmt.Println()
+		syntax()
+	}
+
+	flags := flag.NewFlagSet("broker enroll", flag.ExitOnError)
+	ttl := flags.Duration("ttl", 0, "How long the token is valid, e.g. 1h (default 24h)")
+	force := flags.Bool("force", false, "Create a token even if the client has a valid certificate")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		syntax()
+	}
+
+	admin := &adminClient{addr: config.AdminAddr, http: &http.Client{Timeout: 10 * time.Second}}
+	if err := admin.enroll(flags.Arg(0), *ttl, *force); err != nil {
+		fail(err)
+	}
+}
+
+func (c *adminClient) clients() error {
+	var clients []*adminKnownClient
+	if err := c.request(http.MethodGet, "/known", nil, &clients); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tREGISTERED\tGROUPS\tKEY\tONLINE\tLAST SEEN\tLAST ADDR")
+	for _, client := range clients {
+		registered, online, key, lastSeen := "no", "no", "-", "never"
+		if client.Registered {
+			registered = "yes"
+		}
+		if client.Connected {
+			online = "yes"
+		}
+		if client.Fingerprint != "" {
+			key = client.Fingerprint[:16]
+		}
+		if !client.LastSeen.IsZero() {
+			lastSeen = client.LastSeen.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", client.Id, registered, strings.Join(client.Groups, ","), key, online, lastSeen, client.LastAddr)
+	}
+	return w.Flush()
+}
+
+func (c *adminClient) addClient(id string, keyFile string, groups string) error {
+	request := map[string]interface{}{}
+
+	if keyFile != "" {
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return errors.New("cannot read key file: " + err.Error())
+		}
+		request["publicKey"] = string(key)
+	}
+
+	if groups != "" {
+		request["groups"] = strings.Split(groups, ",")
+	}
+
+	var client adminKnownClient
+	if err := c.request(http.MethodPut, "/known/"+url.PathEscape(id), request, &client); err != nil {
+		return err
+	}
+
+	if client.Fingerprint != "" {
+		fmt.Printf("Client %s registered (key %s)\n", client.Id, client.Fingerprint)
+	} else {
+		fmt.Printf("Client %s registered\n", client.Id)
+	}
+	return nil
+}
+
+func (c *adminClient) removeClient(id string) error {
+	if err := c.request(http.MethodDelete, "/known/"+url.PathEscape(id), nil, nil); err != nil {
+		return err
+	}
+
+	fmt.Printf("Client %s removed\n", id)
+	return nil
+}
+
+func (c *adminClient) enroll(id string, ttl time.Duration, force bool) error {
+	request := map[string]interface{}{}
+	if ttl > 0 {
+		request["ttl"] = ttl.String()
+	}
+	if force {
+		request["force"] = true
+	}
+
+	var enrollment adminEnrollment
+	if err := c.request(http.MethodPut, "/enrollments/"+url.PathEscape(id), request, &enrollment); err != nil {
+		return err
+	}
+
+	fmt.Printf("Enrollment token for client %s (valid until %s, can be used once):\n", enrollment.Client, enrollment.Expires.Local().Format("2006-01-02 15:04:05"))
+	fmt.Println()
+	fmt.Printf("  %s\n", enrollment.Token)
+	fmt.Println()
+	fmt.Println("Set it as EnrollToken in the client's config file, along with Certificate and PrivateKey.")
+	return nil
+}
+
+// request sends a request to the admin API, and decodes the JSON response into response, if it is not nil
+func (c *adminClient) request(method string, path string, body interface{}, response interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, "http://"+c.addr+path, reader)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.New("cannot connect to natter broker admin API via " + c.addr + ", is it running? " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(message)))
+	}
+
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+
+	return nil
+}
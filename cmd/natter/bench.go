@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"heckel.io/natter"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+	"time"
+)
+
+// runBench implements the bench command, which measures the connection cost and throughput to a peer:
+//
+//	natter bench [-streams N] [-duration DURATION] [-handshakes N] PEER
+func runBench(config *natter.Config, args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	streams := flags.Int("streams", 1, "Maximum number of parallel streams, measured as 1, 2, 4, ... streams")
+	duration := flags.Duration("duration", 5*time.Second, "Duration of each upload and download run")
+	handshakes := flags.Int("handshakes", 3, "Number of connections to establish to measure the handshake cost")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		syntax()
+	}
+
+	if config.BrokerAddr == "" {
+		fmt.Println("Broker address cannot be empty.")
+		fmt.Println()
+		syntax()
+	}
+
+	peer := flags.Arg(0)
+	config.ControlSocket = "" // Not needed for one-shot commands
+
+	client, err := natter.NewClient(config)
+	if err != nil {
+		fail(err)
+	}
+
+	// Stop the benchmark on Ctrl-C, and print what we have so far
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	fmt.Printf("BENCH %s via broker %s, up to %d stream(s), %s per run\n", peer, config.BrokerAddr, *streams, *duration)
+
+	options := &natter.BenchOptions{Streams: *streams, Duration: *duration, Handshakes: *handshakes}
+	result, err := client.Bench(ctx, peer, options)
+	if err != nil && result == nil {
+		fail(err)
+	}
+
+	var brokerSum, handshakeSum time.Duration
+	for _, handshake := range result.Handshakes {
+		brokerSum += handshake.Broker
+		handshakeSum += handshake.Handshake
+	}
+
+	if n := time.Duration(len(result.Handshakes)); n > 0 {
+		fmt.Printf("Connection cost (avg of %d): brokered in %s, handshake %s\n", n, (brokerSum / n).Round(time.Microsecond), (handshakeSum / n).Round(time.Microsecond))
+	}
+	fmt.Println()
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "STREAMS\tDIRECTION\tBYTES\tDURATION\tTHROUGHPUT")
+	for _, run := range result.Runs {
+		direction := "download"
+		if run.Upload {
+			direction = "upload"
+		}
+		throughput := run.Throughput() * 8 / 1000 / 1000
+		fmt.Fprintf(writer, "%d\t%s\t%d\t%s\t%.1f Mbit/s\n", run.Streams, direction, run.Bytes, run.Duration.Round(time.Millisecond), throughput)
+	}
+	writer.Flush()
+
+	if err != nil {
+		fail(err)
+	}
+}
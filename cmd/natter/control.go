@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"heckel.io/natter"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var controlCommands = map[string]bool{"status": true, "forwards": true, "forward": true, "sessions": true}
+
+// defaultControlSocket returns the path of the control socket in the user's runtime directory
+// ($XDG_RUNTIME_DIR), or in ~/.config/natter if there is none. Both are only accessible by the user.
+func defaultControlSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "natter.sock")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("natter-%d", os.Getuid()), "natter.sock")
+	}
+
+	return filepath.Join(home, ".config", "natter", "natter.sock")
+}
+
+// controlClient talks to the control API of a running natter client via its Unix socket
+type controlClient struct {
+	socket string
+	http   *http.Client
+}
+
+func newControlClient(socket string) *controlClient {
+	return &controlClient{
+		socket: socket,
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// runControl implements the commands that talk to a running client via its control socket:
+//
+//	natter status
+//	natter forwards
+//	natter forward add [-wait] [-limit RATE[:BURST]] [-compress] SPEC [COMMAND]
+//	natter forward limit ID|SPEC RATE[:BURST]|off
+//	natter forward remove ID|SPEC
+//	natter sessions
+func runControl(config *natter.Config) {
+	control := newControlClient(config.ControlSocket)
+	args := flag.Args()
+
+	var err error
+
+	switch {
+	case len(args) == 1 && args[0] == "status":
+		err = control.status()
+	case len(args) == 1 && args[0] == "forwards":
+		err = control.forwards()
+	case len(args) == 1 && args[0] == "sessions":
+		err = control.sessions()
+	case len(args) >= 3 && args[0] == "forward" && args[1] == "add":
+		flags := flag.NewFlagSet("forward add", flag.ExitOnError)
+		wait := flags.Bool("wait", false, "Wait for offline peers and retry the forward when they come online")
+		limit := flags.String("limit", "", "Rate limit of the forward, e.g. 1M or 1M:4M")
+		compress := flags.Bool("compress", false, "Compress the forward with gzip, if the peer supports it")
+		flags.Parse(args[2:])
+		if flags.NArg() == 0 {
+			syntax()
+		}
+		compression := ""
+		if *compress {
+			compression = natter.CompressionGzip
+		}
+		err = control.addForward(flags.Arg(0), flags.Args()[1:], *wait, *limit, compression)
+	case len(args) == 4 && args[0] == "forward" && args[1] == "limit":
+		err = control.limitForward(args[2], args[3])
+	case len(args) == 3 && args[0] == "forward" && args[1] == "remove":
+		err = control.removeForward(args[2])
+	default:
+		syntax()
+	}
+
+	if err != nil {
+		fail(err)
+	}
+}
+
+func (c *controlClient) status() error {
+	var status natter.ControlStatus
+	if err := c.request(http.MethodGet, "/status", nil, &status); err != nil {
+		return err
+	}
+
+	listening := "no"
+	if status.Listening {
+		listening = "yes"
+	}
+
+	allowPeers := "all"
+	if len(status.AllowPeers) > 0 {
+		allowPeers = strings.Join(status.AllowPeers, ",")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Client:\t%s\n", status.ClientId)
+	if len(status.Brokers) == 0 { // Older clients only report one broker
+		status.Brokers = []*natter.ControlBroker{{Addr: status.BrokerAddr, Connected: status.Connected}}
+	}
+	for i, broker := range status.Brokers {
+		label, connected := "", "disconnected"
+		if i == 0 {
+			label = "Broker:"
+		}
+		if broker.Connected {
+			connected = "connected"
+		}
+		fmt.Fprintf(w, "%s\t%s (%s)\n", label, broker.Addr, connected)
+	}
+	fmt.Fprintf(w, "Listening:\t%s\n", listening)
+	fmt.Fprintf(w, "Services:\t%s\n", strings.Join(status.Services, ","))
+	fmt.Fprintf(w, "Allowed peers:\t%s\n", allowPeers)
+	fmt.Fprintf(w, "Forwards:\t%d\n", status.Forwards)
+	fmt.Fprintf(w, "Sessions:\t%d\n", status.Sessions)
+	return w.Flush()
+}
+
+func (c *controlClient) forwards() error {
+	var forwards []*natter.ControlForward
+	if err := c.request(http.MethodGet, "/forwards", nil, &forwards); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDIRECTION\tSPEC\tSTATE\tPEER ADDR\tLIMIT\tCOMPRESSION")
+	for _, forward := range forwards {
+		limit, compression := forward.Limit, forward.Compression
+		if limit == "" {
+			limit = "-"
+		}
+		if compression == "" {
+			compression = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", forward.Id, forward.Direction, forward.Spec, forward.State, forward.PeerAddr, limit, compression)
+	}
+	return w.Flush()
+}
+
+func (c *controlClient) sessions() error {
+	var sessions []*natter.ControlSession
+	if err := c.request(http.MethodGet, "/sessions", nil, &sessions); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FORWARD\tPEER\tSTREAM\tDURATION\tSENT\tRECEIVED\tRATIO")
+	for _, session := range sessions {
+		duration := time.Since(session.Started).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%d\t%s\n", session.Forward, session.Peer, session.Stream, duration, session.Sent, session.Received, compressionRatio(session))
+	}
+	return w.Flush()
+}
+
+func (c *controlClient) addForward(spec string, command []string, wait bool, limit string, compression string) error {
+	request := &natter.ControlForwardRequest{Spec: spec, Command: command, Wait: wait, Limit: limit, Compression: compression}
+
+	var forward natter.ControlForward
+	if err := c.request(http.MethodPost, "/forwards", request, &forward); err != nil {
+		return err
+	}
+
+	fmt.Printf("Forward %s added (%s)\n", forward.Spec, forward.Id)
+	return nil
+}
+
+// compressionRatio returns how well the data of a compressed session compressed, e.g. 3.2x,
+// or "-" if the session is not compressed
+func compressionRatio(session *natter.ControlSession) string {
+	compressed := session.SentCompressed + session.ReceivedCompressed
+	if compressed == 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("%.1fx", float64(session.Sent+session.Received)/float64(compressed))
+}
+
+// limitForward changes the rate limit of a forward; "off" removes it
+func (c *controlClient) limitForward(key string, limit string) error {
+	if limit == "off" {
+		limit = ""
+	}
+
+	var forward natter.ControlForward
+	if err := c.request(http.MethodPut, "/forwards/"+url.PathEscape(key), &natter.ControlLimitRequest{Limit: limit}, &forward); err != nil {
+		return err
+	}
+
+	if forward.Limit == "" {
+		fmt.Printf("Rate limit of forward %s removed\n", forward.Spec)
+	} else {
+		fmt.Printf("Forward %s limited to %s\n", forward.Spec, forward.Limit)
+	}
+	return nil
+}
+
+func (c *controlClient) removeForward(key string) error {
+	if err := c.request(http.MethodDelete, "/forwards/"+url.PathEscape(key), nil, nil); err != nil {
+		return err
+	}
+
+	fmt.Printf("Forward %s removed\n", key)
+	return nil
+}
+
+// request sends a request to the control API, and decodes the JSON response into response, if it is not nil
+func (c *controlClient) request(method string, path string, body interface{}, response interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, "http://natter"+path, reader)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.New("cannot connect to natter client via " + c.socket + ", is it running? " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(message)))
+	}
+
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+
+	return nil
+}
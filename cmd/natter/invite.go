@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"heckel.io/natter"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+const inviteTimeout = 30 * time.Second
+
+// runShare implements the share command, which creates a single-use invite to a local TCP address:
+//
+//	natter share [-ttl DURATION] ADDR
+func runShare(config *natter.Config, args []string) {
+	flags := flag.NewFlagSet("share", flag.ExitOnError)
+	ttl := flags.Duration("ttl", 10*time.Minute, "Time after which the invite expires, if it was not used")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		syntax()
+	}
+
+	client := newAnonymousClient(config)
+
+	// Only peers that join via the invite may connect; the own ID never dials itself
+	if err := client.SetAllowPeers([]string{config.ClientId}); err != nil {
+		fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), inviteTimeout)
+	defer cancel()
+
+	invite, err := client.Share(ctx, inviteAddr(flags.Arg(0)), *ttl)
+	if err != nil {
+		failAnonymous(err)
+	}
+
+	client.Subscribe(func(event natter.Event) {
+		if event.Type == natter.EventPeerConnected {
+			fmt.Printf("Peer %s connected from %s\n", event.Client, event.Addr)
+		}
+	})
+
+	fmt.Printf("Sharing %s, expires at %s if not used. To connect, run:\n", flags.Arg(0), invite.Expires.Format("15:04:05"))
+	fmt.Println()
+	fmt.Printf("  natter -broker %s join %s LOCALPORT\n", config.BrokerAddr, invite.Code)
+	fmt.Println()
+	fmt.Println("Press Ctrl-C to stop sharing.")
+
+	waitForInterrupt()
+}
+
+// runJoin implements the join command, which forwards a local TCP address to an address shared via share:
+//
+//	natter join CODE LOCALADDR
+func runJoin(config *natter.Config, code string, localAddr string) {
+	client := newAnonymousClient(config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), inviteTimeout)
+	defer cancel()
+
+	if _, err := client.Join(ctx, inviteAddr(localAddr), code); err != nil {
+		failAnonymous(err)
+	}
+
+	fmt.Printf("Joined, forwarding %s to the shared address. Press Ctrl-C to stop.\n", inviteAddr(localAddr))
+	waitForInterrupt()
+}
+
+// newAnonymousClient creates a client with a temporary, random client ID, so that neither side of
+// an invite needs a configured client ID, and a running client with the same ID is not disturbed.
+// Such a client has no certificate, so it cannot be used in setups with a CA.
+func newAnonymousClient(config *natter.Config) natter.Client {
+	if config.BrokerAddr == "" {
+		fmt.Println("Broker address cannot be empty.")
+		fmt.Println()
+		syntax()
+	}
+
+	if config.CAPool != nil || config.EnrollToken != "" {
+		fail(errors.New("share and join use a random client ID without a certificate, so they cannot be used " +
+			"if CACertificate or EnrollToken is set, since the broker and peers only accept clients with a certificate"))
+	}
+
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	rand.Seed(time.Now().UnixNano())
+
+	id := make([]byte, 10)
+	for i := range id {
+		id[i] = letters[rand.Intn(len(letters))]
+	}
+
+	config.ClientId = "anon-" + string(id)
+	config.ControlSocket = "" // Don't take over the control socket of a running client
+	config.Forwards = nil
+	config.Services = nil
+	config.AllowPeers = nil
+
+	client, err := natter.NewClient(config)
+	if err != nil {
+		fail(err)
+	}
+
+	return client
+}
+
+// failAnonymous fails with the given error, and explains why the broker may not have let the
+// anonymous client (see newAnonymousClient) check in, e.g. because of RestrictClients
+func failAnonymous(err error) {
+	if strings.HasPrefix(err.Error(), "cannot connect to broker") {
+		fail(errors.New(err.Error() + " (share and join use a random client ID, which the broker " +
+			"does not let check in if it only allows registered clients)"))
+	}
+
+	fail(err)
+}
+
+// inviteAddr turns a port into an address, e.g. 22 into :22
+func inviteAddr(addr string) string {
+	if !strings.Contains(addr, ":") {
+		return ":" + addr
+	}
+	return addr
+}
+
+func waitForInterrupt() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
@@ -1,66 +1,138 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"heckel.io/natter"
-	"log"
 	"os"
+	"os/signal"
+	"reflect"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
-const (
-	defaultConfigFile = "/etc/natter/natter.conf"
+var (
+	defaultConfigFiles = []string{"/etc/natter/natter.conf", "/etc/natter/natter.yml"}
 )
 
 func main() {
-	configFlag := flag.String("config", "", "Config file, defaults to /etc/natter/natter.conf")
-	brokerFlag := flag.String("broker", "", "Broker address and port")
+	configFlag := flag.String("config", "", "Config file, defaults to /etc/natter/natter.conf or /etc/natter/natter.yml")
+	brokerFlag := flag.String("broker", "", "Broker address and port; clients accept a comma separated list of brokers for failover")
 	clientIdFlag := flag.String("id", "", "Client identifier (client only)")
 	listenFlag := flag.Bool("listen", false, "Listen for incoming forwards (client only)")
+	adminFlag := flag.String("admin", "", "Admin HTTP API address and port (broker only)")
+	metricsFlag := flag.String("metrics", "", "Prometheus metrics endpoint address and port")
+	clusterFlag := flag.String("cluster", "", "Address and port under which other brokers of the cluster reach this broker (broker only)")
+	registryFlag := flag.String("registry", "", "Directory of the client registry shared by all brokers of the cluster (broker only)")
+	controlFlag := flag.String("control", "", "Control socket of the client, defaults to "+defaultControlSocket()+" (client only)")
+	logLevelFlag := flag.String("log-level", "info", "Log level (debug, info or error)")
+	logFormatFlag := flag.String("log-format", "text", "Log format (text or json)")
+	waitFlag := flag.Bool("wait", false, "Wait for offline peers and retry forwards when they come online (client only)")
+	allowFlag := flag.String("allow", "", "Comma separated list of peers allowed to connect, defaults to all (client only)")
+	receiveFlag := flag.String("receive", "", "Accept files sent by peers and store them in this directory (client only)")
+	limitFlag := flag.String("limit", "", "Rate limit for the forwards on the command line, e.g. 1M or 1M:4M (client only)")
+	compressFlag := flag.Bool("compress", false, "Compress the forwards on the command line with gzip, if the peer supports it (client only)")
+	serviceFlag := make(serviceFlags)
+	flag.Var(serviceFlag, "service", "Offer a named service to peers, e.g. ssh=127.0.0.1:22 (client only, repeatable)")
 
 	flag.Parse()
 
-	config := loadConfig(configFlag, clientIdFlag, brokerFlag)
+	if flag.NArg() >= 1 && flag.Arg(0) == "config" {
+		runConfig(configFlag)
+		return
+	}
+
+	config := loadConfig(configFlag, clientIdFlag, brokerFlag, adminFlag, metricsFlag)
+	applyPolicyFlags(config, serviceFlag, allowFlag)
+	if *receiveFlag != "" {
+		config.ReceiveDir = *receiveFlag
+	}
+	if *clusterFlag != "" {
+		config.ClusterAddr = *clusterFlag
+	}
+	if *registryFlag != "" {
+		config.RegistryDir = *registryFlag
+	}
+	config.Logger = createLogger(logLevelFlag, logFormatFlag)
+
+	if *controlFlag != "" {
+		config.ControlSocket = *controlFlag
+	} else if config.ControlSocket == "" {
+		config.ControlSocket = defaultControlSocket()
+	}
+
+	if flag.NArg() >= 1 && controlCommands[flag.Arg(0)] {
+		runControl(config)
+		return
+	}
+
+	// Re-reads the config file on SIGHUP; command line flags still take precedence
+	reload := func() (*natter.Config, error) {
+		filename := configFile(configFlag)
+		if filename == "" {
+			return nil, errors.New("no config file to reload")
+		}
+
+		newConfig, err := natter.LoadConfig(filename)
+		if err != nil {
+			return nil, err
+		}
 
-	if config.ClientId != "" {
-		runClient(config, listenFlag)
+		applyPolicyFlags(newConfig, serviceFlag, allowFlag)
+		if *receiveFlag != "" {
+			newConfig.ReceiveDir = *receiveFlag
+		}
+		return newConfig, nil
+	}
+
+	if flag.NArg() >= 2 && flag.Arg(0) == "broker" && flag.Arg(1) == "clients" {
+		runBrokerClients(config, flag.Args()[2:])
+	} else if flag.NArg() >= 3 && flag.Arg(0) == "broker" && flag.Arg(1) == "enroll" {
+		runBrokerEnroll(config, flag.Args()[2:])
+	} else if flag.NArg() >= 2 && flag.Arg(0) == "share" {
+		runShare(config, flag.Args()[1:])
+	} else if flag.NArg() == 3 && flag.Arg(0) == "join" {
+		runJoin(config, flag.Arg(1), flag.Arg(2))
+	} else if config.ClientId != "" && flag.NArg() == 1 && flag.Arg(0) == "peers" {
+		runPeers(config)
+	} else if config.ClientId != "" && flag.NArg() == 2 && flag.Arg(0) == "ping" {
+		runPing(config, flag.Arg(1))
+	} else if config.ClientId != "" && flag.NArg() >= 2 && flag.Arg(0) == "bench" {
+		runBench(config, flag.Args()[1:])
+	} else if config.ClientId != "" && flag.NArg() >= 3 && flag.Arg(0) == "send" {
+		runSend(config, flag.Arg(1), flag.Args()[2:])
+	} else if config.ClientId != "" {
+		runClient(config, listenFlag, waitFlag, limitFlag, compressFlag, reload)
 	} else {
 		runBroker(config)
 	}
 }
 
-func runClient(config *natter.Config, listenFlag *bool) {
+func runClient(config *natter.Config, listenFlag *bool, waitFlag *bool, limitFlag *string, compressFlag *bool, reload func() (*natter.Config, error)) {
 	if config.BrokerAddr == "" {
 		fmt.Println("Broker address cannot be empty.")
 		fmt.Println()
 		syntax()
 	}
 
-	log.Println("Starting natter in client mode, client ID is " + config.ClientId)
+	config.Logger.Info("Starting natter in client mode", "client", config.ClientId)
 
 	client, err := natter.NewClient(config)
 	if err != nil {
 		fail(err)
 	}
 
-	// Process -listen flag
-	if *listenFlag {
-		err := client.Listen()
-		if err != nil {
-			fail(err)
-		}
-	}
-
-	// Read forward specs and command
+	// Read forward specs and command; specs from the command line are added to the ones from the config file
 	var targetCommandStartIndex int
 	var targetCommand []string
 	var specs []string
 
 	for i := 0; i < flag.NArg(); i++ {
-		spec := strings.Split(flag.Arg(i), ":")
-		if len(spec) != 3 && len(spec) != 4 {
+		if !strings.Contains(flag.Arg(i), ":") {
 			targetCommandStartIndex = i
 			break
 		}
@@ -74,51 +146,324 @@ func runClient(config *natter.Config, listenFlag *bool) {
 		targetCommand = flag.Args()[targetCommandStartIndex:]
 	}
 
-	if !*listenFlag && len(specs) == 0 {
-		fail(errors.New("either specify the -listen flag or at least one forward spec"))
-		syntax()
+	var limit *natter.RateLimit
+	if *limitFlag != "" {
+		limit, err = natter.ParseRateLimit(*limitFlag)
+		if err != nil {
+			fail(err)
+		}
 	}
 
-	// Process forward specs
+	argForwards := make([]*natter.ForwardSpec, 0)
 	for _, s := range specs {
-		spec := strings.Split(s, ":")
-
-		var (
-			sourceAddr string
-			target string
-			targetForwardAddr string
-		)
-
-		if len(spec) == 3 {
-			sourceAddr = spec[0]
-			target = spec[1]
-
-			if spec[2] == "" {
-				targetForwardAddr = ""
-
-				if len(targetCommand) == 0 {
-					fail(errors.New("Invalid spec " + s + ", no command specified"))
-				}
-			} else {
-				targetForwardAddr = ":" + spec[2]
-			}
-		} else if len(spec) == 4 {
-			sourceAddr = spec[0]
-			target = spec[1]
-			targetForwardAddr = spec[2] + ":" + spec[3]
+		spec, err := natter.ParseForwardSpec(s, targetCommand)
+		if err != nil {
+			fail(err)
 		}
 
-		if sourceAddr != "" {
-			sourceAddr = ":" + sourceAddr
+		spec.RateLimit = limit
+		if *compressFlag {
+			spec.Compression = natter.CompressionGzip
 		}
 
-		_, err := client.Forward(sourceAddr, target, targetForwardAddr, targetCommand)
+		argForwards = append(argForwards, spec)
+	}
+
+	// Offering services or receiving files implies listening
+	listen := *listenFlag || config.Listen || len(config.Services) > 0 || config.ReceiveDir != ""
+
+	if !listen && len(config.Forwards) == 0 && len(argForwards) == 0 {
+		fail(errors.New("either specify the -listen flag, a service or at least one forward spec"))
+		syntax()
+	}
+
+	if listen {
+		err := client.Listen()
 		if err != nil {
 			fail(err)
 		}
 	}
 
-	select { }
+	// Process forward specs; forwards from the config file are added and removed when the
+	// config is reloaded, see reloadClient
+	for _, spec := range append(argForwards, config.Forwards...) {
+		if _, err := startForward(client, spec, *waitFlag); err != nil {
+			fail(err)
+		}
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	for range sighup {
+		config.Logger.Info("Reloading config")
+
+		newConfig, err := reload()
+		if err != nil {
+			config.Logger.Error("Cannot reload config, keeping current config", "error", err)
+			continue
+		}
+
+		reloadClient(client, config, newConfig, *listenFlag, *waitFlag)
+		config = newConfig
+	}
+}
+
+func startForward(client natter.Client, spec *natter.ForwardSpec, wait bool) (natter.Forward, error) {
+	options := &natter.ForwardOptions{
+		Service:     spec.Service,
+		WaitForPeer: wait,
+		RateLimit:   spec.RateLimit,
+		Compression: spec.Compression,
+	}
+
+	return client.ForwardWithOptions(spec.LocalAddr, spec.Target, spec.TargetForwardAddr, spec.TargetCommand, options)
+}
+
+// reloadClient applies the differences between the old and the new config to the running client.
+// Only forwards that were added or removed are touched, so established connections keep running.
+func reloadClient(client natter.Client, oldConfig *natter.Config, newConfig *natter.Config, listenFlag bool, wait bool) {
+	logger := oldConfig.Logger
+	newConfig.Logger = logger
+
+	brokersChanged := newConfig.BrokerAddr != oldConfig.BrokerAddr || strings.Join(newConfig.BrokerAddrs, ",") != strings.Join(oldConfig.BrokerAddrs, ",")
+	if newConfig.ClientId != oldConfig.ClientId || brokersChanged || newConfig.MetricsAddr != oldConfig.MetricsAddr || newConfig.ReceiveDir != oldConfig.ReceiveDir {
+		logger.Error("ClientId, BrokerAddr, MetricsAddr and ReceiveDir cannot be changed without a restart, ignoring")
+	}
+
+	newConfig.ClientId = oldConfig.ClientId
+	newConfig.BrokerAddr = oldConfig.BrokerAddr
+	newConfig.BrokerAddrs = oldConfig.BrokerAddrs
+	newConfig.MetricsAddr = oldConfig.MetricsAddr
+	newConfig.ReceiveDir = oldConfig.ReceiveDir
+
+	if !reflect.DeepEqual(newConfig.Services, oldConfig.Services) {
+		logger.Info("Updating services", "services", newConfig.Services)
+		if err := client.SetServices(newConfig.Services); err != nil {
+			logger.Error("Cannot update services", "error", err)
+		}
+	}
+
+	if !reflect.DeepEqual(newConfig.AllowPeers, oldConfig.AllowPeers) {
+		logger.Info("Updating allowed peers", "peers", newConfig.AllowPeers)
+		if err := client.SetAllowPeers(newConfig.AllowPeers); err != nil {
+			logger.Error("Cannot update allowed peers", "error", err)
+		}
+	}
+
+	if !reflect.DeepEqual(newConfig.RateLimits, oldConfig.RateLimits) {
+		logger.Info("Updating rate limits", "limits", newConfig.RateLimits)
+		if err := client.SetRateLimits(newConfig.RateLimits); err != nil {
+			logger.Error("Cannot update rate limits", "error", err)
+		}
+	}
+
+	listen := listenFlag || newConfig.Listen || len(newConfig.Services) > 0 || newConfig.ReceiveDir != ""
+	if listen {
+		if err := client.Listen(); err != nil {
+			logger.Error("Cannot listen for incoming forwards", "error", err)
+		}
+	} else if oldConfig.Listen {
+		logger.Error("Listen cannot be turned off without a restart, ignoring")
+	}
+
+	specs := make(map[string]*natter.ForwardSpec)
+	for _, spec := range newConfig.Forwards {
+		specs[spec.String()] = spec
+	}
+
+	oldSpecs := make(map[string]*natter.ForwardSpec)
+	for _, spec := range oldConfig.Forwards {
+		oldSpecs[spec.String()] = spec
+	}
+
+	// The config is compared to the live forwards of the client, so that forwards that were removed via
+	// the control socket are re-created, and the ones added via the control socket are left alone. Compression
+	// is negotiated when the forward is requested, so changing it re-creates the forward.
+	forwards := make(map[string]natter.Forward)
+	for _, forward := range client.Forwards() {
+		forwards[forward.Spec().String()] = forward
+	}
+
+	for key, forward := range forwards {
+		spec, ok := specs[key]
+		_, configured := oldSpecs[key]
+		if (configured && !ok) || (ok && spec.Compression != forward.Spec().Compression) {
+			logger.Info("Removing forward", "forward", key)
+			if err := forward.Close(); err != nil {
+				logger.Error("Cannot remove forward", "forward", key, "error", err)
+			}
+			delete(forwards, key)
+		}
+	}
+
+	for key, spec := range specs {
+		if forward, ok := forwards[key]; ok {
+			if !reflect.DeepEqual(forward.RateLimit(), spec.RateLimit) {
+				logger.Info("Updating forward rate limit", "forward", key, "limit", spec.RateLimit)
+				forward.SetRateLimit(spec.RateLimit)
+			}
+		} else {
+			logger.Info("Adding forward", "forward", key)
+			if _, err := startForward(client, spec, wait); err != nil {
+				logger.Error("Cannot add forward", "forward", key, "error", err)
+			}
+		}
+	}
+}
+
+// applyPolicyFlags adds the services from the -service flags to the config, and
+// replaces the allowed peers if the -allow flag is set
+func applyPolicyFlags(config *natter.Config, serviceFlag serviceFlags, allowFlag *string) {
+	if len(serviceFlag) > 0 && config.Services == nil {
+		config.Services = make(map[string]string)
+	}
+	for name, addr := range serviceFlag {
+		config.Services[name] = addr
+	}
+	if *allowFlag != "" {
+		config.AllowPeers = strings.Split(*allowFlag, ",")
+	}
+}
+
+// serviceFlags collects repeated -service NAME=ADDR flags
+type serviceFlags map[string]string
+
+func (s serviceFlags) String() string {
+	services := make([]string, 0, len(s))
+	for name, addr := range s {
+		services = append(services, name+"="+addr)
+	}
+	return strings.Join(services, ",")
+}
+
+func (s serviceFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return errors.New("invalid service " + value + ", expected NAME=ADDR")
+	}
+
+	s[parts[0]] = parts[1]
+	return nil
+}
+
+func runPeers(config *natter.Config) {
+	if config.BrokerAddr == "" {
+		fmt.Println("Broker address cannot be empty.")
+		fmt.Println()
+		syntax()
+	}
+
+	config.ControlSocket = "" // Not needed for one-shot commands
+
+	client, err := natter.NewClient(config)
+	if err != nil {
+		fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	peers, err := client.Peers(ctx)
+	if err != nil {
+		fail(err)
+	}
+
+	if len(peers) == 0 {
+		fmt.Println("No peers online.")
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "PEER\tNAT\tSERVICES")
+	for _, peer := range peers {
+		services := strings.Join(peer.Services, ",")
+		if services == "" {
+			services = "-"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", peer.Id, peer.NatType, services)
+	}
+	writer.Flush()
+}
+
+func runPing(config *natter.Config, peer string) {
+	if config.BrokerAddr == "" {
+		fmt.Println("Broker address cannot be empty.")
+		fmt.Println()
+		syntax()
+	}
+
+	config.ControlSocket = "" // Not needed for one-shot commands
+
+	client, err := natter.NewClient(config)
+	if err != nil {
+		fail(err)
+	}
+
+	// Stop sending probes on Ctrl-C, and print what we have so far
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	fmt.Printf("PING %s via broker %s\n", peer, config.BrokerAddr)
+
+	result, err := client.Ping(ctx, peer)
+	if err != nil && result == nil {
+		fail(err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "Local:\t%s\tpublic %s, NAT %s\n", result.LocalAddr, result.PublicAddr, result.NatType)
+	fmt.Fprintf(writer, "Peer:\t%s\tlocal %s, NAT %s\n", result.PeerAddr, result.PeerLocalAddr, result.PeerNatType)
+	fmt.Fprintf(writer, "Brokered in:\t%s\n", result.BrokerDuration.Round(time.Microsecond))
+	fmt.Fprintf(writer, "Handshake:\t%s\n", result.HandshakeDuration.Round(time.Microsecond))
+	writer.Flush()
+	fmt.Println()
+
+	var lost int
+	var min, max, sum time.Duration
+
+	for _, sample := range result.Samples {
+		if sample.Lost {
+			lost++
+			fmt.Printf("seq=%d lost\n", sample.Seq)
+			continue
+		}
+
+		if min == 0 || sample.RTT < min {
+			min = sample.RTT
+		}
+		if sample.RTT > max {
+			max = sample.RTT
+		}
+		sum += sample.RTT
+
+		fmt.Printf("seq=%d rtt=%s\n", sample.Seq, sample.RTT.Round(time.Microsecond))
+	}
+
+	fmt.Println()
+	fmt.Printf("--- %s ping statistics ---\n", peer)
+	loss := 0.0
+	if len(result.Samples) > 0 {
+		loss = 100 * float64(lost) / float64(len(result.Samples))
+	}
+
+	fmt.Printf("%d probes sent, %d lost (%.0f%% loss)\n", len(result.Samples), lost, loss)
+
+	if received := len(result.Samples) - lost; received > 0 {
+		avg := sum / time.Duration(received)
+		fmt.Printf("rtt min/avg/max = %s/%s/%s\n", min.Round(time.Microsecond), avg.Round(time.Microsecond), max.Round(time.Microsecond))
+	}
+
+	if err != nil {
+		fail(err)
+	}
 }
 
 func runBroker(config *natter.Config) {
@@ -132,7 +477,7 @@ func runBroker(config *natter.Config) {
 		syntax()
 	}
 
-	log.Println("Starting natter in broker mode, listening on " + config.BrokerAddr)
+	config.Logger.Info("Starting natter in broker mode", "addr", config.BrokerAddr)
 
 	broker, err := natter.NewBroker(config)
 	if err != nil {
@@ -144,22 +489,17 @@ func runBroker(config *natter.Config) {
 	}
 }
 
-func loadConfig(configFlag *string, clientIdFlag *string, brokerFlag *string) *natter.Config {
+func loadConfig(configFlag *string, clientIdFlag *string, brokerFlag *string, adminFlag *string, metricsFlag *string) *natter.Config {
 	var config *natter.Config
 	var err error
 
-	if *configFlag != "" {
-		config, err = natter.LoadConfig(*configFlag)
+	if filename := configFile(configFlag); filename != "" {
+		config, err = natter.LoadConfig(filename)
 		if err != nil {
 			fmt.Println(err.Error())
 			fmt.Println()
 			syntax()
 		}
-	} else if _, err := os.Stat(defaultConfigFile); err == nil {
-		config, err = natter.LoadConfig(defaultConfigFile)
-		if err != nil {
-			fmt.Println(err.Error())
-		}
 	} else {
 		config = &natter.Config{}
 	}
@@ -169,19 +509,154 @@ func loadConfig(configFlag *string, clientIdFlag *string, brokerFlag *string) *n
 	}
 
 	if *brokerFlag != "" {
-		config.BrokerAddr = *brokerFlag
+		brokers := strings.Split(*brokerFlag, ",")
+		config.BrokerAddr, config.BrokerAddrs = brokers[0], brokers[1:]
+	}
+
+	if *adminFlag != "" {
+		config.AdminAddr = *adminFlag
+	}
+
+	if *metricsFlag != "" {
+		config.MetricsAddr = *metricsFlag
 	}
 
 	return config
 }
 
+// configFile returns the config file passed via -config, or the first default config file
+// that exists. If neither is the case, it returns an empty string.
+func configFile(configFlag *string) string {
+	if *configFlag != "" {
+		return *configFlag
+	}
+
+	for _, filename := range defaultConfigFiles {
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		}
+	}
+
+	return ""
+}
+
+// runConfig implements "natter config check [FILE]", which validates a config file
+// and lists all errors, e.g. before reloading a running client via SIGHUP
+func runConfig(configFlag *string) {
+	if flag.NArg() < 2 || flag.NArg() > 3 || flag.Arg(1) != "check" {
+		syntax()
+	}
+
+	filename := configFile(configFlag)
+	if flag.NArg() == 3 {
+		filename = flag.Arg(2)
+	}
+
+	if filename == "" {
+		fail(errors.New("no config file found, pass it via -config or as argument"))
+	}
+
+	config, err := natter.LoadConfig(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s: OK (%d forward(s), %d service(s), %d allowed peer(s))\n", filename, len(config.Forwards), len(config.Services), len(config.AllowPeers))
+}
+
+func createLogger(logLevelFlag *string, logFormatFlag *string) natter.Logger {
+	level, err := natter.ParseLogLevel(*logLevelFlag)
+	if err != nil {
+		fmt.Println(err.Error())
+		fmt.Println()
+		syntax()
+	}
+
+	switch *logFormatFlag {
+	case "text":
+		return natter.NewTextLogger(os.Stderr, level)
+	case "json":
+		return natter.NewJSONLogger(os.Stderr, level)
+	default:
+		fmt.Println("invalid log format " + *logFormatFlag)
+		fmt.Println()
+		syntax()
+		return nil
+	}
+}
+
 func syntax() {
 	fmt.Println("Syntax:")
-	fmt.Println("  natter -broker :PORT")
-	fmt.Println("    Start the broker / rendevous server on PORT for new client connections")
+	fmt.Println("  natter -broker :PORT [-admin ADMINADDR] [-metrics METRICSADDR] [-cluster CLUSTERADDR -registry DIR]")
+	fmt.Println("    Start the broker / rendevous server on PORT for new client connections,")
+	fmt.Println("    and optionally serve the admin HTTP API on ADMINADDR; brokers that share the")
+	fmt.Println("    registry DIR form a cluster (requires ClusterSecret, and CACertificate or BrokerFingerprint")
+	fmt.Println("    in the config file)")
 	fmt.Println()
-	fmt.Println("  natter [-config CONFIG] [-id CLIENTID] [-broker BROKER] [-listen] [FORWARDSPEC ...] [COMMAND]")
-	fmt.Println("    Start client side daemon to listen for incoming forwards")
+	fmt.Println("  natter [-config CONFIG] [-id CLIENTID] [-broker BROKER] [-listen] [-service NAME=ADDR ...] [-allow PEERS] [-receive DIR] [-wait] [-limit RATE[:BURST]] [-compress] [-metrics METRICSADDR] [FORWARDSPEC ...] [COMMAND]")
+	fmt.Println("    Start client side daemon to listen for incoming forwards, and optionally offer")
+	fmt.Println("    named services to peers (e.g. -service ssh=127.0.0.1:22)")
+	fmt.Println()
+	fmt.Println("  natter [-config CONFIG]")
+	fmt.Println("    Start the client as configured in CONFIG (or /etc/natter/natter.conf or .yml),")
+	fmt.Println("    including its Listen, Forward, Service, AllowPeer and RateLimit settings. Sending SIGHUP")
+	fmt.Println("    re-reads the config file and adds/removes forwards and changes rate limits without")
+	fmt.Println("    dropping connections")
+	fmt.Println()
+	fmt.Println("  natter [-config CONFIG] config check [FILE]")
+	fmt.Println("    Validate the config file and list all errors with their line")
+	fmt.Println()
+	fmt.Println("  natter [-config CONFIG] [-id CLIENTID] [-broker BROKER] ping PEER")
+	fmt.Println("    Connect to PEER and measure the round trip time; shows the addresses and NAT types")
+	fmt.Println("    of both sides, and how long brokering and the handshake took")
+	fmt.Println()
+	fmt.Println("  natter [-config CONFIG] [-id CLIENTID] [-broker BROKER] bench [-streams N] [-duration DURATION] [-handshakes N] PEER")
+	fmt.Println("    Connect to PEER and measure the handshake cost, and the upload and download")
+	fmt.Println("    throughput with 1, 2, 4, ... up to N parallel streams")
+	fmt.Println()
+	fmt.Println("  natter [-config CONFIG] [-id CLIENTID] [-broker BROKER] send PEER PATH ...")
+	fmt.Println("    Send files and directories to PEER, which must be started with -receive DIR;")
+	fmt.Println("    interrupted transfers are resumed when sending the same files again")
+	fmt.Println()
+	fmt.Println("  natter [-config CONFIG] [-broker BROKER] share [-ttl DURATION] [HOST:]PORT")
+	fmt.Println("  natter [-config CONFIG] [-broker BROKER] join CODE [LOCALHOST:]LOCALPORT")
+	fmt.Println("    Share a local TCP port via a single-use invite code, without configuring client IDs;")
+	fmt.Println("    the peer that joins with the code can connect to it via its local port")
+	fmt.Println()
+	fmt.Println("  natter [-control SOCKET] status|forwards|sessions")
+	fmt.Println("  natter [-control SOCKET] forward add [-wait] [-limit RATE[:BURST]] [-compress] FORWARDSPEC [COMMAND]")
+	fmt.Println("  natter [-control SOCKET] forward limit ID|FORWARDSPEC RATE[:BURST]|off")
+	fmt.Println("  natter [-control SOCKET] forward remove ID|FORWARDSPEC")
+	fmt.Println("    Show the status, forwards or active sessions of a running client, add/remove")
+	fmt.Println("    forwards, or change their rate limit, via the client's control socket")
+	fmt.Println()
+	fmt.Println("  natter [-config CONFIG] [-admin ADMINADDR] broker clients")
+	fmt.Println("  natter [-config CONFIG] [-admin ADMINADDR] broker clients add [-key FILE] [-groups GROUP,...] CLIENTID")
+	fmt.Println("  natter [-config CONFIG] [-admin ADMINADDR] broker clients remove CLIENTID")
+	fmt.Println("    List the clients a running broker knows (with when and from where they were last seen),")
+	fmt.Println("    or register/remove a client via the broker's admin API; the broker keeps them in the")
+	fmt.Println("    ClientsFile, and only lets registered clients connect if RestrictClients is set")
+	fmt.Println()
+	fmt.Println("  natter [-config CONFIG] [-admin ADMINADDR] broker enroll [-ttl DURATION] [-force] CLIENTID")
+	fmt.Println("    Create a single-use enrollment token for a new client; the client sets it as EnrollToken")
+	fmt.Println("    and gets its certificate from the broker, which must have CAPrivateKey set. Tokens can only")
+	fmt.Println("    be created via localhost, and only for clients without a valid certificate, unless -force is set")
+	fmt.Println()
+	fmt.Println("  natter [-config CONFIG] [-id CLIENTID] [-broker BROKER] peers")
+	fmt.Println("    List the peers that are online and the services they offer")
+	fmt.Println()
+	fmt.Println("  If -broker is a comma separated list (e.g. -broker b1.example.com:2586,b2.example.com:2586), the client")
+	fmt.Println("  checks in with all brokers, and tries the next one if a forward is rejected or a broker goes away")
+	fmt.Println("  If -allow is set, only the listed peers can see and connect to this client")
+	fmt.Println("  If -receive is set, files sent by peers via send are stored in the given directory")
+	fmt.Println("  If -wait is set, forwards to offline peers are retried as soon as the peer comes online")
+	fmt.Println("  If -limit is set, the forwards are limited to RATE bytes/s per direction (K, M, G suffixes),")
+	fmt.Println("  allowing bursts of BURST bytes; peers can be limited via RateLimit in the config file")
+	fmt.Println("  If -compress is set, the forwards are compressed with gzip if the peer supports it; see")
+	fmt.Println("  the RATIO column of \"natter sessions\" for how well the data compresses")
+	fmt.Println("  If -metrics is set, Prometheus metrics are served at http://METRICSADDR/metrics")
+	fmt.Println("  Logging can be configured via -log-level (debug, info, error) and -log-format (text, json)")
 	fmt.Println()
 	fmt.Println("  Forward spec:")
 	fmt.Println("    [LOCALPORT]:TARGET:[TARGETHOST:]TARGETPORT")
@@ -191,6 +666,7 @@ func syntax() {
 	fmt.Println("    LOCALPORT:TARGET:OTHERHOST:OTHERPORT  - Forward local TCP port to another host on target's network")
 	fmt.Println("    LOCALPORT:TARGET: COMMAND             - Forward local TCP port to target command")
 	fmt.Println("    :TARGET:TARGETPORT                    - Forward STDIN to target TCP port")
+	fmt.Println("    LOCALPORT:TARGET/SERVICE              - Forward local TCP port to a service offered by target")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  natter -config alice.conf 8022:bob:22")
@@ -200,6 +676,12 @@ func syntax() {
 	fmt.Println("    Forward local TCP port 8022 to TCP address 10.0.1.1:22 in bob's network,")
 	fmt.Println("    and also listen for incoming forwards")
 	fmt.Println()
+	fmt.Println("  natter -config bob.conf -listen -service ssh=127.0.0.1:22")
+	fmt.Println("    Listen for incoming forwards, and offer bob's SSH server as service \"ssh\"")
+	fmt.Println()
+	fmt.Println("  natter -config alice.conf 8022:bob/ssh")
+	fmt.Println("    Forward local TCP port 8022 to the service \"ssh\" offered by bob")
+	fmt.Println()
 	fmt.Println("  natter -id alice -broker example.com:1337 :bob: sh -c 'cat > file.txt'")
 	fmt.Println("    Forward local STDIN to remote command")
 	os.Exit(1)
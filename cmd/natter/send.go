@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"heckel.io/natter"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// sendProgressInterval limits how often the progress line of a file is updated
+const sendProgressInterval = 500 * time.Millisecond
+
+// runSend implements the send command, which transfers files and directories to a peer:
+//
+//	natter send PEER PATH ...
+func runSend(config *natter.Config, peer string, paths []string) {
+	if config.BrokerAddr == "" {
+		fmt.Println("Broker address cannot be empty.")
+		fmt.Println()
+		syntax()
+	}
+
+	config.ControlSocket = "" // Not needed for one-shot commands
+
+	client, err := natter.NewClient(config)
+	if err != nil {
+		fail(err)
+	}
+
+	// Abort on Ctrl-C; sending the same files again resumes the transfer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	var started, updated time.Time
+
+	progress := func(progress natter.SendProgress) {
+		switch {
+		case progress.Dir:
+			if progress.Done {
+				fmt.Printf("%s/\n", progress.Name)
+			}
+		case progress.Done:
+			note := ""
+			if progress.Offset == progress.Size && progress.Size > 0 {
+				note = ", already received"
+			} else if progress.Offset > 0 {
+				note = fmt.Sprintf(", resumed at %s", formatBytes(progress.Offset))
+			}
+			fmt.Printf("\r\033[K%s  %s  sha256:%s%s\n", progress.Name, formatBytes(progress.Size), progress.Checksum[:16], note)
+		case progress.Sent == progress.Offset:
+			started, updated = time.Now(), time.Now()
+		case time.Since(updated) >= sendProgressInterval:
+			updated = time.Now()
+			percent := 100 * float64(progress.Sent) / float64(progress.Size)
+			rate := float64(progress.Sent-progress.Offset) / time.Since(started).Seconds()
+			fmt.Printf("\r\033[K%s  %s / %s  %.0f%%  %s/s", progress.Name, formatBytes(progress.Sent), formatBytes(progress.Size), percent, formatBytes(int64(rate)))
+		}
+	}
+
+	start := time.Now()
+	result, err := client.Send(ctx, peer, paths, &natter.SendOptions{Progress: progress})
+	if err != nil {
+		fmt.Println()
+		fail(err)
+	}
+
+	fmt.Printf("Sent %d file(s) and %d dir(s) to %s, %s transferred in %s (%d resumed or already received)\n",
+		result.Files, result.Dirs, peer, formatBytes(result.Bytes), time.Since(start).Round(time.Millisecond), result.Resumed)
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,69 @@
+package natter
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// CompressionGzip compresses the streams of a forward with gzip, see ForwardOptions.Compression
+const CompressionGzip = "gzip"
+
+// supportedCompression returns true if this client can compress and decompress streams
+// with the given compression. Peers only agree to compressions they support.
+func supportedCompression(compression string) bool {
+	return compression == CompressionGzip
+}
+
+// compressStreams wraps the peer stream of a connection with the compression negotiated for
+// the forward (see forward.Compression), and counts the compressed bytes. The returned function
+// finishes the compressed stream, and has to be called before closing the peer stream.
+func (c *client) compressStreams(forward *forward, session *streamSession, peerStream io.ReadWriter) (io.Writer, io.Reader, func()) {
+	if forward.Compression() != CompressionGzip {
+		return peerStream, peerStream, func() {}
+	}
+
+	writer := &compressWriter{gzip.NewWriter(&countingWriter{writer: peerStream, metric: c.metrics.forwardCompressedBytes, labelValues: []string{forward.peer(c.config.ClientId), "sent"}, counter: &session.sentCompressed})}
+	reader := &decompressReader{reader: &countingReader{reader: peerStream, metric: c.metrics.forwardCompressedBytes, labelValues: []string{forward.peer(c.config.ClientId), "received"}, counter: &session.receivedCompressed}}
+
+	return writer, reader, func() { writer.Close() }
+}
+
+// compressWriter compresses everything written to it. It flushes after every write, so that
+// interactive traffic (e.g. an SSH session) is not held back until a block is full.
+type compressWriter struct {
+	gzip *gzip.Writer
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	n, err := w.gzip.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, w.gzip.Flush()
+}
+
+// Close writes the gzip footer, but does not close the underlying writer
+func (w *compressWriter) Close() error {
+	return w.gzip.Close()
+}
+
+// decompressReader decompresses the underlying reader. The gzip reader is created with the first
+// read, since creating it blocks until the header arrives, i.e. until the peer sends something.
+type decompressReader struct {
+	reader io.Reader
+	gzip   *gzip.Reader
+}
+
+func (r *decompressReader) Read(p []byte) (int, error) {
+	if r.gzip == nil {
+		reader, err := gzip.NewReader(r.reader)
+		if err != nil {
+			return 0, err
+		}
+
+		r.gzip = reader
+	}
+
+	return r.gzip.Read(p)
+}
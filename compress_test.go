@@ -0,0 +1,63 @@
+package natter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := &compressWriter{gzip.NewWriter(&compressed)}
+	data := bytes.Repeat([]byte("natter natter natter\n"), 1000)
+
+	if n, err := writer.Write(data); err != nil || n != len(data) {
+		t.Fatalf("expected %d bytes to be written, got %d, %v", len(data), n, err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if compressed.Len() >= len(data)/10 {
+		t.Errorf("expected data to compress well, got %d bytes for %d bytes", compressed.Len(), len(data))
+	}
+
+	decompressed, err := ioutil.ReadAll(&decompressReader{reader: &compressed})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(decompressed, data) {
+		t.Errorf("expected decompressed data to match, got %d bytes", len(decompressed))
+	}
+}
+
+func TestCompressFlushesEveryWrite(t *testing.T) {
+	pipeReader, pipeWriter := io.Pipe()
+	writer := &compressWriter{gzip.NewWriter(pipeWriter)}
+	reader := &decompressReader{reader: pipeReader} // Must not block before the first read
+
+	go func() {
+		for _, line := range []string{"ls\n", "exit\n"} {
+			writer.Write([]byte(line))
+			time.Sleep(10 * time.Millisecond)
+		}
+		writer.Close()
+		pipeWriter.Close()
+	}()
+
+	// Each write arrives on its own, like keystrokes in an interactive session
+	for _, expected := range []string{"ls\n", "exit\n"} {
+		buf := make([]byte, 64)
+		n, err := reader.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(buf[:n]) != expected {
+			t.Errorf("expected %q, got %q", expected, string(buf[:n]))
+		}
+	}
+
+	if _, err := reader.Read(make([]byte, 64)); err != io.EOF {
+		t.Errorf("expected EOF after close, got %v", err)
+	}
+}
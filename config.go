@@ -8,86 +8,429 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"github.com/lucas-clemente/quic-go"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
+// LoadConfig reads and validates the given config file. Files ending in .yml or .yaml are
+// read as YAML (see loadYAMLConfig), all other files in the key/value format, e.g.:
+//
+//	ClientId bob
+//	BrokerAddr heckel.io:2586
+//	Forward 8022:alice:22
+//
+// All invalid or unknown settings are reported, each prefixed with the file name and line.
 func LoadConfig(filename string) (*Config, error) {
-	raw, err := loadRawConfig(filename)
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == ".yml" || ext == ".yaml" {
+		return loadYAMLConfig(filename)
+	}
+
+	return loadKeyValueConfig(filename)
+}
+
+// configKeys lists the settings allowed in the key/value config format
+var configKeys = map[string]bool{
+	"ClientId":            true,
+	"BrokerAddr":          true,
+	"AdminAddr":           true,
+	"MetricsAddr":         true,
+	"ClusterAddr":         true,
+	"ClusterSecret":       true,
+	"RegistryDir":         true,
+	"ClientsFile":         true,
+	"RestrictClients":     true,
+	"ControlSocket":       true,
+	"Listen":              true,
+	"Forward":             true,
+	"Service":             true,
+	"AllowPeer":           true,
+	"ReceiveDir":          true,
+	"RateLimit":           true,
+	"Certificate":         true,
+	"PrivateKey":          true,
+	"CACertificate":       true,
+	"BrokerFingerprint":   true,
+	"CAPrivateKey":        true,
+	"CertificateValidity": true,
+	"EnrollToken":         true,
+}
+
+var fingerprintRegex = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+func loadKeyValueConfig(filename string) (*Config, error) {
+	errs := &configErrors{filename: filename}
+
+	raw, err := loadRawConfig(filename, errs)
 	if err != nil {
 		return nil, err
 	}
 
 	config := &Config{}
 
-	clientId, ok := raw["ClientId"]
-	if ok {
-		config.ClientId = clientId
+	if clientId, ok := raw.value("ClientId"); ok {
+		config.ClientId = clientId.value
+	}
+
+	// BrokerAddr may be repeated, further brokers are used by clients for failover
+	for i, brokerAddr := range raw["BrokerAddr"] {
+		if i == 0 {
+			config.BrokerAddr = brokerAddr.value
+		} else {
+			config.BrokerAddrs = append(config.BrokerAddrs, brokerAddr.value)
+		}
+		errs.check(brokerAddr.line, "BrokerAddr", validateConfigAddr(brokerAddr.value))
+	}
+
+	if adminAddr, ok := raw.value("AdminAddr"); ok {
+		config.AdminAddr = adminAddr.value
+		errs.check(adminAddr.line, "AdminAddr", validateConfigAddr(adminAddr.value))
+	}
+
+	if metricsAddr, ok := raw.value("MetricsAddr"); ok {
+		config.MetricsAddr = metricsAddr.value
+		errs.check(metricsAddr.line, "MetricsAddr", validateConfigAddr(metricsAddr.value))
+	}
+
+	if clusterAddr, ok := raw.value("ClusterAddr"); ok {
+		config.ClusterAddr = clusterAddr.value
+		errs.check(clusterAddr.line, "ClusterAddr", validateConfigAddr(clusterAddr.value))
+	}
+
+	if clusterSecret, ok := raw.value("ClusterSecret"); ok {
+		config.ClusterSecret = clusterSecret.value
+	}
+
+	if registryDir, ok := raw.value("RegistryDir"); ok {
+		config.RegistryDir = registryDir.value
+	}
+
+	if clientsFile, ok := raw.value("ClientsFile"); ok {
+		config.ClientsFile = clientsFile.value
+	}
+
+	if restrictClients, ok := raw.value("RestrictClients"); ok {
+		config.RestrictClients, err = parseConfigBool(restrictClients.value)
+		errs.check(restrictClients.line, "RestrictClients", err)
+	}
+
+	if controlSocket, ok := raw.value("ControlSocket"); ok {
+		config.ControlSocket = controlSocket.value
+	}
+
+	if listen, ok := raw.value("Listen"); ok {
+		config.Listen, err = parseConfigBool(listen.value)
+		errs.check(listen.line, "Listen", err)
 	}
 
-	brokerAddr, ok := raw["BrokerAddr"]
-	if ok {
-		config.BrokerAddr = brokerAddr
+	for _, forward := range raw["Forward"] {
+		fields := strings.Fields(forward.value)
+		spec, err := ParseForwardSpec(fields[0], fields[1:])
+		if errs.check(forward.line, "Forward", err) {
+			config.Forwards = append(config.Forwards, spec)
+		}
 	}
 
-	certificateFile, certificateOk := raw["Certificate"]
-	privateKeyFile, privateKeyOk := raw["PrivateKey"]
+	for _, service := range raw["Service"] {
+		fields := strings.Fields(service.value)
+		if len(fields) != 2 {
+			errs.add(service.line, "invalid Service setting, expected: Service NAME ADDR")
+			continue
+		}
+
+		if errs.check(service.line, "Service", validateConfigAddr(fields[1])) {
+			if config.Services == nil {
+				config.Services = make(map[string]string)
+			}
 
-	if certificateOk && privateKeyOk {
-		certificatePem, err := ioutil.ReadFile(certificateFile)
-		if err != nil {
-			return nil, errors.New("invalid config file, Certificate setting is invalid, cannot read file")
+			config.Services[fields[0]] = fields[1]
 		}
+	}
+
+	for _, peers := range raw["AllowPeer"] {
+		config.AllowPeers = append(config.AllowPeers, strings.FieldsFunc(peers.value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})...)
+	}
 
-		privateKeyPem, err := ioutil.ReadFile(privateKeyFile)
-		if err != nil {
-			return nil, errors.New("invalid config file, PrivateKey setting is invalid, cannot read file")
+	for _, rateLimit := range raw["RateLimit"] {
+		fields := strings.Fields(rateLimit.value)
+		if len(fields) != 2 {
+			errs.add(rateLimit.line, "invalid RateLimit setting, expected: RateLimit PEER|* RATE[:BURST]")
+			continue
 		}
 
-		keyPair, err := tls.X509KeyPair(certificatePem, privateKeyPem)
-		if err != nil {
-			return nil, errors.New("invalid config file, cannot decode certificate and/or private key")
+		limit, err := ParseRateLimit(fields[1])
+		if errs.check(rateLimit.line, "RateLimit", err) {
+			if config.RateLimits == nil {
+				config.RateLimits = make(map[string]*RateLimit)
+			}
+
+			config.RateLimits[fields[0]] = limit
 		}
+	}
+
+	if receiveDir, ok := raw.value("ReceiveDir"); ok {
+		config.ReceiveDir = receiveDir.value
+	}
+
+	if enrollToken, ok := raw.value("EnrollToken"); ok {
+		config.EnrollToken = enrollToken.value
+	}
+
+	certificateFile, certificateOk := raw.value("Certificate")
+	privateKeyFile, privateKeyOk := raw.value("PrivateKey")
+
+	// Enrolling clients store the certificate they get from the broker in these files
+	if certificateOk && privateKeyOk && config.EnrollToken != "" {
+		config.CertificateFile = certificateFile.value
+		config.PrivateKeyFile = privateKeyFile.value
+	} else if certificateOk && privateKeyOk {
+		config.TLSServerConfig, err = loadKeyPairConfig(certificateFile.value, privateKeyFile.value)
+		errs.check(certificateFile.line, "Certificate", err)
+	} else if certificateOk {
+		errs.add(certificateFile.line, "invalid Certificate setting, PrivateKey is missing")
+	} else if privateKeyOk {
+		errs.add(privateKeyFile.line, "invalid PrivateKey setting, Certificate is missing")
+	}
+
+	if caCertificateFile, ok := raw.value("CACertificate"); ok {
+		config.CAPool, err = loadCAPool(caCertificateFile.value)
+		errs.check(caCertificateFile.line, "CACertificate", err)
+	}
 
-		config.TLSServerConfig = &tls.Config{
-			Certificates:[]tls.Certificate{keyPair},
+	if caPrivateKeyFile, ok := raw.value("CAPrivateKey"); ok {
+		if caCertificateFile, ok := raw.value("CACertificate"); ok {
+			config.CAKeyPair, err = loadCAKeyPair(caCertificateFile.value, caPrivateKeyFile.value)
+			errs.check(caPrivateKeyFile.line, "CAPrivateKey", err)
+		} else {
+			errs.add(caPrivateKeyFile.line, "invalid CAPrivateKey setting, CACertificate is missing")
 		}
 	}
 
+	if certificateValidity, ok := raw.value("CertificateValidity"); ok {
+		config.CertificateValidity, err = parseConfigValidity(certificateValidity.value)
+		errs.check(certificateValidity.line, "CertificateValidity", err)
+	}
+
+	if brokerFingerprint, ok := raw.value("BrokerFingerprint"); ok {
+		config.BrokerFingerprint = brokerFingerprint.value
+		errs.check(brokerFingerprint.line, "BrokerFingerprint", validateConfigFingerprint(brokerFingerprint.value))
+	}
+
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
 
-func loadRawConfig(filename string) (map[string]string, error) {
+// rawValue is the value of a setting in the key/value config format, along
+// with the line it was found in, so that errors can point to it
+type rawValue struct {
+	value string
+	line  int
+}
+
+// rawConfig maps config keys to their values. Keys may appear multiple
+// times in the config file, e.g. Forward, so every key maps to a list.
+type rawConfig map[string][]rawValue
+
+// value returns the last value of the given key, i.e. later lines override earlier ones
+func (r rawConfig) value(key string) (rawValue, bool) {
+	values, ok := r[key]
+	if !ok || len(values) == 0 {
+		return rawValue{}, false
+	}
+
+	return values[len(values)-1], true
+}
+
+// loadRawConfig reads the key/value config file. Unknown keys and lines without
+// a value are added to errs; an error is only returned if the file cannot be read.
+func loadRawConfig(filename string, errs *configErrors) (rawConfig, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	rawconfig := make(map[string]string)
+	rawconfig := make(rawConfig)
 	scanner := bufio.NewScanner(file)
 
-	comment := regexp.MustCompile(`^\s*#`)
-	value := regexp.MustCompile(`^\s*(\S+)\s+(.*)$`)
+	comment := regexp.MustCompile(`^\s*(#|$)`)
+	value := regexp.MustCompile(`^\s*(\S+)\s+(.*\S)\s*$`)
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
 
-		if !comment.MatchString(line) {
-			parts := value.FindStringSubmatch(line)
+		if comment.MatchString(text) {
+			continue
+		}
 
-			if len(parts) == 3 {
-				rawconfig[parts[1]] = parts[2]
-			}
+		parts := value.FindStringSubmatch(text)
+		if len(parts) != 3 {
+			errs.add(line, "invalid line, expected: KEY VALUE")
+		} else if !configKeys[parts[1]] {
+			errs.add(line, "unknown setting "+parts[1])
+		} else {
+			rawconfig[parts[1]] = append(rawconfig[parts[1]], rawValue{value: parts[2], line: line})
 		}
 	}
 
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
 	return rawconfig, nil
 }
 
+// configErrors collects the validation errors of a config file, so
+// that all of them can be reported at once, each with its line
+type configErrors struct {
+	filename string
+	errors   []configError
+}
+
+type configError struct {
+	line    int
+	message string
+}
+
+// add adds an error for the given line, or for the whole file if the line is 0
+func (e *configErrors) add(line int, message string) {
+	e.errors = append(e.errors, configError{line: line, message: message})
+}
+
+// check adds the error for the given setting, if any, and returns true if there was none
+func (e *configErrors) check(line int, setting string, err error) bool {
+	if err != nil {
+		e.add(line, "invalid "+setting+" setting, "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+func (e *configErrors) err() error {
+	if len(e.errors) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(e.errors, func(i, j int) bool {
+		return e.errors[i].line < e.errors[j].line
+	})
+
+	messages := make([]string, 0, len(e.errors))
+	for _, err := range e.errors {
+		if err.line > 0 {
+			messages = append(messages, fmt.Sprintf("%s:%d: %s", e.filename, err.line, err.message))
+		} else {
+			messages = append(messages, fmt.Sprintf("%s: %s", e.filename, err.message))
+		}
+	}
+
+	return errors.New(strings.Join(messages, "\n"))
+}
+
+// validateConfigAddr checks that the address is a valid [host]:port address
+func validateConfigAddr(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return errors.New("expected [HOST]:PORT, got " + addr)
+	}
+
+	return nil
+}
+
+func loadKeyPairConfig(certificateFile string, privateKeyFile string) (*tls.Config, error) {
+	certificatePem, err := ioutil.ReadFile(certificateFile)
+	if err != nil {
+		return nil, errors.New("cannot read certificate file: " + err.Error())
+	}
+
+	privateKeyPem, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, errors.New("cannot read private key file: " + err.Error())
+	}
+
+	keyPair, err := tls.X509KeyPair(certificatePem, privateKeyPem)
+	if err != nil {
+		return nil, errors.New("cannot decode certificate and/or private key: " + err.Error())
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+	}, nil
+}
+
+// loadCAPool reads the PEM encoded CA certificates from the given file
+func loadCAPool(caCertificateFile string) (*x509.CertPool, error) {
+	caCertificatePem, err := ioutil.ReadFile(caCertificateFile)
+	if err != nil {
+		return nil, errors.New("cannot read CA certificate file: " + err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCertificatePem) {
+		return nil, errors.New("cannot decode CA certificate, expected PEM encoded certificates")
+	}
+
+	return pool, nil
+}
+
+// loadCAKeyPair reads the PEM encoded CA certificate and its private key, which the broker
+// uses to sign the certificates of enrolling clients. If the file contains several CA
+// certificates, the first one must belong to the private key.
+func loadCAKeyPair(caCertificateFile string, caPrivateKeyFile string) (*tls.Certificate, error) {
+	config, err := loadKeyPairConfig(caCertificateFile, caPrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &config.Certificates[0], nil
+}
+
+// parseConfigValidity parses the validity of certificates signed by the broker, e.g. 720h
+func parseConfigValidity(value string) (time.Duration, error) {
+	validity, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.New("expected duration, e.g. 720h, got " + value)
+	} else if validity < time.Minute {
+		return 0, errors.New("validity must be at least 1m, got " + value)
+	}
+
+	return validity, nil
+}
+
+// validateConfigFingerprint checks that the fingerprint is a hex encoded SHA-256 hash
+func validateConfigFingerprint(fingerprint string) error {
+	if !fingerprintRegex.MatchString(fingerprint) {
+		return errors.New("expected 64 hex characters, got " + fingerprint)
+	}
+
+	return nil
+}
+
+func parseConfigBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "true", "on", "1":
+		return true, nil
+	case "no", "false", "off", "0":
+		return false, nil
+	default:
+		return false, errors.New("expected yes or no, got " + value)
+	}
+}
+
 func generateDefaultQuicConfig() *quic.Config {
 	return &quic.Config{
 		KeepAlive:          true,
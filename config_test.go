@@ -0,0 +1,107 @@
+package natter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigValid(t *testing.T) {
+	tests := []struct {
+		filename string
+		content  string
+	}{
+		{"natter.conf", "# Broker\nBrokerAddr :2586\nClientsFile /tmp/clients.json\n\nCertificateValidity 720h\n"},
+		{"natter.yml", "broker:\n  addr: :2586\n  clients: /tmp/clients.json\ntls:\n  validity: 720h\n"},
+	}
+
+	for _, test := range tests {
+		config, _, err := loadTestConfig(t, test.filename, test.content)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.filename, err)
+			continue
+		}
+
+		if config.BrokerAddr != ":2586" || config.ClientsFile != "/tmp/clients.json" || config.CertificateValidity != 720*time.Hour {
+			t.Errorf("%s: unexpected config %+v", test.filename, config)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		filename string
+		content  string
+		expected []string // Prefixes of the error lines, after the file name
+	}{
+		{"natter.conf", "BrokerAddr :2586\nBrokerAdr :2586\n", []string{
+			":2: unknown setting BrokerAdr",
+		}},
+		{"natter.conf", "# Comment\nClientId\n", []string{
+			":2: invalid line, expected: KEY VALUE",
+		}},
+		{"natter.conf", "BrokerAddr nope\n\nCertificateValidity 1s\nListen maybe\n", []string{
+			":1: invalid BrokerAddr setting",
+			":3: invalid CertificateValidity setting",
+			":4: invalid Listen setting",
+		}},
+		{"natter.conf", "BrokerFingerprint abc\nUnknown 1\n", []string{
+			":1: invalid BrokerFingerprint setting",
+			":2: unknown setting Unknown",
+		}},
+		{"natter.yml", "broker:\n  addr: :2586\n  adr: :2586\n", []string{
+			":3: field adr not found",
+		}},
+		{"natter.yml", "broker:\n  addr: :2586\ntls:\n  validity: soon\n", []string{
+			":4: invalid tls.validity setting",
+		}},
+		{"natter.yml", "broker:\n  addr: nope\n  admin: :8080\ntls:\n  validity: 1s\n", []string{
+			":2: invalid broker.addr setting",
+			":5: invalid tls.validity setting",
+		}},
+		{"natter.yml", "broker:\n  restrict: maybe\n", []string{
+			":2: cannot unmarshal",
+		}},
+	}
+
+	for _, test := range tests {
+		_, filename, err := loadTestConfig(t, test.filename, test.content)
+		if err == nil {
+			t.Errorf("%s %q: expected error", test.filename, test.content)
+			continue
+		}
+
+		lines := strings.Split(err.Error(), "\n")
+		if len(lines) != len(test.expected) {
+			t.Errorf("%s %q: expected %d errors, got: %s", test.filename, test.content, len(test.expected), err)
+			continue
+		}
+
+		for i, line := range lines {
+			if !strings.HasPrefix(line, filename+test.expected[i]) {
+				t.Errorf("%s %q: expected error %q, got %q", test.filename, test.content, filename+test.expected[i], line)
+			}
+		}
+	}
+}
+
+// loadTestConfig writes the config to a temporary file and loads it. The
+// file is removed again, so only the file name is returned, for error messages.
+func loadTestConfig(t *testing.T, name string, content string) (*Config, string, error) {
+	dir, err := ioutil.TempDir("", "natter-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(filename)
+	return config, filename, err
+}
@@ -0,0 +1,348 @@
+package natter
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// yamlConfig is the structure of the YAML config format, e.g.:
+//
+//	broker:
+//	  addr: heckel.io:2586
+//	  addrs: [heckel.de:2586]
+//	  cluster: broker1.heckel.io:2586
+//	  secret: s3cr3t
+//	  registry: /mnt/shared/natter
+//	  clients: /var/lib/natter/clients.json
+//	  restrict: true
+//	  fingerprint: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	client:
+//	  id: bob
+//	  listen: true
+//	  control: /run/user/1000/natter.sock
+//	  enroll: 4fZq8xTbN2kLw7Rc
+//	forwards:
+//	  - 8022:alice:22
+//	  - spec: "9000:alice:"
+//	    command: [zfs, recv, pool]
+//	    limit: 10M
+//	    compression: gzip
+//	services:
+//	  ssh: 127.0.0.1:22
+//	acl:
+//	  allow: [alice, carol]
+//	limits:
+//	  alice: 1M:4M
+//	  "*": 512K
+//	tls:
+//	  certificate: /etc/natter/bob.pem
+//	  key: /etc/natter/bob.key
+//	  ca: /etc/natter/ca.pem
+//	  cakey: /etc/natter/ca.key
+//	  validity: 720h
+type yamlConfig struct {
+	Broker struct {
+		Addr        string   `yaml:"addr"`
+		Addrs       []string `yaml:"addrs"`
+		Admin       string   `yaml:"admin"`
+		Cluster     string   `yaml:"cluster"`
+		Secret      string   `yaml:"secret"`
+		Registry    string   `yaml:"registry"`
+		Clients     string   `yaml:"clients"`
+		Restrict    bool     `yaml:"restrict"`
+		Fingerprint string   `yaml:"fingerprint"`
+	} `yaml:"broker"`
+
+	Client struct {
+		Id      string `yaml:"id"`
+		Listen  bool   `yaml:"listen"`
+		Control string `yaml:"control"`
+		Receive string `yaml:"receive"`
+		Enroll  string `yaml:"enroll"`
+	} `yaml:"client"`
+
+	Metrics  string            `yaml:"metrics"`
+	Forwards []yamlForward     `yaml:"forwards"`
+	Services map[string]string `yaml:"services"`
+
+	ACL struct {
+		Allow []string `yaml:"allow"`
+	} `yaml:"acl"`
+
+	Limits map[string]string `yaml:"limits"`
+
+	TLS struct {
+		Certificate string `yaml:"certificate"`
+		Key         string `yaml:"key"`
+		CA          string `yaml:"ca"`
+		CAKey       string `yaml:"cakey"`
+		Validity    string `yaml:"validity"`
+	} `yaml:"tls"`
+}
+
+// yamlForward is a forward in the YAML config format. It is either a forward spec
+// (see ParseForwardSpec), or a mapping with the spec, the target command, the rate limit and the compression.
+type yamlForward struct {
+	Spec        string
+	Command     []string
+	Limit       string
+	Compression string
+	line        int
+}
+
+func (f *yamlForward) UnmarshalYAML(node *yaml.Node) error {
+	f.line = node.Line
+
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&f.Spec)
+	} else if node.Kind != yaml.MappingNode {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: forward must be a spec or a mapping with spec, command, limit and compression", node.Line)}}
+	}
+
+	// Decoding via the node does not reject unknown fields, so check them here
+	for i := 0; i < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if key.Value != "spec" && key.Value != "command" && key.Value != "limit" && key.Value != "compression" {
+			return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: field %s not found in forward", key.Line, key.Value)}}
+		}
+	}
+
+	var forward struct {
+		Spec        string   `yaml:"spec"`
+		Command     []string `yaml:"command"`
+		Limit       string   `yaml:"limit"`
+		Compression string   `yaml:"compression"`
+	}
+
+	if err := node.Decode(&forward); err != nil {
+		return err
+	}
+
+	f.Spec = forward.Spec
+	f.Command = forward.Command
+	f.Limit = forward.Limit
+	f.Compression = forward.Compression
+
+	return nil
+}
+
+var (
+	yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	yamlErrorType = regexp.MustCompile(` in type .*$`)
+)
+
+// loadYAMLConfig reads the config file in the YAML format (see yamlConfig). Unknown
+// fields are rejected, and all errors are reported with the file name and line.
+func loadYAMLConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := &configErrors{filename: filename}
+
+	var root yaml.Node
+	var raw yamlConfig
+
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		errs.addYAML(err)
+		return nil, errs.err()
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	// Type errors do not stop the decoder, so the remaining settings are still validated
+	if err := decoder.Decode(&raw); err != nil && err != io.EOF {
+		errs.addYAML(err)
+		if _, ok := err.(*yaml.TypeError); !ok {
+			return nil, errs.err()
+		}
+	}
+
+	config := &Config{
+		ClientId:          raw.Client.Id,
+		BrokerAddr:        raw.Broker.Addr,
+		BrokerAddrs:       raw.Broker.Addrs,
+		AdminAddr:         raw.Broker.Admin,
+		MetricsAddr:       raw.Metrics,
+		ClusterAddr:       raw.Broker.Cluster,
+		ClusterSecret:     raw.Broker.Secret,
+		RegistryDir:       raw.Broker.Registry,
+		ClientsFile:       raw.Broker.Clients,
+		RestrictClients:   raw.Broker.Restrict,
+		BrokerFingerprint: raw.Broker.Fingerprint,
+		ControlSocket:     raw.Client.Control,
+		ReceiveDir:        raw.Client.Receive,
+		EnrollToken:       raw.Client.Enroll,
+		Listen:            raw.Client.Listen,
+		AllowPeers:        raw.ACL.Allow,
+	}
+
+	if config.BrokerAddr != "" {
+		errs.check(yamlLine(&root, "broker", "addr"), "broker.addr", validateConfigAddr(config.BrokerAddr))
+	}
+
+	for _, addr := range config.BrokerAddrs {
+		errs.check(yamlLine(&root, "broker", "addrs"), "broker.addrs", validateConfigAddr(addr))
+	}
+
+	if config.AdminAddr != "" {
+		errs.check(yamlLine(&root, "broker", "admin"), "broker.admin", validateConfigAddr(config.AdminAddr))
+	}
+
+	if config.ClusterAddr != "" {
+		errs.check(yamlLine(&root, "broker", "cluster"), "broker.cluster", validateConfigAddr(config.ClusterAddr))
+	}
+
+	if config.BrokerFingerprint != "" {
+		errs.check(yamlLine(&root, "broker", "fingerprint"), "broker.fingerprint", validateConfigFingerprint(config.BrokerFingerprint))
+	}
+
+	if config.MetricsAddr != "" {
+		errs.check(yamlLine(&root, "metrics"), "metrics", validateConfigAddr(config.MetricsAddr))
+	}
+
+	for _, forward := range raw.Forwards {
+		spec, err := ParseForwardSpec(forward.Spec, forward.Command)
+		if !errs.check(forward.line, "forward", err) {
+			continue
+		}
+
+		if forward.Limit != "" {
+			spec.RateLimit, err = ParseRateLimit(forward.Limit)
+			if !errs.check(forward.line, "forward", err) {
+				continue
+			}
+		}
+
+		if forward.Compression != "" && !supportedCompression(forward.Compression) {
+			errs.add(forward.line, "invalid forward setting, unsupported compression "+forward.Compression)
+			continue
+		}
+
+		spec.Compression = forward.Compression
+		config.Forwards = append(config.Forwards, spec)
+	}
+
+	for name, addr := range raw.Services {
+		if errs.check(yamlLine(&root, "services", name), "service "+name, validateConfigAddr(addr)) {
+			if config.Services == nil {
+				config.Services = make(map[string]string)
+			}
+
+			config.Services[name] = addr
+		}
+	}
+
+	for peer, rate := range raw.Limits {
+		limit, err := ParseRateLimit(rate)
+		if errs.check(yamlLine(&root, "limits", peer), "limit "+peer, err) {
+			if config.RateLimits == nil {
+				config.RateLimits = make(map[string]*RateLimit)
+			}
+
+			config.RateLimits[peer] = limit
+		}
+	}
+
+	for _, peer := range raw.ACL.Allow {
+		if peer == "" {
+			errs.add(yamlLine(&root, "acl", "allow"), "invalid acl.allow setting, peer cannot be empty")
+		}
+	}
+
+	if raw.TLS.Certificate != "" || raw.TLS.Key != "" {
+		if raw.TLS.Certificate == "" || raw.TLS.Key == "" {
+			errs.add(yamlLine(&root, "tls"), "invalid tls setting, both certificate and key are required")
+		} else if config.EnrollToken != "" {
+			// Enrolling clients store the certificate they get from the broker in these files
+			config.CertificateFile = raw.TLS.Certificate
+			config.PrivateKeyFile = raw.TLS.Key
+		} else {
+			config.TLSServerConfig, err = loadKeyPairConfig(raw.TLS.Certificate, raw.TLS.Key)
+			errs.check(yamlLine(&root, "tls", "certificate"), "tls.certificate", err)
+		}
+	}
+
+	if raw.TLS.CA != "" {
+		config.CAPool, err = loadCAPool(raw.TLS.CA)
+		errs.check(yamlLine(&root, "tls", "ca"), "tls.ca", err)
+	}
+
+	if raw.TLS.CAKey != "" {
+		if raw.TLS.CA == "" {
+			errs.add(yamlLine(&root, "tls", "cakey"), "invalid tls setting, cakey requires ca")
+		} else {
+			config.CAKeyPair, err = loadCAKeyPair(raw.TLS.CA, raw.TLS.CAKey)
+			errs.check(yamlLine(&root, "tls", "cakey"), "tls.cakey", err)
+		}
+	}
+
+	if raw.TLS.Validity != "" {
+		config.CertificateValidity, err = parseConfigValidity(raw.TLS.Validity)
+		errs.check(yamlLine(&root, "tls", "validity"), "tls.validity", err)
+	}
+
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// addYAML adds the errors returned by the YAML decoder, which contain the
+// line ("line 3: ..."), but not the file name
+func (e *configErrors) addYAML(err error) {
+	messages := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	}
+
+	for _, message := range messages {
+		message = yamlErrorType.ReplaceAllString(message, "")
+		parts := yamlErrorLine.FindStringSubmatch(message)
+
+		if len(parts) == 3 {
+			line, _ := strconv.Atoi(parts[1])
+			e.add(line, parts[2])
+		} else {
+			e.add(0, strings.TrimPrefix(message, "yaml: "))
+		}
+	}
+}
+
+// yamlLine returns the line of the value at the given path of mapping keys,
+// or the line of the closest parent that exists
+func yamlLine(node *yaml.Node, path ...string) int {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line := node.Line
+	for _, key := range path {
+		found := false
+
+		for i := 0; node.Kind == yaml.MappingNode && i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				node = node.Content[i+1]
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			break
+		}
+
+		line = node.Line
+	}
+
+	return line
+}
@@ -0,0 +1,154 @@
+package natter
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies what happened in an Event.
+type EventType int
+
+const (
+	// EventBrokerConnected is fired by a client when it successfully checked in with a broker.
+	// The event's Addr is the broker address.
+	EventBrokerConnected = EventType(iota + 1)
+
+	// EventBrokerDisconnected is fired by a client when the connection to a broker is lost.
+	EventBrokerDisconnected
+
+	// EventForwardRequested is fired by a client when a peer requests a forward to it,
+	// and by the broker when it receives a forward request from a client.
+	EventForwardRequested
+
+	// EventForwardAccepted is fired by a client when a peer accepted its forward request.
+	EventForwardAccepted
+
+	// EventForwardRejected is fired by a client when its forward request was rejected,
+	// either by the broker or by the peer.
+	EventForwardRejected
+
+	// EventPeerConnected is fired by a client when the hole punch succeeded, i.e. when a
+	// QUIC session to or from a peer was established.
+	EventPeerConnected
+
+	// EventStreamOpened is fired by a client when a stream to or from a peer was opened.
+	EventStreamOpened
+
+	// EventStreamClosed is fired by a client when a stream to or from a peer was closed.
+	EventStreamClosed
+
+	// EventClientConnected is fired by the broker when a client checked in for the first time.
+	EventClientConnected
+
+	// EventClientDisconnected is fired by the broker when a client disconnected, or was evicted.
+	EventClientDisconnected
+
+	// EventForwardFinished is fired by the broker when a forward request was answered, rejected
+	// or expired. The outcome is stored in the event's Outcome field.
+	EventForwardFinished
+
+	// EventPeerOnline is fired by a client when a watched peer came online (see Client.WatchPeer).
+	EventPeerOnline
+
+	// EventPeerOffline is fired by a client when a watched peer went away (see Client.WatchPeer).
+	EventPeerOffline
+)
+
+var eventTypeNames = map[EventType]string{
+	EventBrokerConnected:    "BrokerConnected",
+	EventBrokerDisconnected: "BrokerDisconnected",
+	EventForwardRequested:   "ForwardRequested",
+	EventForwardAccepted:    "ForwardAccepted",
+	EventForwardRejected:    "ForwardRejected",
+	EventPeerConnected:      "PeerConnected",
+	EventStreamOpened:       "StreamOpened",
+	EventStreamClosed:       "StreamClosed",
+	EventClientConnected:    "ClientConnected",
+	EventClientDisconnected: "ClientDisconnected",
+	EventForwardFinished:    "ForwardFinished",
+	EventPeerOnline:         "PeerOnline",
+	EventPeerOffline:        "PeerOffline",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+
+	return "Unknown"
+}
+
+// Event describes something that happened in a client or broker. Depending on
+// the event type, only some of the fields are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Client is the ID of the peer (for client events), or the ID of
+	// the client the event relates to (for broker events).
+	Client string
+
+	// Forward is the forward ID, if the event relates to a forward.
+	Forward string
+
+	// Addr is the UDP address of the peer, client or broker.
+	Addr string
+
+	// Stream is the QUIC stream ID for stream events.
+	Stream int64
+
+	// Outcome is the result of a forward request (broker only), e.g. "accepted" or "expired".
+	Outcome string
+
+	// Err is the error that caused the event, if any.
+	Err error
+}
+
+// EventHandler is a callback for events. Handlers are called synchronously, in the
+// goroutine that fired the event. They must not block, and must not call back into the
+// client or broker; if necessary, they should hand off the work to another goroutine.
+type EventHandler func(event Event)
+
+type eventBus struct {
+	handlers map[int]EventHandler
+	nextId   int
+
+	mutex sync.RWMutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		handlers: make(map[int]EventHandler),
+	}
+}
+
+func (e *eventBus) subscribe(handler EventHandler) func() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	id := e.nextId
+	e.handlers[id] = handler
+	e.nextId++
+
+	return func() {
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+
+		delete(e.handlers, id)
+	}
+}
+
+func (e *eventBus) publish(event Event) {
+	event.Time = time.Now()
+
+	e.mutex.RLock()
+	handlers := make([]EventHandler, 0, len(e.handlers))
+	for _, handler := range e.handlers {
+		handlers = append(handlers, handler)
+	}
+	e.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
@@ -1,9 +1,12 @@
 package natter
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"github.com/lucas-clemente/quic-go"
 	"net"
+	"time"
 )
 
 // Client represents a natter client. It can be used to listen for
@@ -30,14 +33,279 @@ type Client interface {
 	// e.g. []string { "zfs", "recv" } or []string{ "sh", "-c", "cat > hello.txt" }.
 	// If targetCommand is set, targetForwardAddr is ignored.
 	Forward(localAddr string, target string, targetForwardAddr string, targetCommand []string) (Forward, error)
+
+	// ForwardService requests a forward connection to a named service on another client,
+	// e.g. "ssh". The target client must advertise the service, see Config.Services.
+	// localAddr is the local TCP [address]:port, or empty to read from STDIN (see Forward).
+	ForwardService(localAddr string, target string, service string) (Forward, error)
+
+	// ForwardWithOptions is like Forward, but allows passing additional options, see
+	// ForwardOptions. If options is nil, it behaves exactly like Forward.
+	ForwardWithOptions(localAddr string, target string, targetForwardAddr string, targetCommand []string, options *ForwardOptions) (Forward, error)
+
+	// Forwards returns the outgoing forwards of this client that have not been closed, no matter
+	// if they were created via Forward, ForwardService, ForwardWithOptions or the control API.
+	Forwards() []Forward
+
+	// DialPeer connects to a named service on another client, and returns the connection
+	// as a net.Conn. The target client must listen for the service via ListenPeer.
+	// The context can be used to cancel the connection attempt, e.g. with a timeout.
+	DialPeer(ctx context.Context, target string, service string) (net.Conn, error)
+
+	// ListenPeer listens for connections from other clients to the named service, e.g. "grpc".
+	// It implies Listen. Connections from peers are returned by the listener's Accept method.
+	ListenPeer(service string) (net.Listener, error)
+
+	// Peers asks the broker for the list of connected clients, along with the services
+	// they offer. Only clients that allow connections from this client are returned
+	// (see AllowPeers below).
+	Peers(ctx context.Context) ([]*Peer, error)
+
+	// Ping connects to the given peer like DialPeer does, and sends a few probes to measure
+	// the round trip time. The result describes the path to the peer, i.e. the addresses and
+	// NAT types as seen by the broker, how long brokering and the handshake took, and the
+	// RTT of every probe. The peer must be listening (see Listen). Canceling the context
+	// stops sending probes and returns the samples collected so far.
+	Ping(ctx context.Context, peer string) (*PingResult, error)
+
+	// Bench measures the cost of connecting to a peer, and the upload and download throughput
+	// to it, using 1, 2, 4, ... parallel streams on the same connection (see BenchOptions). Like
+	// Ping, it only needs the peer to be listening. Canceling the context stops the benchmark
+	// and returns the results collected so far.
+	Bench(ctx context.Context, peer string, options *BenchOptions) (*BenchResult, error)
+
+	// Share creates a single-use invite to the given TCP address on this client (e.g. :22), which
+	// expires after the given time (zero means the broker's default). The returned code contains
+	// a token that the broker maps to this client and address, and a secret that only this client
+	// knows. A peer that joins via the code (see Join) does not need to be in AllowPeers, but
+	// both sides prove that they know the secret before any data is forwarded.
+	Share(ctx context.Context, targetForwardAddr string, ttl time.Duration) (*Invite, error)
+
+	// Join redeems an invite code created via Share, and forwards the given local TCP address
+	// to the shared address. It returns once the peer accepted the forward.
+	Join(ctx context.Context, localAddr string, code string) (Forward, error)
+
+	// Send transfers the given files and directories (recursively) to a peer that receives
+	// files (see Config.ReceiveDir). Every file is verified via its SHA-256 checksum. If a
+	// transfer is interrupted, sending the same files again resumes where it left off, and
+	// files that the peer already has are skipped. Canceling the context aborts the transfer.
+	Send(ctx context.Context, peer string, paths []string, options *SendOptions) (*SendResult, error)
+
+	// WatchPeer subscribes to presence updates for the given peer. When the peer comes
+	// online or goes away, EventPeerOnline or EventPeerOffline is fired (see Subscribe).
+	// If the peer is online already, EventPeerOnline is fired right away.
+	WatchPeer(peer string) error
+
+	// UnwatchPeer stops the presence updates for the given peer.
+	UnwatchPeer(peer string) error
+
+	// SetServices replaces the named services this client offers (see Config.Services), and
+	// advertises them to the broker. Established connections to removed services keep running.
+	SetServices(services map[string]string) error
+
+	// SetRateLimits replaces the rate limits for connections from peers to this client (see
+	// Config.RateLimits). Connections that are already established pick up the new limits.
+	SetRateLimits(limits map[string]*RateLimit) error
+
+	// SetAllowPeers replaces the list of peers that are allowed to connect to this client
+	// (see Config.AllowPeers), and advertises it to the broker.
+	SetAllowPeers(allowPeers []string) error
+
+	// Subscribe registers a handler that is called for every event of the client,
+	// e.g. when it connected to the broker, or when a peer requested a forward.
+	// It returns a function that removes the handler again.
+	Subscribe(handler EventHandler) func()
 }
 
 type Broker interface {
 	ListenAndServe() error
+
+	// Subscribe registers a handler that is called for every event of the broker,
+	// e.g. when a client connected or a forward was brokered.
+	// It returns a function that removes the handler again.
+	Subscribe(handler EventHandler) func()
 }
 
 type Forward interface {
 	PeerUdpAddr() *net.UDPAddr
+
+	// Close removes the forward and stops listening on its local TCP address.
+	// Connections that are already established keep running.
+	Close() error
+
+	// SetRateLimit changes the rate limit of the forward (see ForwardOptions.RateLimit).
+	// It also applies to connections that are already established. Nil removes the limit.
+	SetRateLimit(limit *RateLimit)
+
+	// RateLimit returns the current rate limit of the forward, or nil if it is not limited.
+	RateLimit() *RateLimit
+
+	// Compression returns the compression the peer agreed to (see ForwardOptions.Compression),
+	// or an empty string if the streams of the forward are not compressed.
+	Compression() string
+
+	// Spec returns the spec of the forward, along with its current rate limit and the compression
+	// it requested (see ForwardSpec). Its String method identifies the forward, e.g. 8022:bob:22.
+	Spec() *ForwardSpec
+}
+
+// ForwardOptions defines additional options for a forward, see Client.ForwardWithOptions.
+type ForwardOptions struct {
+	// Service is the name of a service offered by the target client, e.g. ssh.
+	// If it is set, targetForwardAddr and targetCommand are ignored.
+	Service string
+
+	// WaitForPeer keeps the forward around if it is rejected, e.g. because the target
+	// client is offline, and automatically retries it when the target comes online.
+	WaitForPeer bool
+
+	// RateLimit limits the throughput of all connections of this forward, see Forward.SetRateLimit.
+	// If it is nil, the forward is not limited.
+	RateLimit *RateLimit
+
+	// Compression compresses the streams of this forward, if the peer supports it. Currently only
+	// CompressionGzip is available. This is worth it for compressible data on slow links, e.g. logs
+	// or database dumps, but a waste of CPU for data that is already compressed.
+	Compression string
+}
+
+// Peer describes a client connected to the broker, as returned by Client.Peers.
+type Peer struct {
+	// Client identifier of the peer, e.g. bob
+	Id string
+
+	// NAT type of the peer, as guessed by the broker, e.g. port-preserving
+	NatType string
+
+	// Names of the services the peer offers, e.g. ssh
+	Services []string
+}
+
+// PingResult describes the path to a peer and the probes sent to it, see Client.Ping.
+type PingResult struct {
+	// Client identifier of the peer, e.g. bob
+	Peer string
+
+	// Local UDP address of this client, and the address the broker sees it as
+	LocalAddr  string
+	PublicAddr string
+
+	// NAT type of this client, as guessed by the broker, e.g. port-preserving
+	NatType string
+
+	// Address of the peer that was used to connect, i.e. the address the broker sees it as,
+	// and the peer's local UDP address (which is only reachable in the same network)
+	PeerAddr      string
+	PeerLocalAddr string
+
+	// NAT type of the peer, as guessed by the broker
+	PeerNatType string
+
+	// Time it took the broker to broker the connection, and the QUIC handshake with the peer
+	BrokerDuration    time.Duration
+	HandshakeDuration time.Duration
+
+	// Probes sent to the peer, in order
+	Samples []PingSample
+}
+
+// PingSample is a single probe sent to a peer, see PingResult.
+type PingSample struct {
+	Seq  int
+	RTT  time.Duration
+	Lost bool
+}
+
+// BenchOptions configures a benchmark, see Client.Bench. Zero values mean defaults.
+type BenchOptions struct {
+	// Maximum number of parallel streams. Throughput is measured with 1, 2, 4, ... streams,
+	// up to and including this number. Default: 1, maximum: 64
+	Streams int
+
+	// Duration of each upload and download run. Default: 5s, maximum: 1m
+	Duration time.Duration
+
+	// Number of connections to establish to measure the handshake cost. The last one is
+	// used for the throughput runs. Default: 3
+	Handshakes int
+}
+
+// BenchResult contains the connection cost and throughput runs of a benchmark, see Client.Bench.
+type BenchResult struct {
+	// Client identifier of the peer, e.g. bob
+	Peer string
+
+	// Time it took to broker each connection and to complete its QUIC handshake
+	Handshakes []BenchHandshake
+
+	// Upload and download runs, in order of increasing number of streams
+	Runs []BenchRun
+}
+
+// BenchHandshake is the cost of a single connection to a peer, see BenchResult.
+type BenchHandshake struct {
+	Broker    time.Duration
+	Handshake time.Duration
+}
+
+// BenchRun is a single upload or download run, see BenchResult. For uploads, only
+// bytes that were received by the peer are counted.
+type BenchRun struct {
+	Streams  int
+	Upload   bool
+	Bytes    int64
+	Duration time.Duration
+}
+
+// Throughput returns the throughput of the run in bytes per second
+func (r BenchRun) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+// Invite is a single-use invite created via Client.Share.
+type Invite struct {
+	// Code to pass to Client.Join, e.g. kq3ndx7a-4gh2mwr8tz9p
+	Code string
+
+	// Time at which the invite expires, if it was not used
+	Expires time.Time
+}
+
+// SendOptions configures a file transfer, see Client.Send.
+type SendOptions struct {
+	// Called when a file or directory is started, whenever data was sent, and when
+	// it is done. It is called from the sending goroutine, so it should not block.
+	Progress func(progress SendProgress)
+}
+
+// SendProgress describes the transfer of a single file or directory, see SendOptions.
+type SendProgress struct {
+	// Relative name of the file, as it is created on the peer, e.g. photos/2019/cat.jpg
+	Name string
+	Dir  bool
+
+	// Size of the file, the offset at which the transfer was resumed (or the size,
+	// if the peer already had the file), and the bytes sent so far (including the offset)
+	Size   int64
+	Offset int64
+	Sent   int64
+
+	// Hex encoded SHA-256 checksum of the file
+	Checksum string
+
+	// True if the file was received and verified by the peer
+	Done bool
+}
+
+// SendResult summarizes a file transfer, see Client.Send.
+type SendResult struct {
+	Files   int   // Files sent, including skipped and resumed files
+	Dirs    int   // Directories created
+	Resumed int   // Files that were resumed, or that the peer already had
+	Bytes   int64 // Bytes actually transferred
 }
 
 // Config defines the configuration for a natter client or broker.
@@ -50,16 +318,137 @@ type Config struct {
 	// the two peers. Example: heckel.io:2568
 	BrokerAddr string
 
+	// Hostnames and ports of further brokers (client only). The client checks in with all brokers,
+	// and sends its requests to the first one it is connected to, i.e. BrokerAddr if it is up. If a
+	// broker rejects a forward, e.g. because the target is not connected to it, the next broker is
+	// tried. Example: []string{"broker2.heckel.io:2568"}
+	BrokerAddrs []string
+
+	// Address and port of the broker's admin HTTP API, which allows inspecting
+	// connected clients and forwards (broker only). Example: 127.0.0.1:8080
+	// The API is not authenticated, so other hosts can only use it read-only.
+	// If it is empty, the admin API is disabled.
+	AdminAddr string
+
+	// Address and port under which other brokers of the cluster reach this broker (broker only).
+	// It is stored in the registry for each client, see Registry. Example: broker1.heckel.io:2568
+	// If it is empty, BrokerAddr is used, which is fine if there is only one broker. If it is set,
+	// ClusterSecret and CAPool or BrokerFingerprint must be set, too.
+	ClusterAddr string
+
+	// Secret shared by all brokers of a cluster (broker only). Brokers prove to each other that
+	// they know it before relaying forward requests, by answering a challenge of the other broker.
+	// Required if ClusterAddr is set.
+	ClusterSecret string
+
+	// Registry that is shared by all brokers of a cluster (broker only), see NewFileRegistry.
+	// If it is nil, a registry in memory is used, i.e. the broker is on its own.
+	Registry Registry
+
+	// Directory of a file registry shared by all brokers of a cluster (broker only), e.g. on a
+	// network file system. It is ignored if Registry is set. Example: /var/lib/natter/registry
+	RegistryDir string
+
+	// File in which the broker keeps the clients it knows (broker only), i.e. clients registered
+	// via the admin API, along with their public key, groups, and when and from where they
+	// were last seen, as well as revoked client IDs. If it is empty, known clients are only kept
+	// in memory. Clients registered with a public key must sign their check-ins with it, i.e. have
+	// a certificate for the key, issued to their client ID, see TLSServerConfig.
+	// Example: /var/lib/natter/clients.json
+	ClientsFile string
+
+	// If true, only registered clients may connect to the broker (broker only), see ClientsFile.
+	RestrictClients bool
+
+	// Address and port of the HTTP endpoint that exposes Prometheus metrics
+	// at /metrics. Example: 127.0.0.1:9100
+	// If it is empty, no metrics endpoint is started.
+	MetricsAddr string
+
+	// Path of the Unix socket for the control API (client only), which allows inspecting
+	// and changing the forwards of a running client, see the natter status command.
+	// Example: /run/user/1000/natter.sock
+	// The socket is only accessible by the current user. If it is empty, the control API is disabled.
+	ControlSocket string
+
+	// Listen for incoming forwards from other clients (client only). This and Forwards
+	// are declarative: they are read from the config file and applied by the natter CLI.
+	// Library users call Client.Listen and Client.ForwardWithOptions themselves.
+	Listen bool
+
+	// Forwards to other clients (client only), see ParseForwardSpec for the syntax
+	// used in the config file. Example: 8022:bob:22
+	Forwards []*ForwardSpec
+
+	// Named services this client offers to other clients (client only). The key is
+	// the service name, the value is the TCP [address]:port connections to the service
+	// are forwarded to. Services are advertised to the broker when checking in.
+	// Example: map[string]string{"ssh": "127.0.0.1:22", "db": "10.0.0.5:5432"}
+	Services map[string]string
+
+	// Client identifiers of the peers that are allowed to connect to this client
+	// (client only). The list is advertised to the broker, which hides this client
+	// from other peers and rejects their forwards. If it is empty, all peers are allowed.
+	// Example: []string{"alice", "carol"}
+	AllowPeers []string
+
+	// Rate limits for connections from peers to this client, by client ID of the peer
+	// (client only). Each peer is limited separately, across all of its connections.
+	// The limit for "*" applies to all peers that are not listed.
+	// Example: map[string]*RateLimit{"alice": {BytesPerSecond: 1048576}}
+	RateLimits map[string]*RateLimit
+
+	// Directory in which files sent by peers are stored (client only, see Client.Send).
+	// If it is empty, this client does not accept files. Example: /srv/natter
+	ReceiveDir string
+
+	// CA certificates for mutual authentication between clients and broker. If it is set, clients
+	// only connect to a broker whose certificate is signed by one of these CAs and valid for the
+	// broker's hostname, and the broker only accepts check-ins of clients that prove to own a
+	// certificate signed by one of them whose common name is the client ID. A client's certificate
+	// is the first certificate in TLSServerConfig. Clients also verify the certificates of the peers
+	// they connect to, which must be signed by one of these CAs and issued to the peer's client ID.
+	// Brokers of a cluster verify the certificates of the other brokers against them, too.
+	CAPool *x509.CertPool
+
+	// Hex encoded SHA-256 fingerprint of the broker's public key. If it is set, clients only connect
+	// to a broker with this key, and brokers only link to other brokers of the cluster with this key,
+	// i.e. all brokers must share it. The broker logs its fingerprint when it starts.
+	// Example: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+	BrokerFingerprint string
+
+	// CA certificate and private key with which the broker signs client certificates (broker only).
+	// If it is set, clients can enroll with the broker (see EnrollToken). Unless CAPool is set, only
+	// certificates signed by this CA are accepted.
+	CAKeyPair *tls.Certificate
+
+	// How long certificates signed by the broker's CA are valid (broker only). Clients renew them
+	// after two thirds of this time. If it is zero, certificates are valid for 30 days.
+	CertificateValidity time.Duration
+
+	// Token for enrolling with the broker's CA (client only), see "natter broker enroll". If it is
+	// set, a client without certificate generates a key and has the broker sign a certificate for
+	// its client ID, and it renews the certificate before it expires. Unless CAPool is set, the
+	// client trusts the CA that issued its certificate, for both the brokers and its peers.
+	EnrollToken string
+
+	// Files in which an enrolled client keeps its certificate (followed by the CA certificate)
+	// and private key (client only), see EnrollToken. Example: /var/lib/natter/bob.pem
+	CertificateFile string
+	PrivateKeyFile  string
+
 	// Configure TLS for all TLS clients
 	TLSClientConfig *tls.Config
 
 	// Configure TLS between client and server
 	TLSServerConfig *tls.Config
 
+	// Logger used for all log output of the client or broker. If it is not set,
+	// only errors are logged to STDERR. See NewTextLogger and NewJSONLogger.
+	Logger Logger
+
 	// Override the QUIC configuration. This should not be necessary and
 	// can break the functionality, if not done correctly. Ideally, you should
 	// not change any settings here.
 	QuicConfig *quic.Config
-
-	// TODO Add "Listen" and "Forwards" flags
 }
@@ -23,6 +23,12 @@ const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 // 0x01
 type CheckinRequest struct {
 	Source               string   `protobuf:"bytes,1,opt,name=Source,proto3" json:"Source,omitempty"`
+	LocalAddr            string   `protobuf:"bytes,2,opt,name=LocalAddr,proto3" json:"LocalAddr,omitempty"`
+	Services             []string `protobuf:"bytes,3,rep,name=Services,proto3" json:"Services,omitempty"`
+	AllowPeers           []string `protobuf:"bytes,4,rep,name=AllowPeers,proto3" json:"AllowPeers,omitempty"`
+	Certificates         [][]byte `protobuf:"bytes,5,rep,name=Certificates,proto3" json:"Certificates,omitempty"`
+	Timestamp            int64    `protobuf:"varint,6,opt,name=Timestamp,proto3" json:"Timestamp,omitempty"`
+	Signature            []byte   `protobuf:"bytes,7,opt,name=Signature,proto3" json:"Signature,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -60,6 +66,48 @@ func (m *CheckinRequest) GetSource() string {
 	return ""
 }
 
+func (m *CheckinRequest) GetLocalAddr() string {
+	if m != nil {
+		return m.LocalAddr
+	}
+	return ""
+}
+
+func (m *CheckinRequest) GetServices() []string {
+	if m != nil {
+		return m.Services
+	}
+	return nil
+}
+
+func (m *CheckinRequest) GetAllowPeers() []string {
+	if m != nil {
+		return m.AllowPeers
+	}
+	return nil
+}
+
+func (m *CheckinRequest) GetCertificates() [][]byte {
+	if m != nil {
+		return m.Certificates
+	}
+	return nil
+}
+
+func (m *CheckinRequest) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *CheckinRequest) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
 // 0x02
 type CheckinResponse struct {
 	Addr                 string   `protobuf:"bytes,1,opt,name=Addr,proto3" json:"Addr,omitempty"`
@@ -109,6 +157,10 @@ type ForwardRequest struct {
 	TargetAddr           string   `protobuf:"bytes,5,opt,name=TargetAddr,proto3" json:"TargetAddr,omitempty"`
 	TargetForwardAddr    string   `protobuf:"bytes,6,opt,name=TargetForwardAddr,proto3" json:"TargetForwardAddr,omitempty"`
 	TargetCommand        []string `protobuf:"bytes,7,rep,name=TargetCommand,proto3" json:"TargetCommand,omitempty"`
+	TargetService        string   `protobuf:"bytes,8,opt,name=TargetService,proto3" json:"TargetService,omitempty"`
+	Invite               string   `protobuf:"bytes,9,opt,name=Invite,proto3" json:"Invite,omitempty"`
+	Compression          string   `protobuf:"bytes,10,opt,name=Compression,proto3" json:"Compression,omitempty"`
+	SingleSession        bool     `protobuf:"varint,11,opt,name=SingleSession,proto3" json:"SingleSession,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -188,6 +240,34 @@ func (m *ForwardRequest) GetTargetCommand() []string {
 	return nil
 }
 
+func (m *ForwardRequest) GetTargetService() string {
+	if m != nil {
+		return m.TargetService
+	}
+	return ""
+}
+
+func (m *ForwardRequest) GetInvite() string {
+	if m != nil {
+		return m.Invite
+	}
+	return ""
+}
+
+func (m *ForwardRequest) GetCompression() string {
+	if m != nil {
+		return m.Compression
+	}
+	return ""
+}
+
+func (m *ForwardRequest) GetSingleSession() bool {
+	if m != nil {
+		return m.SingleSession
+	}
+	return false
+}
+
 // 0x04
 type ForwardResponse struct {
 	Id                   string   `protobuf:"bytes,1,opt,name=Id,proto3" json:"Id,omitempty"`
@@ -196,6 +276,10 @@ type ForwardResponse struct {
 	SourceAddr           string   `protobuf:"bytes,4,opt,name=SourceAddr,proto3" json:"SourceAddr,omitempty"`
 	Target               string   `protobuf:"bytes,5,opt,name=Target,proto3" json:"Target,omitempty"`
 	TargetAddr           string   `protobuf:"bytes,6,opt,name=TargetAddr,proto3" json:"TargetAddr,omitempty"`
+	SourceNatType        string   `protobuf:"bytes,7,opt,name=SourceNatType,proto3" json:"SourceNatType,omitempty"`
+	TargetNatType        string   `protobuf:"bytes,8,opt,name=TargetNatType,proto3" json:"TargetNatType,omitempty"`
+	TargetLocalAddr      string   `protobuf:"bytes,9,opt,name=TargetLocalAddr,proto3" json:"TargetLocalAddr,omitempty"`
+	Compression          string   `protobuf:"bytes,10,opt,name=Compression,proto3" json:"Compression,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -268,32 +352,843 @@ func (m *ForwardResponse) GetTargetAddr() string {
 	return ""
 }
 
+func (m *ForwardResponse) GetSourceNatType() string {
+	if m != nil {
+		return m.SourceNatType
+	}
+	return ""
+}
+
+func (m *ForwardResponse) GetTargetNatType() string {
+	if m != nil {
+		return m.TargetNatType
+	}
+	return ""
+}
+
+func (m *ForwardResponse) GetTargetLocalAddr() string {
+	if m != nil {
+		return m.TargetLocalAddr
+	}
+	return ""
+}
+
+func (m *ForwardResponse) GetCompression() string {
+	if m != nil {
+		return m.Compression
+	}
+	return ""
+}
+
+// 0x05
+type PeersRequest struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=Id,proto3" json:"Id,omitempty"`
+	Offset               int32    `protobuf:"varint,2,opt,name=Offset,proto3" json:"Offset,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PeersRequest) Reset()         { *m = PeersRequest{} }
+func (m *PeersRequest) String() string { return proto.CompactTextString(m) }
+func (*PeersRequest) ProtoMessage()    {}
+func (*PeersRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{4}
+}
+
+func (m *PeersRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PeersRequest.Unmarshal(m, b)
+}
+func (m *PeersRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PeersRequest.Marshal(b, m, deterministic)
+}
+func (m *PeersRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PeersRequest.Merge(m, src)
+}
+func (m *PeersRequest) XXX_Size() int {
+	return xxx_messageInfo_PeersRequest.Size(m)
+}
+func (m *PeersRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_PeersRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PeersRequest proto.InternalMessageInfo
+
+func (m *PeersRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *PeersRequest) GetOffset() int32 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+// 0x06
+type PeersResponse struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=Id,proto3" json:"Id,omitempty"`
+	Peers                []*Peer  `protobuf:"bytes,2,rep,name=Peers,proto3" json:"Peers,omitempty"`
+	Next                 int32    `protobuf:"varint,3,opt,name=Next,proto3" json:"Next,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PeersResponse) Reset()         { *m = PeersResponse{} }
+func (m *PeersResponse) String() string { return proto.CompactTextString(m) }
+func (*PeersResponse) ProtoMessage()    {}
+func (*PeersResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{5}
+}
+
+func (m *PeersResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PeersResponse.Unmarshal(m, b)
+}
+func (m *PeersResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PeersResponse.Marshal(b, m, deterministic)
+}
+func (m *PeersResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PeersResponse.Merge(m, src)
+}
+func (m *PeersResponse) XXX_Size() int {
+	return xxx_messageInfo_PeersResponse.Size(m)
+}
+func (m *PeersResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_PeersResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PeersResponse proto.InternalMessageInfo
+
+func (m *PeersResponse) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *PeersResponse) GetPeers() []*Peer {
+	if m != nil {
+		return m.Peers
+	}
+	return nil
+}
+
+func (m *PeersResponse) GetNext() int32 {
+	if m != nil {
+		return m.Next
+	}
+	return 0
+}
+
+type Peer struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=Id,proto3" json:"Id,omitempty"`
+	NatType              string   `protobuf:"bytes,2,opt,name=NatType,proto3" json:"NatType,omitempty"`
+	Services             []string `protobuf:"bytes,3,rep,name=Services,proto3" json:"Services,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Peer) Reset()         { *m = Peer{} }
+func (m *Peer) String() string { return proto.CompactTextString(m) }
+func (*Peer) ProtoMessage()    {}
+func (*Peer) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{6}
+}
+
+func (m *Peer) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Peer.Unmarshal(m, b)
+}
+func (m *Peer) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Peer.Marshal(b, m, deterministic)
+}
+func (m *Peer) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Peer.Merge(m, src)
+}
+func (m *Peer) XXX_Size() int {
+	return xxx_messageInfo_Peer.Size(m)
+}
+func (m *Peer) XXX_DiscardUnknown() {
+	xxx_messageInfo_Peer.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Peer proto.InternalMessageInfo
+
+func (m *Peer) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *Peer) GetNatType() string {
+	if m != nil {
+		return m.NatType
+	}
+	return ""
+}
+
+func (m *Peer) GetServices() []string {
+	if m != nil {
+		return m.Services
+	}
+	return nil
+}
+
+// 0x07
+type PresenceRequest struct {
+	Peers                []string `protobuf:"bytes,1,rep,name=Peers,proto3" json:"Peers,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PresenceRequest) Reset()         { *m = PresenceRequest{} }
+func (m *PresenceRequest) String() string { return proto.CompactTextString(m) }
+func (*PresenceRequest) ProtoMessage()    {}
+func (*PresenceRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{7}
+}
+
+func (m *PresenceRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PresenceRequest.Unmarshal(m, b)
+}
+func (m *PresenceRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PresenceRequest.Marshal(b, m, deterministic)
+}
+func (m *PresenceRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PresenceRequest.Merge(m, src)
+}
+func (m *PresenceRequest) XXX_Size() int {
+	return xxx_messageInfo_PresenceRequest.Size(m)
+}
+func (m *PresenceRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_PresenceRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PresenceRequest proto.InternalMessageInfo
+
+func (m *PresenceRequest) GetPeers() []string {
+	if m != nil {
+		return m.Peers
+	}
+	return nil
+}
+
+// 0x08
+type PresenceUpdate struct {
+	Peer                 string   `protobuf:"bytes,1,opt,name=Peer,proto3" json:"Peer,omitempty"`
+	Online               bool     `protobuf:"varint,2,opt,name=Online,proto3" json:"Online,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PresenceUpdate) Reset()         { *m = PresenceUpdate{} }
+func (m *PresenceUpdate) String() string { return proto.CompactTextString(m) }
+func (*PresenceUpdate) ProtoMessage()    {}
+func (*PresenceUpdate) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{8}
+}
+
+func (m *PresenceUpdate) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PresenceUpdate.Unmarshal(m, b)
+}
+func (m *PresenceUpdate) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PresenceUpdate.Marshal(b, m, deterministic)
+}
+func (m *PresenceUpdate) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PresenceUpdate.Merge(m, src)
+}
+func (m *PresenceUpdate) XXX_Size() int {
+	return xxx_messageInfo_PresenceUpdate.Size(m)
+}
+func (m *PresenceUpdate) XXX_DiscardUnknown() {
+	xxx_messageInfo_PresenceUpdate.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PresenceUpdate proto.InternalMessageInfo
+
+func (m *PresenceUpdate) GetPeer() string {
+	if m != nil {
+		return m.Peer
+	}
+	return ""
+}
+
+func (m *PresenceUpdate) GetOnline() bool {
+	if m != nil {
+		return m.Online
+	}
+	return false
+}
+
+// 0x09
+type SendFileRequest struct {
+	Name                 string   `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"`
+	Dir                  bool     `protobuf:"varint,2,opt,name=Dir,proto3" json:"Dir,omitempty"`
+	Size                 int64    `protobuf:"varint,3,opt,name=Size,proto3" json:"Size,omitempty"`
+	Mode                 uint32   `protobuf:"varint,4,opt,name=Mode,proto3" json:"Mode,omitempty"`
+	ModTime              int64    `protobuf:"varint,5,opt,name=ModTime,proto3" json:"ModTime,omitempty"`
+	Checksum             string   `protobuf:"bytes,6,opt,name=Checksum,proto3" json:"Checksum,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SendFileRequest) Reset()         { *m = SendFileRequest{} }
+func (m *SendFileRequest) String() string { return proto.CompactTextString(m) }
+func (*SendFileRequest) ProtoMessage()    {}
+func (*SendFileRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{9}
+}
+
+func (m *SendFileRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SendFileRequest.Unmarshal(m, b)
+}
+func (m *SendFileRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SendFileRequest.Marshal(b, m, deterministic)
+}
+func (m *SendFileRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SendFileRequest.Merge(m, src)
+}
+func (m *SendFileRequest) XXX_Size() int {
+	return xxx_messageInfo_SendFileRequest.Size(m)
+}
+func (m *SendFileRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SendFileRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SendFileRequest proto.InternalMessageInfo
+
+func (m *SendFileRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *SendFileRequest) GetDir() bool {
+	if m != nil {
+		return m.Dir
+	}
+	return false
+}
+
+func (m *SendFileRequest) GetSize() int64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+func (m *SendFileRequest) GetMode() uint32 {
+	if m != nil {
+		return m.Mode
+	}
+	return 0
+}
+
+func (m *SendFileRequest) GetModTime() int64 {
+	if m != nil {
+		return m.ModTime
+	}
+	return 0
+}
+
+func (m *SendFileRequest) GetChecksum() string {
+	if m != nil {
+		return m.Checksum
+	}
+	return ""
+}
+
+// 0x0A
+type SendFileResponse struct {
+	Offset               int64    `protobuf:"varint,1,opt,name=Offset,proto3" json:"Offset,omitempty"`
+	Error                string   `protobuf:"bytes,2,opt,name=Error,proto3" json:"Error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SendFileResponse) Reset()         { *m = SendFileResponse{} }
+func (m *SendFileResponse) String() string { return proto.CompactTextString(m) }
+func (*SendFileResponse) ProtoMessage()    {}
+func (*SendFileResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{10}
+}
+
+func (m *SendFileResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SendFileResponse.Unmarshal(m, b)
+}
+func (m *SendFileResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SendFileResponse.Marshal(b, m, deterministic)
+}
+func (m *SendFileResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SendFileResponse.Merge(m, src)
+}
+func (m *SendFileResponse) XXX_Size() int {
+	return xxx_messageInfo_SendFileResponse.Size(m)
+}
+func (m *SendFileResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_SendFileResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SendFileResponse proto.InternalMessageInfo
+
+func (m *SendFileResponse) GetOffset() int64 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func (m *SendFileResponse) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+// 0x0B
+type SendFileResult struct {
+	Success              bool     `protobuf:"varint,1,opt,name=Success,proto3" json:"Success,omitempty"`
+	Error                string   `protobuf:"bytes,2,opt,name=Error,proto3" json:"Error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SendFileResult) Reset()         { *m = SendFileResult{} }
+func (m *SendFileResult) String() string { return proto.CompactTextString(m) }
+func (*SendFileResult) ProtoMessage()    {}
+func (*SendFileResult) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{11}
+}
+
+func (m *SendFileResult) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SendFileResult.Unmarshal(m, b)
+}
+func (m *SendFileResult) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SendFileResult.Marshal(b, m, deterministic)
+}
+func (m *SendFileResult) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SendFileResult.Merge(m, src)
+}
+func (m *SendFileResult) XXX_Size() int {
+	return xxx_messageInfo_SendFileResult.Size(m)
+}
+func (m *SendFileResult) XXX_DiscardUnknown() {
+	xxx_messageInfo_SendFileResult.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SendFileResult proto.InternalMessageInfo
+
+func (m *SendFileResult) GetSuccess() bool {
+	if m != nil {
+		return m.Success
+	}
+	return false
+}
+
+func (m *SendFileResult) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+// 0x0C
+type InviteRequest struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=Id,proto3" json:"Id,omitempty"`
+	TargetForwardAddr    string   `protobuf:"bytes,2,opt,name=TargetForwardAddr,proto3" json:"TargetForwardAddr,omitempty"`
+	Ttl                  int64    `protobuf:"varint,3,opt,name=Ttl,proto3" json:"Ttl,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *InviteRequest) Reset()         { *m = InviteRequest{} }
+func (m *InviteRequest) String() string { return proto.CompactTextString(m) }
+func (*InviteRequest) ProtoMessage()    {}
+func (*InviteRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{12}
+}
+
+func (m *InviteRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_InviteRequest.Unmarshal(m, b)
+}
+func (m *InviteRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_InviteRequest.Marshal(b, m, deterministic)
+}
+func (m *InviteRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_InviteRequest.Merge(m, src)
+}
+func (m *InviteRequest) XXX_Size() int {
+	return xxx_messageInfo_InviteRequest.Size(m)
+}
+func (m *InviteRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_InviteRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_InviteRequest proto.InternalMessageInfo
+
+func (m *InviteRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *InviteRequest) GetTargetForwardAddr() string {
+	if m != nil {
+		return m.TargetForwardAddr
+	}
+	return ""
+}
+
+func (m *InviteRequest) GetTtl() int64 {
+	if m != nil {
+		return m.Ttl
+	}
+	return 0
+}
+
+// 0x0D
+type InviteResponse struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=Id,proto3" json:"Id,omitempty"`
+	Success              bool     `protobuf:"varint,2,opt,name=Success,proto3" json:"Success,omitempty"`
+	Token                string   `protobuf:"bytes,3,opt,name=Token,proto3" json:"Token,omitempty"`
+	Expires              int64    `protobuf:"varint,4,opt,name=Expires,proto3" json:"Expires,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *InviteResponse) Reset()         { *m = InviteResponse{} }
+func (m *InviteResponse) String() string { return proto.CompactTextString(m) }
+func (*InviteResponse) ProtoMessage()    {}
+func (*InviteResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{13}
+}
+
+func (m *InviteResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_InviteResponse.Unmarshal(m, b)
+}
+func (m *InviteResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_InviteResponse.Marshal(b, m, deterministic)
+}
+func (m *InviteResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_InviteResponse.Merge(m, src)
+}
+func (m *InviteResponse) XXX_Size() int {
+	return xxx_messageInfo_InviteResponse.Size(m)
+}
+func (m *InviteResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_InviteResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_InviteResponse proto.InternalMessageInfo
+
+func (m *InviteResponse) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *InviteResponse) GetSuccess() bool {
+	if m != nil {
+		return m.Success
+	}
+	return false
+}
+
+func (m *InviteResponse) GetToken() string {
+	if m != nil {
+		return m.Token
+	}
+	return ""
+}
+
+func (m *InviteResponse) GetExpires() int64 {
+	if m != nil {
+		return m.Expires
+	}
+	return 0
+}
+
+// 0x0E
+type BrokerHello struct {
+	Broker               string   `protobuf:"bytes,1,opt,name=Broker,proto3" json:"Broker,omitempty"`
+	Mac                  []byte   `protobuf:"bytes,2,opt,name=Mac,proto3" json:"Mac,omitempty"`
+	Nonce                []byte   `protobuf:"bytes,3,opt,name=Nonce,proto3" json:"Nonce,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *BrokerHello) Reset()         { *m = BrokerHello{} }
+func (m *BrokerHello) String() string { return proto.CompactTextString(m) }
+func (*BrokerHello) ProtoMessage()    {}
+func (*BrokerHello) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{14}
+}
+
+func (m *BrokerHello) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_BrokerHello.Unmarshal(m, b)
+}
+func (m *BrokerHello) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_BrokerHello.Marshal(b, m, deterministic)
+}
+func (m *BrokerHello) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_BrokerHello.Merge(m, src)
+}
+func (m *BrokerHello) XXX_Size() int {
+	return xxx_messageInfo_BrokerHello.Size(m)
+}
+func (m *BrokerHello) XXX_DiscardUnknown() {
+	xxx_messageInfo_BrokerHello.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_BrokerHello proto.InternalMessageInfo
+
+func (m *BrokerHello) GetBroker() string {
+	if m != nil {
+		return m.Broker
+	}
+	return ""
+}
+
+func (m *BrokerHello) GetMac() []byte {
+	if m != nil {
+		return m.Mac
+	}
+	return nil
+}
+
+func (m *BrokerHello) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
+// 0x0F
+type EnrollRequest struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=Id,proto3" json:"Id,omitempty"`
+	ClientId             string   `protobuf:"bytes,2,opt,name=ClientId,proto3" json:"ClientId,omitempty"`
+	Csr                  []byte   `protobuf:"bytes,3,opt,name=Csr,proto3" json:"Csr,omitempty"`
+	Mac                  []byte   `protobuf:"bytes,4,opt,name=Mac,proto3" json:"Mac,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *EnrollRequest) Reset()         { *m = EnrollRequest{} }
+func (m *EnrollRequest) String() string { return proto.CompactTextString(m) }
+func (*EnrollRequest) ProtoMessage()    {}
+func (*EnrollRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{15}
+}
+
+func (m *EnrollRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_EnrollRequest.Unmarshal(m, b)
+}
+func (m *EnrollRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_EnrollRequest.Marshal(b, m, deterministic)
+}
+func (m *EnrollRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_EnrollRequest.Merge(m, src)
+}
+func (m *EnrollRequest) XXX_Size() int {
+	return xxx_messageInfo_EnrollRequest.Size(m)
+}
+func (m *EnrollRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_EnrollRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_EnrollRequest proto.InternalMessageInfo
+
+func (m *EnrollRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *EnrollRequest) GetClientId() string {
+	if m != nil {
+		return m.ClientId
+	}
+	return ""
+}
+
+func (m *EnrollRequest) GetCsr() []byte {
+	if m != nil {
+		return m.Csr
+	}
+	return nil
+}
+
+func (m *EnrollRequest) GetMac() []byte {
+	if m != nil {
+		return m.Mac
+	}
+	return nil
+}
+
+// 0x10
+type EnrollResponse struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=Id,proto3" json:"Id,omitempty"`
+	Success              bool     `protobuf:"varint,2,opt,name=Success,proto3" json:"Success,omitempty"`
+	Error                string   `protobuf:"bytes,3,opt,name=Error,proto3" json:"Error,omitempty"`
+	Certificates         [][]byte `protobuf:"bytes,4,rep,name=Certificates,proto3" json:"Certificates,omitempty"`
+	Mac                  []byte   `protobuf:"bytes,5,opt,name=Mac,proto3" json:"Mac,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *EnrollResponse) Reset()         { *m = EnrollResponse{} }
+func (m *EnrollResponse) String() string { return proto.CompactTextString(m) }
+func (*EnrollResponse) ProtoMessage()    {}
+func (*EnrollResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_b0895f35a7d2a8f3, []int{16}
+}
+
+func (m *EnrollResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_EnrollResponse.Unmarshal(m, b)
+}
+func (m *EnrollResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_EnrollResponse.Marshal(b, m, deterministic)
+}
+func (m *EnrollResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_EnrollResponse.Merge(m, src)
+}
+func (m *EnrollResponse) XXX_Size() int {
+	return xxx_messageInfo_EnrollResponse.Size(m)
+}
+func (m *EnrollResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_EnrollResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_EnrollResponse proto.InternalMessageInfo
+
+func (m *EnrollResponse) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *EnrollResponse) GetSuccess() bool {
+	if m != nil {
+		return m.Success
+	}
+	return false
+}
+
+func (m *EnrollResponse) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *EnrollResponse) GetCertificates() [][]byte {
+	if m != nil {
+		return m.Certificates
+	}
+	return nil
+}
+
+func (m *EnrollResponse) GetMac() []byte {
+	if m != nil {
+		return m.Mac
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*CheckinRequest)(nil), "internal.CheckinRequest")
 	proto.RegisterType((*CheckinResponse)(nil), "internal.CheckinResponse")
 	proto.RegisterType((*ForwardRequest)(nil), "internal.ForwardRequest")
 	proto.RegisterType((*ForwardResponse)(nil), "internal.ForwardResponse")
+	proto.RegisterType((*PeersRequest)(nil), "internal.PeersRequest")
+	proto.RegisterType((*PeersResponse)(nil), "internal.PeersResponse")
+	proto.RegisterType((*Peer)(nil), "internal.Peer")
+	proto.RegisterType((*PresenceRequest)(nil), "internal.PresenceRequest")
+	proto.RegisterType((*PresenceUpdate)(nil), "internal.PresenceUpdate")
+	proto.RegisterType((*SendFileRequest)(nil), "internal.SendFileRequest")
+	proto.RegisterType((*SendFileResponse)(nil), "internal.SendFileResponse")
+	proto.RegisterType((*SendFileResult)(nil), "internal.SendFileResult")
+	proto.RegisterType((*InviteRequest)(nil), "internal.InviteRequest")
+	proto.RegisterType((*InviteResponse)(nil), "internal.InviteResponse")
+	proto.RegisterType((*BrokerHello)(nil), "internal.BrokerHello")
+	proto.RegisterType((*EnrollRequest)(nil), "internal.EnrollRequest")
+	proto.RegisterType((*EnrollResponse)(nil), "internal.EnrollResponse")
 }
 
 func init() { proto.RegisterFile("internal/natter.proto", fileDescriptor_b0895f35a7d2a8f3) }
 
 var fileDescriptor_b0895f35a7d2a8f3 = []byte{
-	// 263 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x51, 0xdb, 0x4a, 0xc3, 0x40,
-	0x10, 0x25, 0x97, 0xa6, 0xed, 0x80, 0x29, 0x2e, 0x28, 0x79, 0x92, 0x12, 0x14, 0xf2, 0x20, 0xfa,
-	0xe0, 0x17, 0x48, 0x41, 0xe8, 0x6b, 0xea, 0x0f, 0xac, 0xd9, 0x41, 0x8b, 0x76, 0xb7, 0xce, 0x6e,
-	0xf0, 0xa3, 0xfc, 0x2d, 0x3f, 0x44, 0x3a, 0xbb, 0xa9, 0x31, 0x85, 0xbc, 0xcd, 0x39, 0x73, 0xce,
-	0xcc, 0xce, 0x59, 0xb8, 0xd8, 0x6a, 0x87, 0xa4, 0xe5, 0xc7, 0xbd, 0x96, 0xce, 0x21, 0xdd, 0xed,
-	0xc9, 0x38, 0x23, 0x66, 0x1d, 0x5d, 0x56, 0x90, 0xaf, 0xde, 0xb0, 0x79, 0xdf, 0xea, 0x1a, 0x3f,
-	0x5b, 0xb4, 0x4e, 0x5c, 0x42, 0xb6, 0x31, 0x2d, 0x35, 0x58, 0x44, 0xcb, 0xa8, 0x9a, 0xd7, 0x01,
-	0x95, 0x37, 0xb0, 0x38, 0x2a, 0xed, 0xde, 0x68, 0x8b, 0x42, 0x40, 0xfa, 0xa8, 0x14, 0x05, 0x21,
-	0xd7, 0xe5, 0x4f, 0x04, 0xf9, 0x93, 0xa1, 0x2f, 0x49, 0xaa, 0x9b, 0x98, 0x43, 0xbc, 0x56, 0x41,
-	0x14, 0xaf, 0x55, 0x6f, 0x43, 0xdc, 0xdf, 0x20, 0xae, 0x00, 0x7c, 0xc5, 0x43, 0x13, 0xee, 0xf5,
-	0x98, 0x83, 0xef, 0x59, 0xd2, 0x2b, 0xba, 0x22, 0xf5, 0x3e, 0x8f, 0x0e, 0x3e, 0x5f, 0xb1, 0x6f,
-	0xe2, 0x7d, 0x7f, 0x8c, 0xb8, 0x85, 0x73, 0x8f, 0xc2, 0xbb, 0x58, 0x96, 0xb1, 0xec, 0xb4, 0x21,
-	0xae, 0xe1, 0xcc, 0x93, 0x2b, 0xb3, 0xdb, 0x49, 0xad, 0x8a, 0xe9, 0x32, 0xa9, 0xe6, 0xf5, 0x7f,
-	0xb2, 0xfc, 0x8e, 0x60, 0x71, 0x3c, 0x33, 0xc4, 0x31, 0xbc, 0xb3, 0x80, 0xe9, 0xa6, 0x6d, 0x1a,
-	0xb4, 0x96, 0x0f, 0x9d, 0xd5, 0x1d, 0xec, 0x25, 0x90, 0x8c, 0x24, 0x90, 0x8e, 0x24, 0x30, 0x19,
-	0x49, 0x20, 0x1b, 0x26, 0xf0, 0x92, 0xf1, 0xb7, 0x3f, 0xfc, 0x06, 0x00, 0x00, 0xff, 0xff, 0x63,
-	0x27, 0x51, 0x99, 0x0f, 0x02, 0x00, 0x00,
+	// 830 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x56, 0xcd, 0x6e, 0x23, 0x45,
+	0x10, 0xd6, 0x78, 0x6c, 0xc7, 0xae, 0x38, 0x76, 0x18, 0x2d, 0x68, 0x84, 0xd0, 0x6a, 0xd4, 0x5a,
+	0xc4, 0x1c, 0x50, 0x90, 0x40, 0xe2, 0xc4, 0x61, 0x17, 0x93, 0x15, 0x91, 0x36, 0x61, 0xd5, 0x63,
+	0x0e, 0x9c, 0xd0, 0x30, 0x53, 0x09, 0x4d, 0xc6, 0xdd, 0xa6, 0xbb, 0xbd, 0xbb, 0xf0, 0x00, 0xbc,
+	0x01, 0x4f, 0xc4, 0x9b, 0x70, 0xe4, 0x29, 0x50, 0xff, 0xcd, 0xcf, 0x26, 0x31, 0x62, 0x6f, 0xf5,
+	0x7d, 0x5d, 0xdd, 0x55, 0xfd, 0x55, 0x57, 0xcd, 0xc0, 0xfb, 0x8c, 0x6b, 0x94, 0xbc, 0x6c, 0x3e,
+	0xe3, 0xa5, 0xd6, 0x28, 0xcf, 0x76, 0x52, 0x68, 0x91, 0xcc, 0x02, 0x4d, 0xfe, 0x8e, 0x60, 0xb9,
+	0xfe, 0x19, 0xab, 0x5b, 0xc6, 0x29, 0xfe, 0xba, 0x47, 0xa5, 0x93, 0x0f, 0x60, 0x5a, 0x88, 0xbd,
+	0xac, 0x30, 0x8d, 0xb2, 0x28, 0x9f, 0x53, 0x8f, 0x92, 0x8f, 0x60, 0xfe, 0x42, 0x54, 0x65, 0xf3,
+	0xac, 0xae, 0x65, 0x3a, 0xb2, 0x4b, 0x1d, 0x91, 0x7c, 0x08, 0xb3, 0x02, 0xe5, 0x2b, 0x56, 0xa1,
+	0x4a, 0xe3, 0x2c, 0xce, 0xe7, 0xb4, 0xc5, 0xc9, 0x63, 0x80, 0x67, 0x4d, 0x23, 0x5e, 0xbf, 0x44,
+	0x94, 0x2a, 0x1d, 0xdb, 0xd5, 0x1e, 0x93, 0x10, 0x58, 0xac, 0x51, 0x6a, 0x76, 0xcd, 0xaa, 0x52,
+	0xa3, 0x4a, 0x27, 0x59, 0x9c, 0x2f, 0xe8, 0x80, 0x33, 0xd1, 0x37, 0x6c, 0x8b, 0x4a, 0x97, 0xdb,
+	0x5d, 0x3a, 0xcd, 0xa2, 0x3c, 0xa6, 0x1d, 0x61, 0x56, 0x0b, 0x76, 0xc3, 0x4b, 0xbd, 0x97, 0x98,
+	0x1e, 0x65, 0x51, 0xbe, 0xa0, 0x1d, 0x41, 0x3e, 0x86, 0x55, 0x7b, 0x47, 0xb5, 0x13, 0x5c, 0x61,
+	0x92, 0xc0, 0xd8, 0xde, 0xc3, 0x5d, 0xd1, 0xda, 0xe4, 0x9f, 0x11, 0x2c, 0x9f, 0x0b, 0xf9, 0xba,
+	0x94, 0x75, 0xd0, 0x62, 0x09, 0xa3, 0x8b, 0xda, 0x3b, 0x8d, 0x2e, 0xea, 0x9e, 0x36, 0xa3, 0x81,
+	0x36, 0x8f, 0x01, 0x9c, 0x65, 0x0f, 0x8d, 0xed, 0x5a, 0x8f, 0x31, 0xfb, 0x36, 0xa5, 0xbc, 0x41,
+	0x9d, 0x8e, 0xdd, 0x3e, 0x87, 0xcc, 0x3e, 0x67, 0xd9, 0x7d, 0x13, 0xb7, 0xaf, 0x63, 0x92, 0x4f,
+	0xe1, 0x3d, 0x87, 0x7c, 0x5e, 0xd6, 0x6d, 0x6a, 0xdd, 0xee, 0x2e, 0x24, 0x4f, 0xe0, 0xc4, 0x91,
+	0x6b, 0xb1, 0xdd, 0x96, 0xbc, 0x4e, 0x8f, 0xac, 0xd4, 0x43, 0xb2, 0xf3, 0xf2, 0xf5, 0x49, 0x67,
+	0xf6, 0xbc, 0x21, 0x69, 0x32, 0xbe, 0xe0, 0xaf, 0x98, 0xc6, 0x74, 0xee, 0x32, 0x76, 0x28, 0xc9,
+	0xe0, 0x78, 0x2d, 0xb6, 0x3b, 0x89, 0x4a, 0x31, 0xc1, 0x53, 0xb0, 0x8b, 0x7d, 0xca, 0x9c, 0x5f,
+	0x30, 0x7e, 0xd3, 0x60, 0xe1, 0x7d, 0x8e, 0xb3, 0x28, 0x9f, 0xd1, 0x21, 0x49, 0xfe, 0x1a, 0xc1,
+	0xaa, 0x15, 0xdb, 0x17, 0xe5, 0x6d, 0xb5, 0x53, 0x38, 0x2a, 0xf6, 0x55, 0x85, 0x4a, 0x59, 0xb9,
+	0x67, 0x34, 0xc0, 0x5e, 0x1d, 0xe2, 0x03, 0x75, 0x18, 0x1f, 0xa8, 0xc3, 0xe4, 0x40, 0x1d, 0xa6,
+	0x77, 0xea, 0x60, 0xee, 0x64, 0x4f, 0xb9, 0x2a, 0xf5, 0xe6, 0xb7, 0x9d, 0x7b, 0x63, 0x73, 0x3a,
+	0x24, 0x3b, 0x65, 0x83, 0xd7, 0x40, 0xd9, 0xe0, 0x95, 0xc3, 0xca, 0x11, 0x5d, 0x37, 0x39, 0x89,
+	0xdf, 0xa6, 0xff, 0x5b, 0x6b, 0xf2, 0x25, 0x2c, 0x6c, 0x0b, 0x1d, 0x78, 0xaf, 0xdf, 0x5d, 0x5f,
+	0x2b, 0xd4, 0x56, 0xc0, 0x09, 0xf5, 0x88, 0xfc, 0x00, 0x27, 0x7e, 0xdf, 0x03, 0xd2, 0x3f, 0x81,
+	0x89, 0xeb, 0xd6, 0x51, 0x16, 0xe7, 0xc7, 0x9f, 0x2f, 0xcf, 0xc2, 0xc4, 0x38, 0x33, 0x34, 0x75,
+	0x8b, 0xa6, 0x8b, 0xae, 0xf0, 0x8d, 0xb6, 0x45, 0x98, 0x50, 0x6b, 0x93, 0x17, 0x30, 0x36, 0x8b,
+	0xf7, 0x15, 0x33, 0xc8, 0xe2, 0x7a, 0x27, 0xc0, 0x43, 0xa3, 0x83, 0x7c, 0x02, 0xab, 0x97, 0x12,
+	0x15, 0xf2, 0x0a, 0xc3, 0x1d, 0x1f, 0x85, 0xd4, 0x22, 0xeb, 0xeb, 0x00, 0xf9, 0x0a, 0x96, 0xc1,
+	0xf1, 0xfb, 0x5d, 0x5d, 0x6a, 0xdb, 0xe2, 0x66, 0x29, 0xb4, 0xb8, 0x4d, 0xca, 0xe8, 0xc1, 0x1b,
+	0xc6, 0xd1, 0x3f, 0x28, 0x8f, 0xc8, 0x9f, 0x11, 0xac, 0x0a, 0xe4, 0xf5, 0x73, 0xd6, 0xb4, 0x71,
+	0xcc, 0xe5, 0xca, 0x6d, 0x98, 0x82, 0xd6, 0x4e, 0x4e, 0x21, 0xfe, 0x86, 0x49, 0xbf, 0xd9, 0x98,
+	0xc6, 0xab, 0x60, 0xbf, 0xbb, 0x77, 0x18, 0x53, 0x6b, 0x1b, 0xee, 0x52, 0xd4, 0x68, 0xdf, 0xdf,
+	0x09, 0xb5, 0xb6, 0xb9, 0xfe, 0xa5, 0xa8, 0xcd, 0xc4, 0xb2, 0x4f, 0x2f, 0xa6, 0x01, 0x9a, 0xeb,
+	0xdb, 0xe9, 0xa4, 0xf6, 0x5b, 0xff, 0xf2, 0x5a, 0x4c, 0x9e, 0xc2, 0x69, 0x97, 0x96, 0x2f, 0x55,
+	0x57, 0xd3, 0xc8, 0x1e, 0xe4, 0x91, 0xd1, 0xe5, 0x5c, 0x4a, 0x11, 0x66, 0xb3, 0x03, 0xe4, 0x29,
+	0x2c, 0x7b, 0x27, 0xec, 0x1b, 0xdd, 0xef, 0xaa, 0x68, 0xd8, 0x55, 0xf7, 0x9f, 0xf0, 0x23, 0x9c,
+	0xb8, 0xde, 0x7f, 0xe8, 0x91, 0xdd, 0x3b, 0xa4, 0x46, 0x0f, 0x0d, 0xa9, 0x53, 0x88, 0x37, 0xba,
+	0xf1, 0x7a, 0x19, 0x93, 0xfc, 0x02, 0xcb, 0x10, 0xe0, 0x7f, 0x0f, 0x82, 0x47, 0x30, 0xd9, 0x88,
+	0x5b, 0xe4, 0x7e, 0x0e, 0x38, 0x60, 0xfc, 0xcf, 0xdf, 0xec, 0x98, 0x44, 0x65, 0x6b, 0x10, 0xd3,
+	0x00, 0xc9, 0x25, 0x1c, 0x7f, 0x2d, 0xc5, 0x2d, 0xca, 0x6f, 0xb1, 0x69, 0x84, 0xd1, 0xd2, 0xc1,
+	0xf0, 0xad, 0x73, 0xc8, 0x24, 0x79, 0x59, 0x56, 0x36, 0xd8, 0x82, 0x1a, 0xd3, 0x04, 0xba, 0x12,
+	0xdc, 0x0f, 0x9c, 0x05, 0x75, 0xc0, 0x68, 0x73, 0xce, 0xa5, 0x68, 0x9a, 0x87, 0xb4, 0x31, 0xc5,
+	0x6d, 0x18, 0x72, 0x7d, 0x51, 0x7b, 0x49, 0x5a, 0x6c, 0x82, 0xac, 0x95, 0xf4, 0x07, 0x1a, 0x33,
+	0x84, 0x1d, 0xb7, 0x61, 0xc9, 0x1f, 0x11, 0x2c, 0x43, 0x84, 0x77, 0x11, 0xc7, 0xd5, 0x33, 0xee,
+	0xd5, 0xf3, 0xce, 0xd7, 0x76, 0x7c, 0xcf, 0xd7, 0xd6, 0x27, 0x32, 0x69, 0x13, 0xf9, 0x69, 0x6a,
+	0xff, 0x1c, 0xbe, 0xf8, 0x77, 0x00, 0xc3, 0x6e, 0x47, 0x3e, 0x52, 0x08, 0x00, 0x00,
 }
@@ -0,0 +1,184 @@
+package natter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger is used by clients and brokers to log messages. Fields are passed as
+// alternating key/value pairs, e.g. logger.Info("Client connected", "client", "bob").
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// LogLevel defines the minimum level of messages that a logger created
+// by NewTextLogger or NewJSONLogger outputs.
+type LogLevel int
+
+const (
+	LogLevelDebug = LogLevel(iota)
+	LogLevelInfo
+	LogLevelError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogLevelDebug: "debug",
+	LogLevelInfo:  "info",
+	LogLevelError: "error",
+}
+
+// ParseLogLevel converts a level name (debug, info, error) to a LogLevel.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+
+	return LogLevelInfo, fmt.Errorf("invalid log level %s", name)
+}
+
+type writerLogger struct {
+	writer io.Writer
+	level  LogLevel
+	json   bool
+
+	mutex sync.Mutex
+}
+
+// NewTextLogger creates a logger that writes human readable lines to w, e.g.
+// 2019/09/22 10:09:07 INFO Client connected client=bob addr=1.2.3.4:1234
+func NewTextLogger(w io.Writer, level LogLevel) Logger {
+	return &writerLogger{writer: w, level: level}
+}
+
+// NewJSONLogger creates a logger that writes one JSON object per line to w, e.g.
+// {"time":"2019-09-22T10:09:07Z","level":"info","msg":"Client connected","client":"bob"}
+func NewJSONLogger(w io.Writer, level LogLevel) Logger {
+	return &writerLogger{writer: w, level: level, json: true}
+}
+
+// newDefaultLogger creates the logger used if none is configured. It is
+// quiet by default and only reports errors.
+func newDefaultLogger() Logger {
+	return NewTextLogger(os.Stderr, LogLevelError)
+}
+
+func (l *writerLogger) Debug(msg string, fields ...interface{}) {
+	l.log(LogLevelDebug, msg, fields)
+}
+
+func (l *writerLogger) Info(msg string, fields ...interface{}) {
+	l.log(LogLevelInfo, msg, fields)
+}
+
+func (l *writerLogger) Error(msg string, fields ...interface{}) {
+	l.log(LogLevelError, msg, fields)
+}
+
+func (l *writerLogger) log(level LogLevel, msg string, fields []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var line string
+	now := time.Now()
+
+	if l.json {
+		line = formatJSONLogLine(now, level, msg, fields)
+	} else {
+		line = formatTextLogLine(now, level, msg, fields)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	io.WriteString(l.writer, line)
+}
+
+func formatTextLogLine(now time.Time, level LogLevel, msg string, fields []interface{}) string {
+	var b strings.Builder
+
+	b.WriteString(now.Format("2006/01/02 15:04:05 "))
+	b.WriteString(strings.ToUpper(logLevelNames[level]))
+	b.WriteString(" ")
+	b.WriteString(msg)
+
+	for i := 0; i < len(fields); i += 2 {
+		value := formatLogValue(logFieldValue(fields, i))
+		if strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+
+		b.WriteString(fmt.Sprintf(" %v=%s", fields[i], value))
+	}
+
+	b.WriteString("\n")
+	return b.String()
+}
+
+func formatJSONLogLine(now time.Time, level LogLevel, msg string, fields []interface{}) string {
+	var b strings.Builder
+
+	b.WriteString(`{"time":`)
+	b.Write(marshalLogValue(now.Format(time.RFC3339Nano)))
+	b.WriteString(`,"level":`)
+	b.Write(marshalLogValue(logLevelNames[level]))
+	b.WriteString(`,"msg":`)
+	b.Write(marshalLogValue(msg))
+
+	for i := 0; i < len(fields); i += 2 {
+		value := logFieldValue(fields, i)
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		} else if stringer, ok := value.(fmt.Stringer); ok {
+			value = stringer.String()
+		}
+
+		b.WriteString(",")
+		b.Write(marshalLogValue(fmt.Sprint(fields[i])))
+		b.WriteString(":")
+		b.Write(marshalLogValue(value))
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func marshalLogValue(value interface{}) []byte {
+	b, err := json.Marshal(value)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(value))
+	}
+
+	return b
+}
+
+func logFieldValue(fields []interface{}, i int) interface{} {
+	if i+1 < len(fields) {
+		return fields[i+1]
+	}
+
+	return nil
+}
+
+func formatLogValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case error:
+		return v.Error()
+	case []string:
+		return strings.Join(v, " ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,313 @@
+package natter
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// This is a minimal implementation of Prometheus counters, gauges and histograms, and of
+// the Prometheus text exposition format. It is intentionally tiny, so that library users
+// are not forced to pull in the Prometheus client library (and its dependencies).
+
+const (
+	metricTypeCounter   = "counter"
+	metricTypeGauge     = "gauge"
+	metricTypeHistogram = "histogram"
+)
+
+var (
+	metricsSizeBuckets     = []float64{32, 64, 128, 256, 512, 1024, 2048, 4096, 8192}
+	metricsDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+)
+
+type metricsRegistry struct {
+	metrics []*metric
+	mutex   sync.Mutex
+}
+
+type metric struct {
+	name       string
+	help       string
+	metricType string
+	labels     []string
+	buckets    []float64
+	valueFunc  func() float64
+	values     map[string]*metricValue
+
+	mutex sync.Mutex
+}
+
+type metricValue struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64
+	count       uint64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		metrics: make([]*metric, 0),
+	}
+}
+
+func (r *metricsRegistry) counter(name string, help string, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, metricType: metricTypeCounter, labels: labels})
+}
+
+func (r *metricsRegistry) gauge(name string, help string, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, metricType: metricTypeGauge, labels: labels})
+}
+
+func (r *metricsRegistry) gaugeFunc(name string, help string, valueFunc func() float64) *metric {
+	return r.register(&metric{name: name, help: help, metricType: metricTypeGauge, valueFunc: valueFunc})
+}
+
+func (r *metricsRegistry) histogram(name string, help string, buckets []float64, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, metricType: metricTypeHistogram, buckets: buckets, labels: labels})
+}
+
+func (r *metricsRegistry) register(m *metric) *metric {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	m.values = make(map[string]*metricValue)
+	r.metrics = append(r.metrics, m)
+
+	if len(m.labels) == 0 && m.valueFunc == nil {
+		m.value(nil) // Unlabeled metrics are reported even if they are zero
+	}
+
+	return m
+}
+
+// listenAndServe serves the metrics in the Prometheus text format at /metrics.
+func (r *metricsRegistry) listenAndServe(addr string, logger Logger) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.write(w)
+	})
+
+	logger.Info("Metrics endpoint listening", "addr", addr)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("Metrics endpoint failed", "addr", addr, "error", err)
+	}
+}
+
+func (r *metricsRegistry) write(w io.Writer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) dec(labelValues ...string) {
+	m.add(-1, labelValues...)
+}
+
+func (m *metric) add(delta float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.value(labelValues).value += delta
+}
+
+func (m *metric) observe(sample float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	v := m.value(labelValues)
+	v.value += sample
+	v.count++
+
+	for i, bound := range m.buckets {
+		if sample <= bound {
+			v.buckets[i]++
+		}
+	}
+}
+
+// value returns the value for the given label values, creating it if necessary.
+// It must be called with the metric mutex held.
+func (m *metric) value(labelValues []string) *metricValue {
+	key := strings.Join(labelValues, "\xff")
+
+	v, ok := m.values[key]
+	if !ok {
+		v = &metricValue{
+			labelValues: labelValues,
+			buckets:     make([]uint64, len(m.buckets)),
+		}
+		m.values[key] = v
+	}
+
+	return v
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.metricType)
+
+	if m.valueFunc != nil {
+		fmt.Fprintf(w, "%s %s\n", m.name, formatMetricValue(m.valueFunc()))
+		return
+	}
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := m.values[key]
+
+		if m.metricType == metricTypeHistogram {
+			for i, bound := range m.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.formatLabels(v.labelValues, "le", formatMetricValue(bound)), v.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.formatLabels(v.labelValues, "le", "+Inf"), v.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.formatLabels(v.labelValues), formatMetricValue(v.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.formatLabels(v.labelValues), v.count)
+		} else {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.formatLabels(v.labelValues), formatMetricValue(v.value))
+		}
+	}
+}
+
+func (m *metric) formatLabels(labelValues []string, extra ...string) string {
+	pairs := make([]string, 0)
+
+	for i, label := range m.labels {
+		if i < len(labelValues) {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, escapeLabelValue(labelValues[i])))
+		}
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabelValue(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, +1) {
+		return "+Inf"
+	}
+
+	return fmt.Sprintf("%g", value)
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+// countingWriter passes all writes through to the underlying writer, and
+// adds the number of bytes written to the given metric, and to the counter, if any.
+type countingWriter struct {
+	writer      io.Writer
+	metric      *metric
+	labelValues []string
+	counter     *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.metric.add(float64(n), w.labelValues...)
+	if w.counter != nil {
+		atomic.AddInt64(w.counter, int64(n))
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read, like countingWriter
+type countingReader struct {
+	reader      io.Reader
+	metric      *metric
+	labelValues []string
+	counter     *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.metric.add(float64(n), r.labelValues...)
+	if r.counter != nil {
+		atomic.AddInt64(r.counter, int64(n))
+	}
+	return n, err
+}
+
+type brokerMetrics struct {
+	registry        *metricsRegistry
+	checkins        *metric
+	forwardRequests *metric
+	messageSize     *metric
+}
+
+type clientMetrics struct {
+	registry               *metricsRegistry
+	punchAttempts          *metric
+	handshakeDuration      *metric
+	forwardBytes           *metric // By peer rather than forward ID, since every forward gets a new ID
+	forwardCompressedBytes *metric
+	streams                *metric
+}
+
+func newBrokerMetrics(b *broker) *brokerMetrics {
+	registry := newMetricsRegistry()
+
+	registry.gaugeFunc("natter_broker_clients_connected", "Number of clients currently connected to the broker", func() float64 {
+		b.mutex.RLock()
+		defer b.mutex.RUnlock()
+		return float64(len(b.clients))
+	})
+
+	return &brokerMetrics{
+		registry:        registry,
+		checkins:        registry.counter("natter_broker_checkins_total", "Number of check-ins received from clients"),
+		forwardRequests: registry.counter("natter_broker_forward_requests_total", "Number of forward requests by outcome", "outcome"),
+		messageSize:     registry.histogram("natter_broker_message_size_bytes", "Size of protocol messages by direction and type", metricsSizeBuckets, "direction", "type"),
+	}
+}
+
+func newClientMetrics(c *client) *clientMetrics {
+	registry := newMetricsRegistry()
+
+	registry.gaugeFunc("natter_client_forwards_active", "Number of active forwards, incoming and outgoing", func() float64 {
+		c.forwardsMutex.RLock()
+		defer c.forwardsMutex.RUnlock()
+		return float64(len(c.forwards))
+	})
+
+	return &clientMetrics{
+		registry:               registry,
+		punchAttempts:          registry.counter("natter_client_punch_attempts_total", "Number of UDP hole punching packets sent to peers"),
+		handshakeDuration:      registry.histogram("natter_client_handshake_duration_seconds", "Duration of the QUIC handshake with peers", metricsDurationBuckets),
+		forwardBytes:           registry.counter("natter_client_forward_bytes_total", "Number of bytes forwarded, by peer and direction", "peer", "direction"),
+		forwardCompressedBytes: registry.counter("natter_client_forward_compressed_bytes_total", "Number of compressed bytes sent to or received from peers, by peer and direction", "peer", "direction"),
+		streams:                registry.gauge("natter_client_streams_active", "Number of active peer streams"),
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"github.com/lucas-clemente/quic-go"
 	"heckel.io/natter/internal"
 	"io"
-	"log"
+	"strings"
 	"sync"
 )
 
@@ -19,6 +19,24 @@ const (
 
 	messageTypeForwardRequest  = messageType(0x03)
 	messageTypeForwardResponse = messageType(0x04)
+
+	messageTypePeersRequest  = messageType(0x05)
+	messageTypePeersResponse = messageType(0x06)
+
+	messageTypePresenceRequest = messageType(0x07)
+	messageTypePresenceUpdate  = messageType(0x08)
+
+	messageTypeSendFileRequest  = messageType(0x09)
+	messageTypeSendFileResponse = messageType(0x0A)
+	messageTypeSendFileResult   = messageType(0x0B)
+
+	messageTypeInviteRequest  = messageType(0x0C)
+	messageTypeInviteResponse = messageType(0x0D)
+
+	messageTypeBrokerHello = messageType(0x0E)
+
+	messageTypeEnrollRequest  = messageType(0x0F)
+	messageTypeEnrollResponse = messageType(0x10)
 )
 
 var messageTypes = map[messageType]string{
@@ -27,12 +45,44 @@ var messageTypes = map[messageType]string{
 
 	messageTypeForwardRequest:  "ForwardRequest",
 	messageTypeForwardResponse: "ForwardResponse",
+
+	messageTypePeersRequest:  "PeersRequest",
+	messageTypePeersResponse: "PeersResponse",
+
+	messageTypePresenceRequest: "PresenceRequest",
+	messageTypePresenceUpdate:  "PresenceUpdate",
+
+	messageTypeSendFileRequest:  "SendFileRequest",
+	messageTypeSendFileResponse: "SendFileResponse",
+	messageTypeSendFileResult:   "SendFileResult",
+
+	messageTypeInviteRequest:  "InviteRequest",
+	messageTypeInviteResponse: "InviteResponse",
+
+	messageTypeBrokerHello: "BrokerHello",
+
+	messageTypeEnrollRequest:  "EnrollRequest",
+	messageTypeEnrollResponse: "EnrollResponse",
+}
+
+// Services with this prefix are built into every listening client, e.g. natter:ping. Clients
+// do not advertise them and cannot offer services with this prefix themselves.
+const builtinServicePrefix = "natter:"
+
+func isBuiltinService(service string) bool {
+	return strings.HasPrefix(service, builtinServicePrefix)
 }
 
+// maxMessageLength is the maximum size of a message, larger messages are rejected by receive
+const maxMessageLength = 8192
+
 type protocol struct {
 	stream quic.Stream
 	sendmu sync.Mutex
 	receivemu sync.Mutex
+	logger Logger
+
+	messageSize *metric // optional
 }
 
 func (p *protocol) send(messageType messageType, message proto.Message) error {
@@ -58,7 +108,11 @@ func (p *protocol) send(messageType messageType, message proto.Message) error {
 		return err
 	}
 
-	log.Println("-> [" + messageTypes[messageType] + "] " + message.(proto.Message).String())
+	if p.messageSize != nil {
+		p.messageSize.observe(float64(len(messageBytes)), "sent", messageTypes[messageType])
+	}
+
+	p.logger.Debug("-> ["+messageTypes[messageType]+"]", "type", messageTypes[messageType], "size", len(messageBytes), "message", loggedMessage{message})
 	return nil
 }
 
@@ -81,7 +135,7 @@ func (p *protocol) receive() (messageType, proto.Message, error) {
 		return 0, nil, err
 	}
 
-	if messageLength = binary.BigEndian.Uint32(messageLengthBytes); messageLength > 8192 {
+	if messageLength = binary.BigEndian.Uint32(messageLengthBytes); messageLength > maxMessageLength {
 		return 0, nil, errors.New("message too long")
 	}
 
@@ -103,6 +157,30 @@ func (p *protocol) receive() (messageType, proto.Message, error) {
 		message = &internal.ForwardRequest{}
 	case messageTypeForwardResponse:
 		message = &internal.ForwardResponse{}
+	case messageTypePeersRequest:
+		message = &internal.PeersRequest{}
+	case messageTypePeersResponse:
+		message = &internal.PeersResponse{}
+	case messageTypePresenceRequest:
+		message = &internal.PresenceRequest{}
+	case messageTypePresenceUpdate:
+		message = &internal.PresenceUpdate{}
+	case messageTypeSendFileRequest:
+		message = &internal.SendFileRequest{}
+	case messageTypeSendFileResponse:
+		message = &internal.SendFileResponse{}
+	case messageTypeSendFileResult:
+		message = &internal.SendFileResult{}
+	case messageTypeInviteRequest:
+		message = &internal.InviteRequest{}
+	case messageTypeInviteResponse:
+		message = &internal.InviteResponse{}
+	case messageTypeBrokerHello:
+		message = &internal.BrokerHello{}
+	case messageTypeEnrollRequest:
+		message = &internal.EnrollRequest{}
+	case messageTypeEnrollResponse:
+		message = &internal.EnrollResponse{}
 	default:
 		return 0, nil, errors.New("Unknown message")
 	}
@@ -112,10 +190,59 @@ func (p *protocol) receive() (messageType, proto.Message, error) {
 		return 0, nil, err
 	}
 
-	log.Println("<- [" + messageTypes[messageType] + "] " + message.(proto.Message).String())
+	if p.messageSize != nil {
+		p.messageSize.observe(float64(messageLength), "received", messageTypes[messageType])
+	}
+
+	p.logger.Debug("<- ["+messageTypes[messageType]+"]", "type", messageTypes[messageType], "size", messageLength, "message", loggedMessage{message})
 	return messageType, message, nil
 }
 
 func (p *protocol) close() error {
 	return p.stream.Close()
 }
+
+// loggedMessage is logged instead of the message itself: it is only formatted if the logger
+// writes the line, and it hides signatures, MACs, nonces and invite tokens, so that debug logs
+// cannot be used to impersonate a client or broker
+type loggedMessage struct {
+	message proto.Message
+}
+
+const redacted = "[redacted]"
+
+func (m loggedMessage) String() string {
+	message := proto.Clone(m.message)
+
+	switch message := message.(type) {
+	case *internal.CheckinRequest:
+		message.Signature = redactBytes(message.Signature)
+	case *internal.ForwardRequest:
+		message.Invite = redactString(message.Invite)
+	case *internal.InviteResponse:
+		message.Token = redactString(message.Token)
+	case *internal.BrokerHello:
+		message.Mac = redactBytes(message.Mac)
+		message.Nonce = redactBytes(message.Nonce)
+	case *internal.EnrollRequest:
+		message.Mac = redactBytes(message.Mac)
+	case *internal.EnrollResponse:
+		message.Mac = redactBytes(message.Mac)
+	}
+
+	return strings.TrimSpace(message.String())
+}
+
+func redactBytes(value []byte) []byte {
+	if len(value) == 0 {
+		return value
+	}
+	return []byte(redacted)
+}
+
+func redactString(value string) string {
+	if value == "" {
+		return value
+	}
+	return redacted
+}
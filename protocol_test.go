@@ -0,0 +1,39 @@
+package natter
+
+import (
+	"github.com/golang/protobuf/proto"
+	"heckel.io/natter/internal"
+	"strings"
+	"testing"
+)
+
+func TestLoggedMessageRedacted(t *testing.T) {
+	tests := []struct {
+		message proto.Message
+		secrets []string
+	}{
+		{&internal.CheckinRequest{Source: "alice", Signature: []byte("signature")}, []string{"signature"}},
+		{&internal.ForwardRequest{Source: "alice", Invite: "abcdefgh"}, []string{"abcdefgh"}},
+		{&internal.InviteResponse{Id: "alice", Token: "abcdefgh"}, []string{"abcdefgh"}},
+		{&internal.BrokerHello{Broker: "alice", Mac: []byte("mac"), Nonce: []byte("nonce")}, []string{"mac", "nonce"}},
+		{&internal.EnrollRequest{ClientId: "alice", Mac: []byte("mac")}, []string{"mac"}},
+		{&internal.EnrollResponse{Id: "alice", Mac: []byte("mac")}, []string{"mac"}},
+	}
+
+	for _, test := range tests {
+		original := proto.Clone(test.message)
+		logged := loggedMessage{test.message}.String()
+
+		if !strings.Contains(logged, "alice") || !strings.Contains(logged, redacted) {
+			t.Errorf("expected message with redacted fields, got %s", logged)
+		}
+		for _, secret := range test.secrets {
+			if strings.Contains(logged, `"`+secret+`"`) {
+				t.Errorf("expected %s to be redacted, got %s", secret, logged)
+			}
+		}
+		if !proto.Equal(original, test.message) {
+			t.Errorf("expected message itself to be unchanged, got %s", test.message.String())
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package natter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitMaxChunk is the largest write that is passed through at once, so that
+// rate limited streams are smooth rather than bursty
+const rateLimitMaxChunk = 16 * 1024
+
+// RateLimit limits the throughput of a forward or of all forwards from a peer, see
+// ForwardOptions.RateLimit and Config.RateLimits. It applies to each direction separately.
+type RateLimit struct {
+	// Bytes per second, e.g. 1048576 for 1 MiB/s
+	BytesPerSecond int64
+
+	// Number of bytes that may be sent at full speed after a stream was idle.
+	// If it is zero, it defaults to BytesPerSecond, i.e. one second worth of data.
+	Burst int64
+}
+
+// ParseRateLimit parses a rate limit of the form RATE[:BURST], e.g. 512K or 1M:4M. RATE and
+// BURST are bytes (per second), with an optional K, M or G suffix (powers of 1024).
+func ParseRateLimit(s string) (*RateLimit, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("invalid rate limit %s, expected RATE[:BURST]", s)
+	}
+
+	rate, err := parseRateBytes(parts[0])
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("invalid rate limit %s, expected RATE[:BURST], e.g. 512K or 1M:4M", s)
+	}
+
+	limit := &RateLimit{BytesPerSecond: rate}
+
+	if len(parts) == 2 {
+		limit.Burst, err = parseRateBytes(parts[1])
+		if err != nil || limit.Burst <= 0 {
+			return nil, fmt.Errorf("invalid burst in rate limit %s, expected RATE[:BURST], e.g. 512K or 1M:4M", s)
+		}
+	}
+
+	return limit, nil
+}
+
+func (l *RateLimit) String() string {
+	if l.Burst == 0 {
+		return formatRateBytes(l.BytesPerSecond)
+	}
+
+	return formatRateBytes(l.BytesPerSecond) + ":" + formatRateBytes(l.Burst)
+}
+
+func parseRateBytes(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	multiplier := int64(1)
+
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid number of bytes")
+	} else if n > math.MaxInt64/multiplier {
+		return 0, errors.New("number of bytes too large")
+	}
+
+	return n * multiplier, nil
+}
+
+func formatRateBytes(n int64) string {
+	switch {
+	case n >= 1024*1024*1024 && n%(1024*1024*1024) == 0:
+		return strconv.FormatInt(n/(1024*1024*1024), 10) + "G"
+	case n >= 1024*1024 && n%(1024*1024) == 0:
+		return strconv.FormatInt(n/(1024*1024), 10) + "M"
+	case n >= 1024 && n%1024 == 0:
+		return strconv.FormatInt(n/1024, 10) + "K"
+	default:
+		return strconv.FormatInt(n, 10)
+	}
+}
+
+// rateLimiter shapes the traffic of all streams it is used for, e.g. of all streams of a
+// forward. Each direction has its own token bucket. The limit can be changed at any time;
+// streams that are already running pick up the new limit with their next write.
+type rateLimiter struct {
+	sent     *tokenBucket
+	received *tokenBucket
+}
+
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	limiter := &rateLimiter{
+		sent:     &tokenBucket{},
+		received: &tokenBucket{},
+	}
+
+	limiter.setLimit(limit)
+	return limiter
+}
+
+// setLimit changes the limit. A nil limit removes it.
+func (l *rateLimiter) setLimit(limit *RateLimit) {
+	l.sent.setLimit(limit)
+	l.received.setLimit(limit)
+}
+
+func (l *rateLimiter) limit() *RateLimit {
+	return l.sent.limit()
+}
+
+// tokenBucket is a token bucket that allows going into debt: Taking more tokens than
+// there are makes the caller wait until the bucket has been refilled accordingly.
+type tokenBucket struct {
+	rate   float64 // Tokens (bytes) per second, zero means unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	sync.Mutex
+}
+
+func (b *tokenBucket) setLimit(limit *RateLimit) {
+	b.Lock()
+	defer b.Unlock()
+
+	if limit == nil {
+		b.rate, b.burst = 0, 0
+		return
+	}
+
+	b.rate = float64(limit.BytesPerSecond)
+	b.burst = float64(limit.Burst)
+	if b.burst == 0 {
+		b.burst = b.rate
+	}
+
+	if b.last.IsZero() || b.tokens > b.burst {
+		b.tokens = b.burst
+		b.last = time.Now()
+	}
+}
+
+func (b *tokenBucket) limit() *RateLimit {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate == 0 {
+		return nil
+	}
+
+	limit := &RateLimit{BytesPerSecond: int64(b.rate)}
+	if b.burst != b.rate {
+		limit.Burst = int64(b.burst)
+	}
+
+	return limit
+}
+
+// chunk returns the largest number of bytes that should be written at once
+func (b *tokenBucket) chunk() int {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate == 0 {
+		return math.MaxInt32
+	}
+
+	return int(math.Max(1, math.Min(b.burst, rateLimitMaxChunk)))
+}
+
+// take removes n tokens from the bucket, and returns how long the caller has to wait before using them
+func (b *tokenBucket) take(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate == 0 {
+		return 0
+	}
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimitedWriter passes all writes through to the underlying writer, waiting as
+// long as the token buckets of all limiters require. Writes are split into chunks.
+type rateLimitedWriter struct {
+	writer  io.Writer
+	buckets []*tokenBucket
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for written < len(p) {
+		chunk := len(p) - written
+		for _, bucket := range w.buckets {
+			if max := bucket.chunk(); chunk > max {
+				chunk = max
+			}
+		}
+
+		for _, bucket := range w.buckets {
+			if wait := bucket.take(chunk); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		n, err := w.writer.Write(p[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,114 @@
+package natter
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		s     string
+		rate  int64
+		burst int64
+		ok    bool
+	}{
+		{"512", 512, 0, true},
+		{"512K", 512 * 1024, 0, true},
+		{"1m:4m", 1024 * 1024, 4 * 1024 * 1024, true},
+		{"2GB", 2 * 1024 * 1024 * 1024, 0, true},
+		{"8589934591G", 8589934591 * 1024 * 1024 * 1024, 0, true},
+		{"8589934592G", 0, 0, false}, // Overflows int64
+		{"9223372036854775807K", 0, 0, false},
+		{"1M:9223372036854775807M", 0, 0, false},
+		{"-1K", 0, 0, false},
+		{"-9223372036854775807K", 0, 0, false},
+		{"0", 0, 0, false},
+		{"1M:0", 0, 0, false},
+		{"1M:2M:3M", 0, 0, false},
+		{"fast", 0, 0, false},
+		{"", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		limit, err := ParseRateLimit(test.s)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: expected error, got %+v", test.s, limit)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.s, err)
+		} else if limit.BytesPerSecond != test.rate || limit.Burst != test.burst {
+			t.Errorf("%s: expected %d:%d, got %d:%d", test.s, test.rate, test.burst, limit.BytesPerSecond, limit.Burst)
+		} else if parsed, err := ParseRateLimit(limit.String()); err != nil || *parsed != *limit {
+			t.Errorf("%s: expected %s to parse to the same limit, got %+v, %v", test.s, limit.String(), parsed, err)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := &tokenBucket{}
+	if wait := bucket.take(math.MaxInt32); wait != 0 {
+		t.Errorf("expected unlimited bucket not to wait, got %s", wait)
+	}
+	if bucket.limit() != nil {
+		t.Errorf("expected no limit")
+	}
+
+	bucket.setLimit(&RateLimit{BytesPerSecond: 1000, Burst: 2000})
+	if limit := bucket.limit(); limit == nil || limit.BytesPerSecond != 1000 || limit.Burst != 2000 {
+		t.Errorf("expected limit 1000:2000, got %+v", limit)
+	}
+	if chunk := bucket.chunk(); chunk != 2000 {
+		t.Errorf("expected chunk of 2000 bytes, got %d", chunk)
+	}
+
+	// The burst can be used right away, everything above it has to be waited for
+	if wait := bucket.take(2000); wait != 0 {
+		t.Errorf("expected burst not to wait, got %s", wait)
+	}
+	if wait := bucket.take(500); wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("expected to wait about 500ms, got %s", wait)
+	}
+	if wait := bucket.take(1000); wait < 1400*time.Millisecond || wait > 1500*time.Millisecond {
+		t.Errorf("expected debt to add up to about 1.5s, got %s", wait)
+	}
+
+	// Without a burst, one second worth of data can be sent at once
+	bucket.setLimit(&RateLimit{BytesPerSecond: 1000})
+	if limit := bucket.limit(); limit == nil || limit.BytesPerSecond != 1000 || limit.Burst != 0 {
+		t.Errorf("expected limit 1000, got %+v", limit)
+	}
+	if chunk := bucket.chunk(); chunk != 1000 {
+		t.Errorf("expected chunk of 1000 bytes, got %d", chunk)
+	}
+
+	bucket.setLimit(nil)
+	if wait := bucket.take(1000); wait != 0 || bucket.limit() != nil {
+		t.Errorf("expected removed limit not to wait, got %s", wait)
+	}
+}
+
+func TestRateLimitedWriter(t *testing.T) {
+	bucket := &tokenBucket{}
+	bucket.setLimit(&RateLimit{BytesPerSecond: 100 * 1024, Burst: 1024})
+
+	var buf bytes.Buffer
+	writer := &rateLimitedWriter{writer: &buf, buckets: []*tokenBucket{bucket}}
+	data := bytes.Repeat([]byte("x"), 20*1024)
+
+	start := time.Now()
+	n, err := writer.Write(data)
+	if err != nil || n != len(data) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("expected all %d bytes to be written, got %d, %v", len(data), n, err)
+	}
+
+	// 1K burst, then 19K at 100K/s
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected write to be limited to take about 190ms, took %s", elapsed)
+	}
+}
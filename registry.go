@@ -0,0 +1,328 @@
+package natter
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileRegistryFlushInterval = time.Second
+	fileRegistrySuffix        = ".json"
+)
+
+// Registry stores which clients are connected to which broker, so that several brokers can
+// share their clients, see Config.Registry. Brokers register their clients with every check-in,
+// and look up clients that are not connected to them. Entries whose last check-in is too old
+// are treated as offline, so entries of brokers that crashed do not linger.
+//
+// Implementations must be safe for concurrent use.
+type Registry interface {
+	// Register adds or updates the entry of a client
+	Register(entry *RegistryEntry) error
+
+	// Unregister removes the entry of a client, unless it was registered by another broker in the
+	// meantime, i.e. the client moved to another broker
+	Unregister(clientId string, broker string) error
+
+	// Lookup returns the entry of a client, or nil if it is not registered
+	Lookup(clientId string) (*RegistryEntry, error)
+
+	// List returns the entries of all registered clients
+	List() ([]*RegistryEntry, error)
+}
+
+// RegistryEntry describes a client as seen by the broker it is connected to
+type RegistryEntry struct {
+	ClientId    string    `json:"clientId"`
+	Broker      string    `json:"broker"` // Cluster address of the broker, see Config.ClusterAddr
+	Addr        string    `json:"addr"`   // UDP address of the client, as seen by the broker
+	LocalAddr   string    `json:"localAddr,omitempty"`
+	NatType     string    `json:"natType"`
+	Services    []string  `json:"services,omitempty"`
+	AllowPeers  []string  `json:"allowPeers,omitempty"`
+	Invites     []string  `json:"invites,omitempty"` // Tokens of the client's unused invites, see Client.Share
+	LastCheckin time.Time `json:"lastCheckin"`
+}
+
+// allows returns true if the client allows connections from the given peer, see brokerClient.allows
+func (e *RegistryEntry) allows(peer string) bool {
+	return allowsPeer(e.AllowPeers, peer)
+}
+
+// offers returns true if the client advertised the given service, see brokerClient.offers
+func (e *RegistryEntry) offers(service string) bool {
+	for _, s := range e.Services {
+		if s == service {
+			return true
+		}
+	}
+
+	return false
+}
+
+type memoryRegistry struct {
+	entries map[string]*RegistryEntry
+	mutex   sync.RWMutex
+}
+
+// NewMemoryRegistry creates a registry that only lives in memory. It is used if no other registry
+// is configured, and can be shared by several brokers in the same process.
+func NewMemoryRegistry() Registry {
+	return &memoryRegistry{
+		entries: make(map[string]*RegistryEntry),
+	}
+}
+
+func (r *memoryRegistry) Register(entry *RegistryEntry) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	copied := *entry
+	r.entries[entry.ClientId] = &copied
+
+	return nil
+}
+
+func (r *memoryRegistry) Unregister(clientId string, broker string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if entry, ok := r.entries[clientId]; ok && entry.Broker == broker {
+		delete(r.entries, clientId)
+	}
+
+	return nil
+}
+
+func (r *memoryRegistry) Lookup(clientId string) (*RegistryEntry, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	entry, ok := r.entries[clientId]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *entry
+	return &copied, nil
+}
+
+func (r *memoryRegistry) List() ([]*RegistryEntry, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	entries := make([]*RegistryEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		copied := *entry
+		entries = append(entries, &copied)
+	}
+
+	return entries, nil
+}
+
+// fileRegistry stores the clients of each broker in its own file in a shared directory, e.g. on
+// a network file system. Since every file is only written by one broker, no locking is required.
+// Writes are batched and flushed once per second; readers re-read files that changed.
+type fileRegistry struct {
+	dir     string
+	entries map[string]map[string]*RegistryEntry // Broker -> client ID -> entry, of this process only
+	dirty   map[string]bool
+	cache   map[string]*fileRegistryCache // File name -> last read
+	mutex   sync.Mutex
+}
+
+type fileRegistryCache struct {
+	modified time.Time
+	size     int64 // File systems with coarse timestamps may not change the time of quick successive writes
+	entries  []*RegistryEntry
+}
+
+// NewFileRegistry creates a registry that is stored in the given directory. Several brokers (on
+// different hosts) can share the directory, each broker writes its clients to its own file.
+// Clients of a broker that is restarted are known to the other brokers until they time out.
+func NewFileRegistry(dir string) (Registry, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.New("cannot create registry directory: " + err.Error())
+	}
+
+	registry := &fileRegistry{
+		dir:     dir,
+		entries: make(map[string]map[string]*RegistryEntry),
+		dirty:   make(map[string]bool),
+		cache:   make(map[string]*fileRegistryCache),
+	}
+
+	go registry.flushLoop()
+
+	return registry, nil
+}
+
+func (r *fileRegistry) Register(entry *RegistryEntry) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.entries[entry.Broker]; !ok {
+		r.entries[entry.Broker] = r.load(entry.Broker)
+	}
+
+	copied := *entry
+	r.entries[entry.Broker][entry.ClientId] = &copied
+	r.dirty[entry.Broker] = true
+
+	return nil
+}
+
+func (r *fileRegistry) Unregister(clientId string, broker string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.entries[broker]; !ok {
+		r.entries[broker] = r.load(broker)
+	}
+
+	if _, ok := r.entries[broker][clientId]; ok {
+		delete(r.entries[broker], clientId)
+		r.dirty[broker] = true
+	}
+
+	return nil
+}
+
+func (r *fileRegistry) Lookup(clientId string) (*RegistryEntry, error) {
+	entries, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.ClientId == clientId {
+			return entry, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// List reads the files of all brokers. If a client is registered by several brokers, e.g.
+// because it moved to another broker, the entry with the most recent check-in wins.
+func (r *fileRegistry) List() ([]*RegistryEntry, error) {
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	latest := make(map[string]*RegistryEntry)
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), fileRegistrySuffix) {
+			continue
+		}
+
+		cached, ok := r.cache[file.Name()]
+		if !ok || !cached.modified.Equal(file.ModTime()) || cached.size != file.Size() {
+			data, err := ioutil.ReadFile(filepath.Join(r.dir, file.Name()))
+			if err != nil {
+				continue // Removed in the meantime
+			}
+
+			cached = &fileRegistryCache{modified: file.ModTime(), size: file.Size()}
+			if err := json.Unmarshal(data, &cached.entries); err != nil {
+				continue // Being written in the meantime, or not a registry file
+			}
+
+			r.cache[file.Name()] = cached
+		}
+
+		for _, entry := range cached.entries {
+			if existing, ok := latest[entry.ClientId]; !ok || entry.LastCheckin.After(existing.LastCheckin) {
+				copied := *entry
+				latest[entry.ClientId] = &copied
+			}
+		}
+	}
+
+	entries := make([]*RegistryEntry, 0, len(latest))
+	for _, entry := range latest {
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (r *fileRegistry) flushLoop() {
+	for {
+		time.Sleep(fileRegistryFlushInterval)
+		r.flush()
+	}
+}
+
+// load reads the entries that a previous run of the given broker left behind, so that its clients
+// remain known to other brokers until they re-register or time out
+func (r *fileRegistry) load(broker string) map[string]*RegistryEntry {
+	entries := make(map[string]*RegistryEntry)
+
+	data, err := ioutil.ReadFile(filepath.Join(r.dir, registryFileName(broker)))
+	if err != nil {
+		return entries
+	}
+
+	var existing []*RegistryEntry
+	if err := json.Unmarshal(data, &existing); err != nil {
+		return entries
+	}
+
+	for _, entry := range existing {
+		entries[entry.ClientId] = entry
+	}
+
+	return entries
+}
+
+// flush writes the files of all brokers whose entries changed, and drops entries that timed out.
+// Files are replaced atomically, so that readers never see a partially written file.
+func (r *fileRegistry) flush() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for broker := range r.dirty {
+		entries := make([]*RegistryEntry, 0, len(r.entries[broker]))
+		for id, entry := range r.entries[broker] {
+			if time.Since(entry.LastCheckin) > brokerClientTimeout {
+				delete(r.entries[broker], id)
+				continue
+			}
+
+			entries = append(entries, entry)
+		}
+
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			continue
+		}
+
+		filename := filepath.Join(r.dir, registryFileName(broker))
+		if err := ioutil.WriteFile(filename+".tmp", data, 0600); err != nil {
+			continue // Retried with the next flush
+		}
+
+		if err := os.Rename(filename+".tmp", filename); err != nil {
+			continue
+		}
+
+		delete(r.dirty, broker)
+	}
+}
+
+// registryFileName returns the name of the file that holds the clients of the given broker
+func registryFileName(broker string) string {
+	return strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(broker) + fileRegistrySuffix
+}
@@ -0,0 +1,118 @@
+package natter
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natter-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files, err := NewFileRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registries := map[string]Registry{"memory": NewMemoryRegistry(), "file": files}
+
+	// File registries only write their entries once per second
+	flush := func(registry Registry) {
+		if r, ok := registry.(*fileRegistry); ok {
+			r.flush()
+		}
+	}
+
+	for name, registry := range registries {
+		alice := &RegistryEntry{ClientId: "alice", Broker: "b1:2586", Addr: "1.2.3.4:1234", LastCheckin: time.Now()}
+		if err := registry.Register(alice); err != nil {
+			t.Fatal(err)
+		}
+		alice.Addr = "changed" // Registries keep a copy
+		flush(registry)
+
+		if entry, err := registry.Lookup("alice"); err != nil || entry == nil || entry.Addr != "1.2.3.4:1234" {
+			t.Errorf("%s: expected entry of alice, got %+v, %v", name, entry, err)
+		}
+		if entry, err := registry.Lookup("bob"); err != nil || entry != nil {
+			t.Errorf("%s: expected no entry for bob, got %+v, %v", name, entry, err)
+		}
+
+		// Only the broker the client is registered with can unregister it
+		if err := registry.Unregister("alice", "b2:2586"); err != nil {
+			t.Fatal(err)
+		}
+		flush(registry)
+		if entries, err := registry.List(); err != nil || len(entries) != 1 {
+			t.Errorf("%s: expected alice to remain registered, got %d entries, %v", name, len(entries), err)
+		}
+		if err := registry.Unregister("alice", "b1:2586"); err != nil {
+			t.Fatal(err)
+		}
+		flush(registry)
+		if entry, err := registry.Lookup("alice"); err != nil || entry != nil {
+			t.Errorf("%s: expected alice to be unregistered, got %+v, %v", name, entry, err)
+		}
+	}
+}
+
+func TestFileRegistryShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natter-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r1, err := NewFileRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := NewFileRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice moved from b1 to b2, the most recent check-in wins
+	r1.Register(&RegistryEntry{ClientId: "alice", Broker: "b1:2586", LastCheckin: time.Now().Add(-time.Minute)})
+	r1.Register(&RegistryEntry{ClientId: "carol", Broker: "b1:2586", LastCheckin: time.Now().Add(-2 * brokerClientTimeout)})
+	r2.Register(&RegistryEntry{ClientId: "alice", Broker: "b2:2586", LastCheckin: time.Now()})
+	r1.(*fileRegistry).flush()
+	r2.(*fileRegistry).flush()
+
+	if entry, err := r1.Lookup("alice"); err != nil || entry == nil || entry.Broker != "b2:2586" {
+		t.Errorf("expected alice on b2, got %+v, %v", entry, err)
+	}
+
+	// Timed out entries are dropped when the file is written
+	if entry, err := r2.Lookup("carol"); err != nil || entry != nil {
+		t.Errorf("expected timed out entry of carol to be dropped, got %+v, %v", entry, err)
+	}
+}
+
+func TestRegistryExpiry(t *testing.T) {
+	registry := NewMemoryRegistry()
+	b1 := newTestClusterBroker(t, "b1:2586", registry)
+
+	registry.Register(&RegistryEntry{ClientId: "alice", Broker: "b2:2586", LastCheckin: time.Now()})
+	registry.Register(&RegistryEntry{ClientId: "bob", Broker: "b2:2586", LastCheckin: time.Now().Add(-2 * brokerClientTimeout)})
+	registry.Register(&RegistryEntry{ClientId: "carol", Broker: "b1:2586", LastCheckin: time.Now()})
+
+	if entry := b1.lookupRemote("alice"); entry == nil {
+		t.Errorf("expected alice to be found on b2")
+	}
+	if entry := b1.lookupRemote("bob"); entry != nil {
+		t.Errorf("expected entry of bob to be expired, got %+v", entry)
+	}
+	if entry := b1.lookupRemote("carol"); entry != nil {
+		t.Errorf("expected own client carol not to be remote, got %+v", entry)
+	}
+
+	if remote := b1.remoteClients(); len(remote) != 1 || remote[0].ClientId != "alice" {
+		t.Errorf("expected only alice to be remote, got %d entries", len(remote))
+	}
+}
@@ -0,0 +1,101 @@
+package natter
+
+import (
+	"errors"
+	"strings"
+)
+
+// ForwardSpec describes a forward, as parsed from the forward spec syntax used
+// in the config file and on the command line (see ParseForwardSpec).
+type ForwardSpec struct {
+	// Local TCP address to listen on, e.g. :8022. If empty, STDIN is forwarded.
+	LocalAddr string
+
+	// Client identifier of the target client, e.g. bob
+	Target string
+
+	// TCP address on the target client to forward to, e.g. :22 or 10.0.1.1:22
+	TargetForwardAddr string
+
+	// Command to execute on the target client, e.g. []string{"zfs", "recv", "pool"}
+	TargetCommand []string
+
+	// Name of the service offered by the target client, e.g. ssh. If it is set,
+	// TargetForwardAddr and TargetCommand are empty.
+	Service string
+
+	// Rate limit of the forward, see ForwardOptions.RateLimit. It is not part of the spec
+	// syntax, and can be changed without re-creating the forward.
+	RateLimit *RateLimit
+
+	// Compression of the forward's streams, see ForwardOptions.Compression. It is not part of the
+	// spec syntax either.
+	Compression string
+}
+
+// ParseForwardSpec parses a forward spec, as used in the config file and on the command line:
+//
+//	LOCALPORT:TARGET:TARGETPORT           - Forward local TCP port to target TCP port
+//	LOCALPORT:TARGET:OTHERHOST:OTHERPORT  - Forward local TCP port to another host on target's network
+//	LOCALPORT:TARGET:                     - Forward local TCP port to target command
+//	LOCALPORT:TARGET/SERVICE              - Forward local TCP port to a service offered by target
+//	:TARGET:TARGETPORT                    - Forward STDIN to target TCP port
+//
+// The command is only used (and required) if the spec forwards to a target command.
+func ParseForwardSpec(spec string, command []string) (*ForwardSpec, error) {
+	parts := strings.Split(spec, ":")
+	forward := &ForwardSpec{}
+
+	if len(parts) == 2 && strings.Count(parts[1], "/") == 1 {
+		service := strings.SplitN(parts[1], "/", 2)
+		forward.Target = service[0]
+		forward.Service = service[1]
+
+		if forward.Service == "" {
+			return nil, errors.New("invalid spec " + spec + ", service cannot be empty")
+		}
+	} else if len(parts) == 3 {
+		forward.Target = parts[1]
+
+		if parts[2] == "" {
+			if len(command) == 0 {
+				return nil, errors.New("invalid spec " + spec + ", no command specified")
+			}
+
+			forward.TargetCommand = command
+		} else {
+			forward.TargetForwardAddr = ":" + parts[2]
+		}
+	} else if len(parts) == 4 {
+		forward.Target = parts[1]
+		forward.TargetForwardAddr = parts[2] + ":" + parts[3]
+	} else {
+		return nil, errors.New("invalid spec " + spec + ", expected LOCALPORT:TARGET:[TARGETHOST:]TARGETPORT or LOCALPORT:TARGET/SERVICE")
+	}
+
+	if forward.Target == "" {
+		return nil, errors.New("invalid spec " + spec + ", target cannot be empty")
+	}
+
+	if parts[0] != "" {
+		forward.LocalAddr = ":" + parts[0]
+	}
+
+	return forward, nil
+}
+
+// String returns the forward spec in the syntax understood by ParseForwardSpec,
+// followed by the target command, if any.
+func (s *ForwardSpec) String() string {
+	spec := strings.TrimPrefix(s.LocalAddr, ":") + ":" + s.Target
+
+	if s.Service != "" {
+		spec += "/" + s.Service
+	} else if len(s.TargetCommand) > 0 {
+		spec += ": " + strings.Join(s.TargetCommand, " ")
+	} else {
+		spec += ":" + strings.TrimPrefix(s.TargetForwardAddr, ":")
+	}
+
+	return spec
+}
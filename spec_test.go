@@ -0,0 +1,63 @@
+package natter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseForwardSpec(t *testing.T) {
+	tests := []struct {
+		spec     string
+		command  []string
+		expected *ForwardSpec
+	}{
+		{"8022:bob:22", nil, &ForwardSpec{LocalAddr: ":8022", Target: "bob", TargetForwardAddr: ":22"}},
+		{"8022:bob:10.0.1.1:22", nil, &ForwardSpec{LocalAddr: ":8022", Target: "bob", TargetForwardAddr: "10.0.1.1:22"}},
+		{"9000:bob:", []string{"zfs", "recv", "pool"}, &ForwardSpec{LocalAddr: ":9000", Target: "bob", TargetCommand: []string{"zfs", "recv", "pool"}}},
+		{"8022:bob/ssh", nil, &ForwardSpec{LocalAddr: ":8022", Target: "bob", Service: "ssh"}},
+		{":bob:22", nil, &ForwardSpec{Target: "bob", TargetForwardAddr: ":22"}},
+	}
+
+	for _, test := range tests {
+		spec, err := ParseForwardSpec(test.spec, test.command)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.spec, err)
+			continue
+		} else if !reflect.DeepEqual(spec, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.spec, test.expected, spec)
+		}
+
+		// String appends the command, which is passed separately when parsing
+		expected := strings.TrimSpace(test.spec + " " + strings.Join(test.command, " "))
+		if spec.String() != expected {
+			t.Errorf("%s: expected string %q, got %q", test.spec, expected, spec.String())
+		}
+		if len(test.command) == 0 {
+			if parsed, err := ParseForwardSpec(spec.String(), nil); err != nil || !reflect.DeepEqual(parsed, spec) {
+				t.Errorf("%s: expected %s to parse to the same spec, got %+v, %v", test.spec, spec.String(), parsed, err)
+			}
+		}
+	}
+}
+
+func TestParseForwardSpecInvalid(t *testing.T) {
+	tests := []struct {
+		spec    string
+		command []string
+	}{
+		{"8022", nil},
+		{"8022:bob", nil},
+		{"8022:bob/", nil},
+		{"8022:/ssh", nil},
+		{"8022::22", nil},
+		{"9000:bob:", nil},
+		{"1:2:3:4:5", nil},
+	}
+
+	for _, test := range tests {
+		if spec, err := ParseForwardSpec(test.spec, test.command); err == nil {
+			t.Errorf("%s: expected error, got %+v", test.spec, spec)
+		}
+	}
+}